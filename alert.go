@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+	"time"
+)
+
+// defaultAlertWindow is the trailing window a drop is compared against when no window is configured
+const defaultAlertWindow = "1h"
+
+// alertRule is a condition on a table's difference between runs, which fires an alert when it is met
+// Table, Database and Kind are optional, and restrict the rule to one table, database or table list, otherwise every table is checked
+// Exactly one of Below, Above, Drop or Anomaly is set:
+// Below and Above compare the difference against a threshold, for example "Message delta < 1"
+// Drop is a percentage the rate may fall by, compared to the average rate over the trailing Window of history
+// Anomaly is the most deviations the rate may be from its usual band for the time of day or week, in either direction, see getAnomalies
+// For is the number of consecutive runs the condition must be met for before the alert fires, defaulting to 1
+type alertRule struct {
+	Name     string
+	Database string
+	Table    string
+	Kind     string
+	Below    *float64
+	Above    *float64
+	Drop     *float64
+	Anomaly  *float64
+	Window   string
+	For      int
+}
+
+// alertState is the state of a single rule for a single table, as recorded in the counts YAML between runs
+// Breaches is the number of consecutive runs the condition has been met for
+// Since is when the alert started firing, and is zero if it isn't firing
+type alertState struct {
+	Rule     string    `yaml:"rule"`
+	Database string    `yaml:"database"`
+	Table    string    `yaml:"table"`
+	Kind     string    `yaml:"kind"`
+	Breaches int       `yaml:"breaches"`
+	Firing   bool      `yaml:"firing"`
+	Since    time.Time `yaml:"since,omitempty"`
+}
+
+// alertEvent is a change in an alert, either it starting to fire or being resolved
+// Value is the difference, or the rate for drop rules, that the rule was evaluated against
+// DedupKey identifies the alert across runs, so the firing and resolved events of an alert can be matched by a channel
+type alertEvent struct {
+	Rule     string
+	Database string
+	Table    string
+	Kind     string
+	Status   string
+	Value    float64
+	Message  string
+	DedupKey string
+	Time     time.Time
+}
+
+// alert event statuses
+const (
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+)
+
+// getAlerts checks the configured alert rules against the differences of a run, loading the history needed for drop rules
+// lastState is the state of the last run, and interval the time since it
+// anomalies are the anomaly results of the run, used by anomaly rules, or nil if anomaly detection is not configured
+// It returns the alert state to record for the next run, and the events to notify, as well as an error if the rules could not be evaluated
+func getAlerts(config applicationConfig, diffCountCollections map[string]countCollection, lastState countState, interval time.Duration, collectedAt time.Time, anomalies map[string]map[countKey]anomalyResult) (map[string]alertState, []alertEvent, error) {
+	var history []historyRecord
+
+	if hasDropAlerts(config.Alerts) {
+		if config.History.Path == "" {
+			return lastState.Alerts, nil, fmt.Errorf("drop alerts need history.path to be configured")
+		}
+
+		// Only the longest window of history is needed
+		var longest time.Duration
+		for _, rule := range config.Alerts {
+			if window, err := getAlertWindow(rule); err == nil && window > longest {
+				longest = window
+			}
+		}
+
+		var err error
+		history, err = readRecentHistory(config.History.Path, collectedAt.Add(-longest))
+		if err != nil {
+			return lastState.Alerts, nil, err
+		}
+	}
+
+	alerts, events, err := evaluateAlerts(config.Alerts, diffCountCollections, lastState.Alerts, history, anomalies, interval, collectedAt)
+	for _, event := range events {
+		slog.Debug("Alert changed", "rule", event.Rule, "database", event.Database, "table", event.Table, "status", event.Status)
+	}
+
+	return alerts, events, err
+}
+
+// evaluateAlerts checks every rule against the differences of a run
+// lastAlerts is the alert state from the counts YAML of the last run, and history is used to find the trailing average of drop rules
+// anomalies are the anomaly results of the run, keyed by database and table, for anomaly rules
+// interval is the time since the last run, used to turn differences into rates
+// It returns the alert state to record for the next run, and the events of any alerts that started firing or were resolved
+func evaluateAlerts(rules []alertRule, diffCountCollections map[string]countCollection, lastAlerts map[string]alertState, history []historyRecord, anomalies map[string]map[countKey]anomalyResult, interval time.Duration, collectedAt time.Time) (map[string]alertState, []alertEvent, error) {
+	alerts := make(map[string]alertState)
+	evaluated := make(map[string]bool)
+	ruleNames := make(map[string]bool)
+	var events []alertEvent
+
+	for _, rule := range rules {
+		ruleNames[rule.Name] = true
+		for _, countCollectionName := range getSortedKeys(diffCountCollections) {
+			// Go through each database and table the rule applies to
+			if rule.Database != "" && rule.Database != countCollectionName {
+				continue
+			}
+			countCollection := diffCountCollections[countCollectionName]
+
+			for _, kind := range []string{"increment", "row"} {
+				diffs := countCollection.Increment
+				if kind == "row" {
+					diffs = countCollection.Row
+				}
+
+				if rule.Kind != "" && rule.Kind != kind {
+					continue
+				}
+
+				for _, table := range getSortedKeys(diffs) {
+					if rule.Table != "" && rule.Table != table {
+						continue
+					}
+					delta := diffs[table]
+
+					var anomaly *anomalyResult
+					if result, ok := anomalies[countCollectionName][countKey{Kind: kind, Table: table}]; ok {
+						anomaly = &result
+					}
+
+					breached, value, description, err := checkAlertRule(rule, countCollectionName, kind, table, delta, history, anomaly, interval, collectedAt)
+					if err != nil {
+						return lastAlerts, nil, err
+					}
+
+					key := getAlertKey(rule, countCollectionName, kind, table)
+					evaluated[key] = true
+					alert := lastAlerts[key]
+					alert.Rule, alert.Database, alert.Table, alert.Kind = rule.Name, countCollectionName, table, kind
+
+					event := alertEvent{
+						Rule:     rule.Name,
+						Database: countCollectionName,
+						Table:    table,
+						Kind:     kind,
+						Value:    value,
+						DedupKey: "rowmetrics/" + key,
+						Time:     collectedAt,
+					}
+
+					if breached {
+						// Count the run, and fire once the condition has been met for enough consecutive runs
+						alert.Breaches++
+						if !alert.Firing && alert.Breaches >= getAlertFor(rule) {
+							alert.Firing = true
+							alert.Since = collectedAt.UTC()
+							event.Status = alertFiring
+							event.Message = fmt.Sprintf("%s: %s in database %s %s", rule.Name, table, countCollectionName, description)
+							if alert.Breaches > 1 {
+								event.Message += fmt.Sprintf(", for %d consecutive runs", alert.Breaches)
+							}
+							events = append(events, event)
+						}
+					} else {
+						// Reset the count, and resolve the alert if it was firing
+						if alert.Firing {
+							event.Status = alertResolved
+							event.Message = fmt.Sprintf("%s: %s in database %s is back to normal, with a delta of %d", rule.Name, table, countCollectionName, delta)
+							events = append(events, event)
+						}
+						alert.Breaches = 0
+						alert.Firing = false
+						alert.Since = time.Time{}
+					}
+
+					if alert.Breaches > 0 || alert.Firing {
+						// Only alerts with something to remember are recorded
+						alerts[key] = alert
+					}
+				}
+			}
+		}
+	}
+
+	for key, alert := range lastAlerts {
+		// Keep the state of tables that weren't counted this run, such as missing tables, as long as their rule still exists
+		if !evaluated[key] && ruleNames[alert.Rule] {
+			alerts[key] = alert
+		}
+	}
+
+	return alerts, events, nil
+}
+
+// checkAlertRule checks a single table's difference against a rule
+// anomaly is the table's anomaly result, or nil if it has none
+// It returns whether the condition is met, the value it was evaluated against and a description of it, as well as an error if the rule is invalid
+func checkAlertRule(rule alertRule, database string, kind string, table string, delta int, history []historyRecord, anomaly *anomalyResult, interval time.Duration, collectedAt time.Time) (bool, float64, string, error) {
+	switch {
+	case rule.Below != nil:
+		return float64(delta) < *rule.Below, float64(delta), fmt.Sprintf("has a delta of %d, below %g", delta, *rule.Below), nil
+	case rule.Above != nil:
+		return float64(delta) > *rule.Above, float64(delta), fmt.Sprintf("has a delta of %d, above %g", delta, *rule.Above), nil
+	case rule.Drop != nil:
+		window, err := getAlertWindow(rule)
+		if err != nil {
+			return false, 0, "", err
+		}
+		if interval <= 0 {
+			// Without the time since the last run there is no rate to compare
+			return false, 0, "", nil
+		}
+
+		rate := float64(delta) / interval.Seconds()
+		average, ok := getTrailingRate(history, database, table, kind, collectedAt.Add(-window))
+		if !ok || average <= 0 {
+			// Without any history in the window, or any inserts in it, there is nothing to drop from
+			return false, rate, "", nil
+		}
+
+		dropped := (1 - rate/average) * 100
+		return dropped >= *rule.Drop, rate, fmt.Sprintf("has a rate of %.3f/s, %.0f%% below its trailing %s average of %.3f/s", rate, dropped, formatDuration(window), average), nil
+	case rule.Anomaly != nil:
+		if anomaly == nil || anomaly.Learning {
+			// Tables without enough history to know what is usual are never anomalous
+			return false, 0, "", nil
+		}
+
+		return math.Abs(anomaly.Score) > *rule.Anomaly, anomaly.Score, fmt.Sprintf("has a rate of %.3f/s, %.1f deviations from its usual %.3f/s at this time", anomaly.Rate, anomaly.Score, anomaly.Median), nil
+	}
+
+	return false, 0, "", fmt.Errorf("alert %q has no below, above, drop or anomaly condition", rule.Name)
+}
+
+// getTrailingRate finds the average rate of a table over the history records collected since a time
+// It returns the rate per second, as well as whether there were any records to average
+func getTrailingRate(history []historyRecord, database string, table string, kind string, since time.Time) (float64, bool) {
+	var deltas, seconds float64
+	for _, record := range history {
+		if record.Database != database || record.Table != table || record.Kind != kind || record.Delta == nil || record.Time.Before(since) {
+			continue
+		}
+		deltas += float64(*record.Delta)
+		seconds += record.Interval
+	}
+
+	if seconds <= 0 {
+		return 0, false
+	}
+
+	return deltas / seconds, true
+}
+
+// getAlertKey returns the key a rule's state for a table is recorded under in the counts YAML
+// The kind is part of the key, as the same table may be counted as both kinds, each with its own state
+func getAlertKey(rule alertRule, database string, kind string, table string) string {
+	return rule.Name + "/" + database + "/" + kind + "/" + table
+}
+
+// getAlertFor returns the number of consecutive runs a rule's condition must be met for, defaulting to 1
+func getAlertFor(rule alertRule) int {
+	if rule.For < 1 {
+		return 1
+	}
+
+	return rule.For
+}
+
+// getAlertWindow parses the trailing window of a drop rule, or the default if none is configured
+// It returns the window, as well as an error if it could not be parsed
+func getAlertWindow(rule alertRule) (time.Duration, error) {
+	window := rule.Window
+	if window == "" {
+		window = defaultAlertWindow
+	}
+
+	duration, err := parseLongDuration(window)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("alert %q has an invalid window %q", rule.Name, window)
+	}
+
+	return duration, nil
+}
+
+// hasDropAlerts returns whether any rule needs history to be evaluated
+func hasDropAlerts(rules []alertRule) bool {
+	for _, rule := range rules {
+		if rule.Drop != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// formatDuration formats a duration without any trailing zero units, such as "1h" rather than "1h0m0s"
+func formatDuration(duration time.Duration) string {
+	formatted := duration.String()
+	if strings.HasSuffix(formatted, "m0s") {
+		formatted = strings.TrimSuffix(formatted, "0s")
+	}
+	if strings.HasSuffix(formatted, "h0m") {
+		formatted = strings.TrimSuffix(formatted, "0m")
+	}
+
+	return formatted
+}
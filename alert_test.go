@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEvaluateAlertsKind(t *testing.T) {
+	below := 1.0
+	rules := []alertRule{{Name: "stalled", Table: "Sale", Below: &below}}
+	collectedAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	// Sale is counted as both kinds, and only its row count has stalled
+	diffs := map[string]countCollection{
+		"edge": {Increment: map[string]int{"Sale": 5}, Row: map[string]int{"Sale": 0}},
+	}
+
+	alerts, events, err := evaluateAlerts(rules, diffs, nil, nil, nil, time.Minute, collectedAt)
+	if err != nil {
+		t.Fatalf("evaluateAlerts returned an error: %s", err)
+	}
+	if len(events) != 1 || events[0].Kind != "row" || events[0].DedupKey != "rowmetrics/stalled/edge/row/Sale" {
+		t.Fatalf("events are %+v, expected the row count of Sale to fire", events)
+	}
+
+	// The next run, the increment stalls too, which fires separately rather than sharing the row count's state
+	diffs["edge"].Increment["Sale"] = 0
+	alerts, events, err = evaluateAlerts(rules, diffs, alerts, nil, nil, time.Minute, collectedAt.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("evaluateAlerts returned an error: %s", err)
+	}
+	if len(events) != 1 || events[0].Kind != "increment" {
+		t.Errorf("events are %+v, expected the increment of Sale to fire", events)
+	}
+	if len(alerts) != 2 {
+		t.Errorf("alerts are %+v, expected both kinds to be firing", alerts)
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"time"
+)
+
+// defaults for the anomaly configuration
+const (
+	defaultAnomalyBucket     = "1h"
+	defaultAnomalyLookback   = "28d"
+	defaultAnomalyMinSamples = 3
+)
+
+// madScale converts a median absolute deviation into an estimate of the standard deviation, for normally distributed rates
+const madScale = 1.4826
+
+// anomalyConfig is the configuration of anomaly detection, which scores each table's rate against its history
+// Seasonality is either "day" or "week", and decides whether a rate is compared to the same time of day, or of the same day of the week
+// Bucket is how close to the same time a past rate must have been collected to be compared, such as "1h" for half an hour either side
+// Lookback is how far back history is compared, and MinSamples the fewest past rates needed before a table is scored rather than learning
+// Timezone is the IANA name of the timezone days and weeks start in, defaulting to the local timezone
+type anomalyConfig struct {
+	Seasonality string
+	Bucket      string
+	Lookback    string
+	MinSamples  int `yaml:"minSamples"`
+	Timezone    string
+}
+
+// anomalyResult is how a single table's rate in a run compares to its past rates from the same time
+// Median and Deviation are the centre and scaled median absolute deviation of the past rates, which together form the expected band
+// Score is how many deviations the rate is from the median, negative if it is below it
+// Learning is whether there were too few past rates to score, in which case only Samples is set
+type anomalyResult struct {
+	Rate      float64
+	Median    float64
+	Deviation float64
+	Score     float64
+	Samples   int
+	Learning  bool
+}
+
+// anomalyParameters is the parsed form of an anomalyConfig
+type anomalyParameters struct {
+	period     time.Duration
+	bucket     time.Duration
+	lookback   time.Duration
+	minSamples int
+	location   *time.Location
+}
+
+// getAnomalies scores the rate of every table in a run against its history from the same time of day or week
+// interval is the time since the last run, used to turn differences into rates
+// It returns the results keyed by database and then table, as well as an error if the configuration is invalid or the history could not be read
+func getAnomalies(config applicationConfig, diffCountCollections map[string]countCollection, interval time.Duration, collectedAt time.Time) (map[string]map[countKey]anomalyResult, error) {
+	parameters, err := getAnomalyParameters(config.Anomaly)
+	if err != nil {
+		return nil, err
+	}
+	if config.History.Path == "" {
+		return nil, fmt.Errorf("anomaly detection needs history.path to be configured")
+	}
+	if interval <= 0 {
+		// Without the time since the last run there is no rate to score
+		return nil, nil
+	}
+
+	history, err := readRecentHistory(config.History.Path, collectedAt.Add(-parameters.lookback))
+	if err != nil {
+		return nil, err
+	}
+
+	// Group the past rates by table, keeping only those from the same time of day or week
+	pastRates := make(map[string]map[countKey][]float64)
+	for _, record := range history {
+		if record.Delta == nil || record.Interval <= 0 || !isSameSeason(record.Time, collectedAt, parameters) {
+			continue
+		}
+
+		if pastRates[record.Database] == nil {
+			pastRates[record.Database] = make(map[countKey][]float64)
+		}
+		key := countKey{Kind: record.Kind, Table: record.Table}
+		pastRates[record.Database][key] = append(pastRates[record.Database][key], float64(*record.Delta)/record.Interval)
+	}
+
+	anomalies := make(map[string]map[countKey]anomalyResult)
+	for countCollectionName, countCollection := range diffCountCollections {
+		anomalies[countCollectionName] = make(map[countKey]anomalyResult)
+
+		for _, kind := range []string{"increment", "row"} {
+			diffs := countCollection.Increment
+			if kind == "row" {
+				diffs = countCollection.Row
+			}
+
+			for table, delta := range diffs {
+				key := countKey{Kind: kind, Table: table}
+				result := scoreRate(float64(delta)/interval.Seconds(), pastRates[countCollectionName][key], interval, parameters.minSamples)
+				anomalies[countCollectionName][key] = result
+
+				if result.Learning {
+					slog.Debug("Anomaly detection is still learning", "database", countCollectionName, "table", table, "kind", kind, "samples", result.Samples, "needed", parameters.minSamples)
+				} else {
+					slog.Debug("Scored rate", "database", countCollectionName, "table", table, "kind", kind, "rate", result.Rate, "median", result.Median, "deviation", result.Deviation, "score", result.Score)
+				}
+			}
+		}
+	}
+
+	return anomalies, nil
+}
+
+// scoreRate scores a rate against past rates, as the number of scaled median absolute deviations it is from their median
+// If every past rate was the same, the deviation is taken as the rate of a single row over the interval, so that a difference of one row scores 1
+func scoreRate(rate float64, pastRates []float64, interval time.Duration, minSamples int) anomalyResult {
+	result := anomalyResult{Rate: rate, Samples: len(pastRates)}
+	if len(pastRates) < minSamples || len(pastRates) == 0 {
+		result.Learning = true
+		return result
+	}
+
+	result.Median = getMedian(pastRates)
+
+	deviations := make([]float64, len(pastRates))
+	for i, pastRate := range pastRates {
+		deviations[i] = math.Abs(pastRate - result.Median)
+	}
+	result.Deviation = madScale * getMedian(deviations)
+	if result.Deviation == 0 {
+		result.Deviation = 1 / interval.Seconds()
+	}
+
+	result.Score = (rate - result.Median) / result.Deviation
+	return result
+}
+
+// getMedian returns the median of a list of values, which must not be empty
+func getMedian(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+
+	return sorted[middle]
+}
+
+// isSameSeason returns whether two times are at the same point of the day or week, to within half a bucket either side
+func isSameSeason(past time.Time, now time.Time, parameters anomalyParameters) bool {
+	distance := getSeasonOffset(past, parameters) - getSeasonOffset(now, parameters)
+	if distance < 0 {
+		distance = -distance
+	}
+	if distance > parameters.period/2 {
+		// The distance wraps around midnight, or the end of the week
+		distance = parameters.period - distance
+	}
+
+	return distance <= parameters.bucket/2
+}
+
+// getSeasonOffset returns how far into its day or week a time is, in the configured timezone
+func getSeasonOffset(t time.Time, parameters anomalyParameters) time.Duration {
+	t = t.In(parameters.location)
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+
+	if parameters.period > 24*time.Hour {
+		// Weeks start on Sunday, as time.Weekday does
+		offset += time.Duration(t.Weekday()) * 24 * time.Hour
+	}
+
+	return offset
+}
+
+// getAnomalyParameters parses an anomalyConfig, filling in the defaults
+// It returns the parameters, as well as an error if any value is invalid
+func getAnomalyParameters(config anomalyConfig) (anomalyParameters, error) {
+	parameters := anomalyParameters{minSamples: config.MinSamples, location: time.Local}
+
+	switch config.Seasonality {
+	case "day":
+		parameters.period = 24 * time.Hour
+	case "week":
+		parameters.period = 7 * 24 * time.Hour
+	default:
+		return parameters, fmt.Errorf("invalid anomaly seasonality %q, must be day or week", config.Seasonality)
+	}
+
+	for _, value := range []struct {
+		name         string
+		value        string
+		defaultValue string
+		duration     *time.Duration
+	}{
+		{"bucket", config.Bucket, defaultAnomalyBucket, &parameters.bucket},
+		{"lookback", config.Lookback, defaultAnomalyLookback, &parameters.lookback},
+	} {
+		if value.value == "" {
+			value.value = value.defaultValue
+		}
+
+		duration, err := parseLongDuration(value.value)
+		if err != nil || duration <= 0 {
+			return parameters, fmt.Errorf("invalid anomaly %s %q", value.name, value.value)
+		}
+		*value.duration = duration
+	}
+
+	if parameters.bucket > parameters.period {
+		return parameters, fmt.Errorf("anomaly bucket %q is longer than a %s", config.Bucket, config.Seasonality)
+	}
+
+	if parameters.minSamples <= 0 {
+		parameters.minSamples = defaultAnomalyMinSamples
+	}
+
+	if config.Timezone != "" {
+		location, err := time.LoadLocation(config.Timezone)
+		if err != nil {
+			return parameters, fmt.Errorf("invalid anomaly timezone %q: %s", config.Timezone, err)
+		}
+		parameters.location = location
+	}
+
+	return parameters, nil
+}
+
+// getAnomalyMetrics converts the anomaly results of a run into datums
+// Each scored table has an AnomalyScore, broken down by kind as a table may be counted as both, and each database the number of tables still learning, as AnomalyLearningTables
+func getAnomalyMetrics(anomalies map[string]map[countKey]anomalyResult) []metricDatum {
+	var datums []metricDatum
+
+	for _, database := range getSortedKeys(anomalies) {
+		learning := 0
+		results := anomalies[database]
+
+		var keys []countKey
+		for key := range results {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].Kind != keys[j].Kind {
+				return keys[i].Kind < keys[j].Kind
+			}
+			return keys[i].Table < keys[j].Table
+		})
+
+		for _, key := range keys {
+			result := results[key]
+			if result.Learning {
+				learning++
+				continue
+			}
+
+			datums = append(datums, metricDatum{
+				Name: "AnomalyScore",
+				Dimensions: []metricDimension{
+					{Name: "database", Value: database},
+					{Name: "kind", Value: key.Kind},
+					{Name: "table", Value: key.Table},
+				},
+				Value: result.Score,
+				Unit:  "None",
+			})
+		}
+
+		datums = append(datums, metricDatum{
+			Name:       "AnomalyLearningTables",
+			Dimensions: []metricDimension{{Name: "database", Value: database}},
+			Value:      float64(learning),
+			Unit:       "Count",
+		})
+	}
+
+	return datums
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestScoreRate(t *testing.T) {
+	tests := []struct {
+		name              string
+		rate              float64
+		pastRates         []float64
+		minSamples        int
+		expectedLearning  bool
+		expectedMedian    float64
+		expectedDeviation float64
+		expectedScore     float64
+	}{
+		{name: "learning", rate: 5, pastRates: []float64{1, 2}, minSamples: 3, expectedLearning: true},
+		{name: "no past rates", rate: 5, pastRates: nil, minSamples: 0, expectedLearning: true},
+		{name: "above", rate: 6, pastRates: []float64{5, 1, 4, 2, 3}, minSamples: 3, expectedMedian: 3, expectedDeviation: madScale, expectedScore: 3 / madScale},
+		{name: "below", rate: 0, pastRates: []float64{1, 2, 3, 4}, minSamples: 3, expectedMedian: 2.5, expectedDeviation: madScale, expectedScore: -2.5 / madScale},
+		// Every past rate was the same, so a single row more over the minute scores 1
+		{name: "zero deviation", rate: 2 + 1.0/60, pastRates: []float64{2, 2, 2}, minSamples: 3, expectedMedian: 2, expectedDeviation: 1.0 / 60, expectedScore: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := scoreRate(test.rate, test.pastRates, time.Minute, test.minSamples)
+			if result.Rate != test.rate || result.Samples != len(test.pastRates) || result.Learning != test.expectedLearning {
+				t.Fatalf("result is %+v, expected learning to be %t", result, test.expectedLearning)
+			}
+			if result.Median != test.expectedMedian || math.Abs(result.Deviation-test.expectedDeviation) > 1e-9 || math.Abs(result.Score-test.expectedScore) > 1e-9 {
+				t.Errorf("result is %+v, expected a median of %g, deviation of %g and score of %g", result, test.expectedMedian, test.expectedDeviation, test.expectedScore)
+			}
+		})
+	}
+}
+
+func TestIsSameSeason(t *testing.T) {
+	day := anomalyParameters{period: 24 * time.Hour, bucket: time.Hour, location: time.UTC}
+	week := anomalyParameters{period: 7 * 24 * time.Hour, bucket: time.Hour, location: time.UTC}
+	// 2026-01-03 is a Saturday, the last day of the week
+	saturday := time.Date(2026, 1, 3, 23, 50, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		past       time.Time
+		now        time.Time
+		parameters anomalyParameters
+		expected   bool
+	}{
+		{name: "same time the day before", past: saturday.AddDate(0, 0, -1), now: saturday, parameters: day, expected: true},
+		{name: "within the bucket", past: saturday.Add(-29 * time.Minute), now: saturday.AddDate(0, 0, 1), parameters: day, expected: true},
+		{name: "outside the bucket", past: saturday.Add(-31 * time.Minute), now: saturday.AddDate(0, 0, 1), parameters: day, expected: false},
+		{name: "across midnight", past: saturday, now: saturday.Add(20 * time.Minute), parameters: day, expected: true},
+		{name: "across midnight outside the bucket", past: saturday.Add(-30 * time.Minute), now: saturday.Add(20 * time.Minute), parameters: day, expected: false},
+		{name: "same time the week before", past: saturday.AddDate(0, 0, -7), now: saturday, parameters: week, expected: true},
+		{name: "different day of the week", past: saturday.AddDate(0, 0, -1), now: saturday, parameters: week, expected: false},
+		{name: "across the end of the week", past: saturday.AddDate(0, 0, -7), now: saturday.Add(20 * time.Minute), parameters: week, expected: true},
+		{name: "across the end of the week a day out", past: saturday.AddDate(0, 0, -8), now: saturday.Add(20 * time.Minute), parameters: week, expected: false},
+		{name: "in another timezone", past: saturday.AddDate(0, 0, -7), now: saturday.Add(20 * time.Minute), parameters: anomalyParameters{period: week.period, bucket: time.Hour, location: time.FixedZone("UTC+10", 10*60*60)}, expected: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, times := range [][2]time.Time{{test.past, test.now}, {test.now, test.past}} {
+				if same := isSameSeason(times[0], times[1], test.parameters); same != test.expected {
+					t.Errorf("isSameSeason(%s, %s) is %t, expected %t", times[0], times[1], same, test.expected)
+				}
+			}
+		})
+	}
+}
+
+func TestGetAnomalyParameters(t *testing.T) {
+	tests := []struct {
+		name               string
+		config             anomalyConfig
+		valid              bool
+		expectedMinSamples int
+		expectedBucket     time.Duration
+		expectedLookback   time.Duration
+	}{
+		{name: "defaults", config: anomalyConfig{Seasonality: "day"}, valid: true, expectedMinSamples: 3, expectedBucket: time.Hour, expectedLookback: 28 * 24 * time.Hour},
+		{name: "configured", config: anomalyConfig{Seasonality: "week", Bucket: "2h", Lookback: "8w", MinSamples: 6}, valid: true, expectedMinSamples: 6, expectedBucket: 2 * time.Hour, expectedLookback: 56 * 24 * time.Hour},
+		{name: "negative min samples", config: anomalyConfig{Seasonality: "day", MinSamples: -1}, valid: true, expectedMinSamples: 3, expectedBucket: time.Hour, expectedLookback: 28 * 24 * time.Hour},
+		{name: "no seasonality", config: anomalyConfig{}},
+		{name: "invalid bucket", config: anomalyConfig{Seasonality: "day", Bucket: "0h"}},
+		{name: "bucket longer than the period", config: anomalyConfig{Seasonality: "day", Bucket: "2d"}},
+		{name: "invalid timezone", config: anomalyConfig{Seasonality: "day", Timezone: "Nowhere/Atlantis"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parameters, err := getAnomalyParameters(test.config)
+			if (err == nil) != test.valid {
+				t.Fatalf("getAnomalyParameters returned the error %v, expected valid to be %t", err, test.valid)
+			}
+			if !test.valid {
+				return
+			}
+			if parameters.minSamples != test.expectedMinSamples || parameters.bucket != test.expectedBucket || parameters.lookback != test.expectedLookback {
+				t.Errorf("parameters are %+v, expected %d samples, a bucket of %s and a lookback of %s", parameters, test.expectedMinSamples, test.expectedBucket, test.expectedLookback)
+			}
+		})
+	}
+}
+
+func TestGetAnomalies(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	collectedAt := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+
+	// Sale added 1, 2 and 3 rows a second around noon on the days before, and far more in the evening
+	writeHistoryLines(t, path,
+		`{"time":"2026-01-07T12:05:00Z","database":"shop","table":"Sale","kind":"increment","value":100,"delta":60,"interval":60}`,
+		`{"time":"2026-01-08T11:55:00Z","database":"shop","table":"Sale","kind":"increment","value":200,"delta":120,"interval":60}`,
+		`{"time":"2026-01-08T18:00:00Z","database":"shop","table":"Sale","kind":"increment","value":900,"delta":6000,"interval":60}`,
+		`{"time":"2026-01-09T12:00:00Z","database":"shop","table":"Sale","kind":"increment","value":300,"delta":180,"interval":60}`,
+		`{"time":"2026-01-09T12:00:00Z","database":"shop","table":"Product","kind":"row","value":30,"delta":1,"interval":60}`,
+	)
+
+	diffs := map[string]countCollection{
+		"shop": {Increment: map[string]int{"Sale": 300}, Row: map[string]int{"Product": 1}},
+	}
+	config := applicationConfig{History: historyConfig{Path: path}, Anomaly: anomalyConfig{Seasonality: "day", Timezone: "UTC"}}
+
+	anomalies, err := getAnomalies(config, diffs, time.Minute, collectedAt)
+	if err != nil {
+		t.Fatalf("getAnomalies returned an error: %s", err)
+	}
+
+	sale := anomalies["shop"][countKey{Kind: "increment", Table: "Sale"}]
+	if sale.Learning || sale.Samples != 3 || sale.Median != 2 || math.Abs(sale.Score-3/madScale) > 1e-9 {
+		t.Errorf("Sale is %+v, expected it to be scored against the rates around noon", sale)
+	}
+	if product := anomalies["shop"][countKey{Kind: "row", Table: "Product"}]; !product.Learning || product.Samples != 1 {
+		t.Errorf("Product is %+v, expected it to still be learning", product)
+	}
+
+	// Without the time since the last run, nothing is scored
+	if anomalies, err := getAnomalies(config, diffs, 0, collectedAt); err != nil || anomalies != nil {
+		t.Errorf("getAnomalies returned %v and %v without an interval, expected nothing", anomalies, err)
+	}
+}
+
+func TestGetAnomalyMetrics(t *testing.T) {
+	anomalies := map[string]map[countKey]anomalyResult{
+		"shop": {
+			{Kind: "row", Table: "Product"}:    {Learning: true, Samples: 1},
+			{Kind: "increment", Table: "Sale"}: {Score: 2.5},
+		},
+	}
+
+	datums := getAnomalyMetrics(anomalies)
+	if len(datums) != 2 {
+		t.Fatalf("datums are %+v, expected a score for Sale and the number of tables learning", datums)
+	}
+
+	// The dimensions are named as those of the table metrics are, see tableDelta.dimensions
+	expected := tableDelta{Database: "shop", Kind: "increment", Table: "Sale"}.dimensions()
+	if score := datums[0]; score.Name != "AnomalyScore" || score.Value != 2.5 || !reflect.DeepEqual(score.Dimensions, expected) {
+		t.Errorf("first datum is %+v, expected the score of Sale with the dimensions %v", score, expected)
+	}
+	if learning := datums[1]; learning.Name != "AnomalyLearningTables" || learning.Value != 1 || !reflect.DeepEqual(learning.Dimensions, expected[:1]) {
+		t.Errorf("last datum is %+v, expected one table of shop learning", learning)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic replaces the file at fileName with data, so that the file is never left partially written
+// The data is written to a temporary file in the same directory, synced to disk, and then renamed over fileName
+// If backup is true, the previous file is first kept at the path returned by getBackupPath
+// It returns an error if any issues were encountered, in which case fileName is left untouched
+func writeFileAtomic(fileName string, data []byte, backup bool) error {
+	dir := filepath.Dir(fileName)
+
+	// Create the temporary file next to the destination, so the rename can't cross filesystems
+	tempFile, err := ioutil.TempFile(dir, "."+filepath.Base(fileName)+".tmp-")
+	if err != nil {
+		return err
+	}
+	tempName := tempFile.Name()
+
+	// Remove the temporary file if anything goes wrong before it is renamed
+	renamed := false
+	defer func() {
+		if !renamed {
+			os.Remove(tempName)
+		}
+	}()
+
+	// Write the data, and make sure it is on disk before it replaces anything
+	_, err = tempFile.Write(data)
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	// Keep the permissions of the file being replaced, or the usual permissions for a new file
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(fileName); err == nil {
+		mode = info.Mode().Perm()
+	}
+	err = os.Chmod(tempName, mode)
+	if err != nil {
+		return err
+	}
+
+	if backup {
+		// Keep the previous file as a backup, in case the new one turns out to be unusable
+		err = backupFile(fileName)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Replace the file in a single step
+	err = os.Rename(tempName, fileName)
+	if err != nil {
+		return err
+	}
+	renamed = true
+
+	// Sync the directory, so the rename itself survives a crash
+	// Not every platform supports syncing a directory, so failures are ignored
+	if dirFile, err := os.Open(dir); err == nil {
+		dirFile.Sync()
+		dirFile.Close()
+	}
+
+	return nil
+}
+
+// backupFile copies the file at fileName to the path returned by getBackupPath, replacing any previous backup
+// A hard link is used where possible, so the file doesn't need to be copied
+// It returns nil if there is no file to back up, or an error if the backup could not be made
+func backupFile(fileName string) error {
+	if _, err := os.Stat(fileName); os.IsNotExist(err) {
+		return nil
+	}
+
+	backupName := getBackupPath(fileName)
+	err := os.Remove(backupName)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if os.Link(fileName, backupName) == nil {
+		return nil
+	}
+
+	// If the filesystem doesn't support hard links, copy the file instead
+	source, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	destination, err := os.OpenFile(backupName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(destination, source)
+	if err == nil {
+		err = destination.Sync()
+	}
+	if closeErr := destination.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// getBackupPath returns the path the backup of a file is kept at
+func getBackupPath(fileName string) string {
+	return fileName + ".bak"
+}
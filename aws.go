@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// newAWSSession takes the AWS configuration values and opens an AWS session, with region overriding aws.region if it is set
+// Unless aws.accessKeyId is specified, it will use the normal avenues for obtaining credentials
+// That is, Environment Variables -> Shared Credentials File -> EC2 IAM Role, or the function's role when running in Lambda
+// It returns the session, as well as an error if the credentials could not be resolved or don't work
+func newAWSSession(awsConfig map[string]string, region string) (*session.Session, error) {
+	var (
+		awsSession *session.Session
+		err        error
+	)
+
+	if region == "" {
+		region = awsConfig["region"]
+	}
+
+	if awsConfig["accessKeyId"] == "" {
+		// If no credentials are explicitly specified in the config YAML, open an AWS session using the default credential provider chain
+		// The aws section may still configure the region, namespace or whether CloudWatch is enabled
+		sessionConfig := aws.NewConfig()
+		if region != "" {
+			sessionConfig = sessionConfig.WithRegion(region)
+		}
+		awsSession, err = session.NewSession(sessionConfig)
+	} else {
+		// Otherwise, resolve the credentials explicitly specified, in case they reference secrets
+		var accessKeyID, secretAccessKey string
+		accessKeyID, err = resolveSecret(awsConfig["accessKeyId"])
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve aws.accessKeyId: %s", err)
+		}
+		secretAccessKey, err = resolveSecret(awsConfig["secretAccessKey"])
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve aws.secretAccessKey: %s", err)
+		}
+
+		// Open an AWS session using the resolved credentials
+		awsSession, err = session.NewSession(&aws.Config{
+			Region:      aws.String(region),
+			Credentials: credentials.NewStaticCredentials(accessKeyID, secretAccessKey, ""),
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Test the credentials, and fail if there are issues
+	_, err = awsSession.Config.Credentials.Get()
+	if err != nil {
+		return nil, err
+	}
+
+	return awsSession, nil
+}
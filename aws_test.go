@@ -0,0 +1,64 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+// setAWSEnvironment gives the default credential provider chain credentials in the environment, without any shared config files
+func setAWSEnvironment(t *testing.T) {
+	t.Helper()
+
+	missing := filepath.Join(t.TempDir(), "missing")
+	t.Setenv("AWS_CONFIG_FILE", missing)
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", missing)
+	t.Setenv("AWS_PROFILE", "")
+	t.Setenv("AWS_REGION", "")
+	t.Setenv("AWS_DEFAULT_REGION", "")
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIAENVIRONMENT")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "environment-secret")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+}
+
+func TestNewAWSSession(t *testing.T) {
+	setAWSEnvironment(t)
+
+	tests := []struct {
+		name           string
+		awsConfig      map[string]string
+		region         string
+		expectedKeyID  string
+		expectedRegion string
+	}{
+		{name: "no aws section", awsConfig: nil, region: "eu-west-1", expectedKeyID: "AKIAENVIRONMENT", expectedRegion: "eu-west-1"},
+		{name: "aws section with only region", awsConfig: map[string]string{"region": "us-east-1"}, expectedKeyID: "AKIAENVIRONMENT", expectedRegion: "us-east-1"},
+		{name: "aws section without keys", awsConfig: map[string]string{"namespace": "Shop", "enabled": "true"}, region: "ap-southeast-2", expectedKeyID: "AKIAENVIRONMENT", expectedRegion: "ap-southeast-2"},
+		{name: "region overrides aws.region", awsConfig: map[string]string{"region": "us-east-1"}, region: "eu-west-1", expectedKeyID: "AKIAENVIRONMENT", expectedRegion: "eu-west-1"},
+		{name: "static keys", awsConfig: map[string]string{"region": "us-east-1", "accessKeyId": "AKIASTATIC", "secretAccessKey": "static-secret"}, expectedKeyID: "AKIASTATIC", expectedRegion: "us-east-1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			awsSession, err := newAWSSession(test.awsConfig, test.region)
+			if err != nil {
+				t.Fatalf("newAWSSession returned an error: %s", err)
+			}
+
+			value, err := awsSession.Config.Credentials.Get()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value.AccessKeyID != test.expectedKeyID {
+				t.Errorf("access key ID is %q, expected %q", value.AccessKeyID, test.expectedKeyID)
+			}
+			if test.expectedKeyID == "AKIASTATIC" && value.ProviderName != credentials.StaticProviderName {
+				t.Errorf("credentials are from %s, expected the static keys", value.ProviderName)
+			}
+			if region := *awsSession.Config.Region; region != test.expectedRegion {
+				t.Errorf("region is %q, expected %q", region, test.expectedRegion)
+			}
+		})
+	}
+}
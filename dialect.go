@@ -0,0 +1,117 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// dialect is the set of database specifics needed to obtain RowMetrics from one type of database
+// Each supported type registers its dialect in dialects, keyed by the value of database.type in the config YAML
+type dialect interface {
+	// driverName returns the name of the database/sql driver used to connect
+	driverName() string
+
+	// dsn generates the Database Source Name for a databaseConfig, using an already resolved password
+	// Options are any additional DSN options configured, which should be passed on to the driver
+	dsn(dbConfig databaseConfig, password string, options url.Values) string
+
+	// defaultSchema returns the schema the configured tables live in when no schema is configured
+	defaultSchema(dbConfig databaseConfig) string
+
+	// incrementQuery returns the query to select the name and auto increment value of tables in a schema
+	incrementQuery(db *sql.DB, schema string) dialectQuery
+
+	// rowQuery returns the query to select the name and row count of tables in a schema
+	rowQuery(db *sql.DB, schema string) dialectQuery
+
+	// sizeQuery returns the query to select the name and size in bytes, including indexes, of tables in a schema
+	sizeQuery(db *sql.DB, schema string) dialectQuery
+
+	// tablesQuery returns the query to select the name of tables that exist in a schema
+	tablesQuery(schema string) dialectQuery
+
+	// fallbackQuery returns the query to select a single count for a table whose value in the usual query is NULL
+	fallbackQuery(db *sql.DB, schema string, kind string, table string) (string, error)
+
+	// bindType returns the sqlx placeholder style the driver requires, such as sqlx.DOLLAR
+	bindType() int
+
+	// capabilities returns what the dialect is able to report
+	capabilities() dialectCapabilities
+}
+
+// dialectQuery is a query with ? placeholders, selecting from a list of tables
+// SQL must contain "IN (?)", which is expanded to the list of tables
+// Args are the arguments for any placeholders after the list of tables, such as the schema
+type dialectQuery struct {
+	SQL  string
+	Args []interface{}
+}
+
+// dialectCapabilities describes what a dialect is able to report
+// Increment is whether increment queries return real auto increment values, rather than row counts
+// Size is whether size queries return the size of tables
+type dialectCapabilities struct {
+	Increment bool
+	Size      bool
+}
+
+// dialects is the registry of every supported database type and its dialect
+var dialects = map[string]dialect{
+	"mysql":     mysqlDialect{},
+	"postgres":  postgresDialect{},
+	"sqlite":    sqliteDialect{},
+	"sqlserver": sqlServerDialect{},
+}
+
+// getDialect takes a databaseConfig and looks up the dialect for its type
+// It returns the dialect, as well as an error if the type is not supported
+func getDialect(dbConfig databaseConfig) (dialect, error) {
+	dbType := getDatabaseType(dbConfig)
+
+	dialect, ok := dialects[dbType]
+	if !ok {
+		// Unknown types are rejected, rather than guessing at a DSN that won't work
+		return nil, fmt.Errorf("unsupported database type %q, must be one of %s", dbType, strings.Join(getDialectNames(), ", "))
+	}
+
+	return dialect, nil
+}
+
+// getDialectNames returns the sorted names of every registered dialect
+func getDialectNames() []string {
+	return getSortedKeys(dialects)
+}
+
+// buildDialectQuery takes a dialectQuery and expands it for a list of tables, in the dialect's placeholder style
+// It returns the query and slice of arguments, as well as an error if the query could not be assembled
+func buildDialectQuery(dialect dialect, query dialectQuery, tables []string) (string, []interface{}, error) {
+	// Generate the query and slice of arguments, with the table list first
+	sqlQuery, args, err := sqlx.In(query.SQL, append([]interface{}{tables}, query.Args...)...)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Rebind the interface to use the placeholders the driver requires, such as $1, $2, etc instead of ?, ?, etc
+	return sqlx.Rebind(dialect.bindType(), sqlQuery), args, nil
+}
+
+// appendDSNOptions appends encoded DSN options to a DSN, using separator to start them
+// It returns the DSN unchanged if there are no options
+func appendDSNOptions(dsn string, separator string, options url.Values) string {
+	if len(options) == 0 {
+		return dsn
+	}
+
+	return dsn + separator + options.Encode()
+}
+
+// quoteIdentifier quotes a table, schema or column name so it can be used in a query
+// Any quote characters within the name are escaped by doubling them
+func quoteIdentifier(name string, quote string) string {
+	return quote + strings.Replace(name, quote, quote+quote, -1) + quote
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// mysqlDialect is the dialect for MySQL databases, and is the default when no type is configured
+type mysqlDialect struct{}
+
+func (mysqlDialect) driverName() string {
+	return "mysql"
+}
+
+func (mysqlDialect) dsn(dbConfig databaseConfig, password string, options url.Values) string {
+	return appendDSNOptions(fmt.Sprintf("%s:%s@tcp(%s)/%s", dbConfig.User, password, dbConfig.Host, dbConfig.Database), "?", options)
+}
+
+func (mysqlDialect) defaultSchema(dbConfig databaseConfig) string {
+	// In MySQL, the schema is the database itself
+	return dbConfig.Database
+}
+
+func (mysqlDialect) incrementQuery(db *sql.DB, schema string) dialectQuery {
+	return dialectQuery{
+		SQL:  "SELECT `TABLE_NAME`, `AUTO_INCREMENT` FROM information_schema.TABLES WHERE TABLE_NAME IN (?) AND TABLE_SCHEMA = ?",
+		Args: []interface{}{schema},
+	}
+}
+
+func (mysqlDialect) rowQuery(db *sql.DB, schema string) dialectQuery {
+	return dialectQuery{
+		SQL:  "SELECT `TABLE_NAME`, `TABLE_ROWS` FROM information_schema.TABLES WHERE TABLE_NAME IN (?) AND TABLE_SCHEMA = ?",
+		Args: []interface{}{schema},
+	}
+}
+
+func (mysqlDialect) sizeQuery(db *sql.DB, schema string) dialectQuery {
+	// Like TABLE_ROWS, the lengths are estimates kept up to date by the storage engine
+	return dialectQuery{
+		SQL:  "SELECT `TABLE_NAME`, `DATA_LENGTH` + `INDEX_LENGTH` FROM information_schema.TABLES WHERE TABLE_NAME IN (?) AND TABLE_SCHEMA = ?",
+		Args: []interface{}{schema},
+	}
+}
+
+func (mysqlDialect) tablesQuery(schema string) dialectQuery {
+	return dialectQuery{
+		SQL:  "SELECT TABLE_NAME FROM information_schema.TABLES WHERE TABLE_NAME IN (?) AND TABLE_SCHEMA = ?",
+		Args: []interface{}{schema},
+	}
+}
+
+func (mysqlDialect) fallbackQuery(db *sql.DB, schema string, kind string, table string) (string, error) {
+	if kind != "increment" {
+		// Row tables are counted exactly
+		return fmt.Sprintf("SELECT COUNT(*) FROM %s.%s", quoteIdentifier(schema, "`"), quoteIdentifier(table, "`")), nil
+	}
+
+	// Increment tables use the largest primary key, as AUTO_INCREMENT is NULL for some storage engines and views
+	var primaryKey string
+	err := db.QueryRow("SELECT COLUMN_NAME FROM information_schema.KEY_COLUMN_USAGE WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? AND CONSTRAINT_NAME = 'PRIMARY' ORDER BY ORDINAL_POSITION LIMIT 1", schema, table).Scan(&primaryKey)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("table has no primary key")
+	} else if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("SELECT MAX(%s) FROM %s.%s", quoteIdentifier(primaryKey, "`"), quoteIdentifier(schema, "`"), quoteIdentifier(table, "`")), nil
+}
+
+func (mysqlDialect) bindType() int {
+	return sqlx.QUESTION
+}
+
+func (mysqlDialect) capabilities() dialectCapabilities {
+	return dialectCapabilities{Increment: true, Size: true}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+)
+
+// postgresDialect is the dialect for PostgreSQL databases
+// Both Increment and Row use the same query, as it is non-trivial to obtain the auto-increment value
+// TODO: Figure out how to obtain auto-increment values efficiently
+type postgresDialect struct{}
+
+func (postgresDialect) driverName() string {
+	return "postgres"
+}
+
+func (postgresDialect) dsn(dbConfig databaseConfig, password string, options url.Values) string {
+	// Generate a PostgreSQL URL, escaping the credentials and database name
+	dsn := url.URL{
+		Scheme:   "postgres",
+		User:     url.UserPassword(dbConfig.User, password),
+		Host:     dbConfig.Host,
+		Path:     "/" + dbConfig.Database,
+		RawQuery: options.Encode(),
+	}
+
+	return dsn.String()
+}
+
+func (postgresDialect) defaultSchema(dbConfig databaseConfig) string {
+	return "public"
+}
+
+func (d postgresDialect) incrementQuery(db *sql.DB, schema string) dialectQuery {
+	return d.rowQuery(db, schema)
+}
+
+func (postgresDialect) rowQuery(db *sql.DB, schema string) dialectQuery {
+	return dialectQuery{
+		SQL:  "SELECT relname,n_live_tup FROM pg_stat_user_tables WHERE relname IN (?) AND schemaname = ?",
+		Args: []interface{}{schema},
+	}
+}
+
+func (postgresDialect) sizeQuery(db *sql.DB, schema string) dialectQuery {
+	// The total relation size includes indexes and TOAST data
+	return dialectQuery{
+		SQL:  "SELECT relname,pg_total_relation_size(relid) FROM pg_stat_user_tables WHERE relname IN (?) AND schemaname = ?",
+		Args: []interface{}{schema},
+	}
+}
+
+func (postgresDialect) tablesQuery(schema string) dialectQuery {
+	return dialectQuery{
+		SQL:  "SELECT tablename FROM pg_tables WHERE tablename IN (?) AND schemaname = ?",
+		Args: []interface{}{schema},
+	}
+}
+
+func (postgresDialect) fallbackQuery(db *sql.DB, schema string, kind string, table string) (string, error) {
+	return fmt.Sprintf("SELECT COUNT(*) FROM %s.%s", quoteIdentifier(schema, `"`), quoteIdentifier(table, `"`)), nil
+}
+
+func (postgresDialect) bindType() int {
+	return sqlx.DOLLAR
+}
+
+func (postgresDialect) capabilities() dialectCapabilities {
+	return dialectCapabilities{Increment: false, Size: true}
+}
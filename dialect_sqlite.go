@@ -0,0 +1,103 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	_ "modernc.org/sqlite"
+)
+
+// sqlitePathEscaper escapes the characters of a path that SQLite would otherwise read as part of the file: URI syntax
+// SQLite decodes the escapes again when it opens the file
+var sqlitePathEscaper = strings.NewReplacer("%", "%25", "?", "%3F", "#", "%23")
+
+// sqliteDialect is the dialect for SQLite database files
+// Tables are looked up in sqlite_master, so tables without a value come back as NULL and use the fallback
+type sqliteDialect struct{}
+
+func (sqliteDialect) driverName() string {
+	return "sqlite"
+}
+
+func (sqliteDialect) dsn(dbConfig databaseConfig, password string, options url.Values) string {
+	// The host is the path to the database file, falling back to the database if there is no host
+	path := dbConfig.Host
+	if path == "" {
+		path = dbConfig.Database
+	}
+
+	// Open the file read only, so a misconfigured path can't create an empty database
+	// The path is escaped, so a "?" or "#" in it isn't taken as the start of the URI's query or fragment
+	dsn := url.URL{Scheme: "file", Opaque: sqlitePathEscaper.Replace(path), RawQuery: "mode=ro"}
+	return appendDSNOptions(dsn.String(), "&", options)
+}
+
+func (sqliteDialect) defaultSchema(dbConfig databaseConfig) string {
+	// The main schema is the database file itself
+	return "main"
+}
+
+func (sqliteDialect) incrementQuery(db *sql.DB, schema string) dialectQuery {
+	quotedSchema := quoteIdentifier(schema, `"`)
+
+	// sqlite_sequence only exists once a table with AUTOINCREMENT has been created, so check for it first
+	if !hasSQLiteTable(db, schema, "sqlite_sequence") {
+		return dialectQuery{SQL: "SELECT m.name, NULL FROM " + quotedSchema + ".sqlite_master m WHERE m.type = 'table' AND m.name IN (?)"}
+	}
+
+	return dialectQuery{SQL: "SELECT m.name, s.seq FROM " + quotedSchema + ".sqlite_master m LEFT JOIN " + quotedSchema + ".sqlite_sequence s ON s.name = m.name WHERE m.type = 'table' AND m.name IN (?)"}
+}
+
+func (sqliteDialect) rowQuery(db *sql.DB, schema string) dialectQuery {
+	quotedSchema := quoteIdentifier(schema, `"`)
+
+	// The estimate is the first number of the table's sqlite_stat1 entry, which only exists once ANALYZE has been run
+	if !hasSQLiteTable(db, schema, "sqlite_stat1") {
+		return dialectQuery{SQL: "SELECT m.name, NULL FROM " + quotedSchema + ".sqlite_master m WHERE m.type = 'table' AND m.name IN (?)"}
+	}
+
+	return dialectQuery{SQL: "SELECT m.name, (SELECT CAST(substr(st.stat, 1, instr(st.stat || ' ', ' ') - 1) AS INTEGER) FROM " + quotedSchema + ".sqlite_stat1 st WHERE st.tbl = m.name LIMIT 1) FROM " + quotedSchema + ".sqlite_master m WHERE m.type = 'table' AND m.name IN (?)"}
+}
+
+func (sqliteDialect) sizeQuery(db *sql.DB, schema string) dialectQuery {
+	quotedSchema := quoteIdentifier(schema, `"`)
+
+	// dbstat reports the pages of each table and index, which are summed by the table they belong to
+	return dialectQuery{
+		SQL:  "SELECT m.tbl_name, SUM(d.pgsize) FROM dbstat d JOIN " + quotedSchema + ".sqlite_master m ON m.name = d.name WHERE m.tbl_name IN (?) AND d.schema = ? GROUP BY m.tbl_name",
+		Args: []interface{}{schema},
+	}
+}
+
+func (sqliteDialect) tablesQuery(schema string) dialectQuery {
+	return dialectQuery{SQL: "SELECT name FROM " + quoteIdentifier(schema, `"`) + ".sqlite_master WHERE type = 'table' AND name IN (?)"}
+}
+
+func (sqliteDialect) fallbackQuery(db *sql.DB, schema string, kind string, table string) (string, error) {
+	if kind == "increment" {
+		// Increment tables use the largest rowid, which is what AUTOINCREMENT would have recorded
+		return fmt.Sprintf("SELECT MAX(rowid) FROM %s.%s", quoteIdentifier(schema, `"`), quoteIdentifier(table, `"`)), nil
+	}
+
+	// Row tables are counted exactly
+	return fmt.Sprintf("SELECT COUNT(*) FROM %s.%s", quoteIdentifier(schema, `"`), quoteIdentifier(table, `"`)), nil
+}
+
+func (sqliteDialect) bindType() int {
+	return sqlx.QUESTION
+}
+
+func (sqliteDialect) capabilities() dialectCapabilities {
+	return dialectCapabilities{Increment: true, Size: true}
+}
+
+// hasSQLiteTable checks whether a table, such as one of SQLite's internal tables, exists in a SQLite schema
+// Any error looking the table up is treated as the table not existing
+func hasSQLiteTable(db *sql.DB, schema string, table string) bool {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM "+quoteIdentifier(schema, `"`)+".sqlite_master WHERE type = 'table' AND name = ?", table).Scan(&count)
+	return err == nil && count > 0
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// createSQLiteDatabase creates a SQLite database file at path, running each statement against it
+func createSQLiteDatabase(t *testing.T, path string, statements ...string) {
+	t.Helper()
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatalf("failed to open %s: %s", path, err)
+	}
+	defer db.Close()
+
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("failed to run %q: %s", statement, err)
+		}
+	}
+}
+
+func TestSQLiteCountCollection(t *testing.T) {
+	createPath := filepath.Join(t.TempDir(), "edge.db")
+	createSQLiteDatabase(t, createPath,
+		"CREATE TABLE Sale (id INTEGER PRIMARY KEY AUTOINCREMENT, total INTEGER)",
+		"INSERT INTO Sale (total) VALUES (1), (2), (3)",
+		"DELETE FROM Sale WHERE id = 3",
+		"CREATE TABLE Msg (id INTEGER PRIMARY KEY, body TEXT)",
+		"INSERT INTO Msg (id, body) VALUES (7, 'a'), (12, 'b')",
+		"CREATE TABLE Product (name TEXT)",
+		"INSERT INTO Product (name) VALUES ('a'), ('b')",
+	)
+
+	// The database is moved to a directory whose name has the characters that would otherwise end the path of a file: URI
+	dir := filepath.Join(t.TempDir(), "rowmetrics?test#1%")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "edge.db")
+	if err := os.Rename(createPath, path); err != nil {
+		t.Fatal(err)
+	}
+
+	dbConfig := databaseConfig{
+		Name: "edge",
+		Type: "sqlite",
+		Host: path,
+		Tables: tableConfig{
+			Increment: []string{"Sale", "Msg"},
+			Row:       []string{"Product", "Missing"},
+		},
+	}
+
+	collection, err := getCountCollection(dbConfig, true)
+	if err != nil {
+		t.Fatalf("getCountCollection returned an error: %s", err)
+	}
+
+	// Sale keeps the AUTOINCREMENT value past the deleted row, Msg falls back to its largest rowid
+	expectedIncrements := map[string]int{"Sale": 3, "Msg": 12}
+	for table, expected := range expectedIncrements {
+		if actual, ok := collection.Increment[table]; !ok || actual != expected {
+			t.Errorf("increment count of %s is %d (found %t), expected %d", table, actual, ok, expected)
+		}
+	}
+	if actual := collection.Row["Product"]; actual != 2 {
+		t.Errorf("row count of Product is %d, expected 2", actual)
+	}
+	if _, ok := collection.Row["Missing"]; ok {
+		t.Errorf("row count of Missing was set, expected it to be missing")
+	}
+
+	expectedSources := map[countKey]string{
+		{Kind: "increment", Table: "Sale"}: "sqlite.increment",
+		{Kind: "increment", Table: "Msg"}:  "sqlite.fallback",
+		{Kind: "row", Table: "Product"}:    "sqlite.fallback",
+	}
+	for key, expected := range expectedSources {
+		if actual := collection.Sources[key]; actual != expected {
+			t.Errorf("source of %s %s is %q, expected %q", key.Kind, key.Table, actual, expected)
+		}
+	}
+
+	if len(collection.Missing) != 1 || collection.Missing[0].Table != "Missing" || collection.Missing[0].Kind != "row" {
+		t.Errorf("missing tables are %+v, expected only the row table Missing", collection.Missing)
+	}
+	if collection.Sizes["Sale"] <= 0 {
+		t.Errorf("size of Sale is %d, expected it to be collected", collection.Sizes["Sale"])
+	}
+}
+
+func TestSQLiteCountCollectionMissingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing.db")
+
+	dbConfig := databaseConfig{
+		Name: "edge",
+		Type: "sqlite",
+		Host: path,
+		Tables: tableConfig{
+			Increment: []string{"Sale"},
+			Row:       []string{"Product"},
+		},
+	}
+
+	collection, err := getCountCollection(dbConfig, false)
+	if err != nil {
+		t.Fatalf("getCountCollection returned an error: %s", err)
+	}
+
+	// Every table is missing, as the query fails, and the database file isn't created by opening it
+	if len(collection.Increment) != 0 || len(collection.Row) != 0 {
+		t.Errorf("counts are %v and %v, expected none", collection.Increment, collection.Row)
+	}
+	if len(collection.Missing) != 2 {
+		t.Errorf("missing tables are %+v, expected both tables", collection.Missing)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("%s was created, expected it to be opened read only", path)
+	}
+}
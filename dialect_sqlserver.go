@@ -0,0 +1,85 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/microsoft/go-mssqldb"
+)
+
+// sqlServerDialect is the dialect for Microsoft SQL Server databases
+type sqlServerDialect struct{}
+
+func (sqlServerDialect) driverName() string {
+	return "sqlserver"
+}
+
+func (sqlServerDialect) dsn(dbConfig databaseConfig, password string, options url.Values) string {
+	// Generate a SQL Server URL, with the instance name as the path if there is one
+	options.Set("database", dbConfig.Database)
+	dsn := url.URL{
+		Scheme:   "sqlserver",
+		User:     url.UserPassword(dbConfig.User, password),
+		Host:     dbConfig.Host,
+		Path:     dbConfig.Instance,
+		RawQuery: options.Encode(),
+	}
+
+	return dsn.String()
+}
+
+func (sqlServerDialect) defaultSchema(dbConfig databaseConfig) string {
+	return "dbo"
+}
+
+func (sqlServerDialect) incrementQuery(db *sql.DB, schema string) dialectQuery {
+	return dialectQuery{
+		SQL:  "SELECT t.name, CAST(IDENT_CURRENT(QUOTENAME(s.name) + '.' + QUOTENAME(t.name)) AS BIGINT) FROM sys.tables t JOIN sys.schemas s ON s.schema_id = t.schema_id WHERE t.name IN (?) AND s.name = ?",
+		Args: []interface{}{schema},
+	}
+}
+
+func (sqlServerDialect) rowQuery(db *sql.DB, schema string) dialectQuery {
+	// Only the heap or clustered index partitions are summed, so rows aren't counted once per index
+	return dialectQuery{
+		SQL:  "SELECT t.name, SUM(p.rows) FROM sys.tables t JOIN sys.schemas s ON s.schema_id = t.schema_id JOIN sys.partitions p ON p.object_id = t.object_id AND p.index_id IN (0, 1) WHERE t.name IN (?) AND s.name = ? GROUP BY t.name",
+		Args: []interface{}{schema},
+	}
+}
+
+func (sqlServerDialect) sizeQuery(db *sql.DB, schema string) dialectQuery {
+	// Every allocation unit of every index is summed, as pages of 8KB
+	return dialectQuery{
+		SQL:  "SELECT t.name, CAST(SUM(a.total_pages) AS BIGINT) * 8192 FROM sys.tables t JOIN sys.schemas s ON s.schema_id = t.schema_id JOIN sys.partitions p ON p.object_id = t.object_id JOIN sys.allocation_units a ON a.container_id = p.partition_id WHERE t.name IN (?) AND s.name = ? GROUP BY t.name",
+		Args: []interface{}{schema},
+	}
+}
+
+func (sqlServerDialect) tablesQuery(schema string) dialectQuery {
+	return dialectQuery{
+		SQL:  "SELECT t.name FROM sys.tables t JOIN sys.schemas s ON s.schema_id = t.schema_id WHERE t.name IN (?) AND s.name = ?",
+		Args: []interface{}{schema},
+	}
+}
+
+func (sqlServerDialect) fallbackQuery(db *sql.DB, schema string, kind string, table string) (string, error) {
+	// Count the rows, as IDENT_CURRENT is NULL for tables without an identity column
+	return fmt.Sprintf("SELECT COUNT_BIG(*) FROM %s.%s", quoteSQLServerIdentifier(schema), quoteSQLServerIdentifier(table)), nil
+}
+
+func (sqlServerDialect) bindType() int {
+	return sqlx.AT
+}
+
+func (sqlServerDialect) capabilities() dialectCapabilities {
+	return dialectCapabilities{Increment: true, Size: true}
+}
+
+// quoteSQLServerIdentifier quotes a table or schema name in brackets so it can be used in a SQL Server query
+// Any closing brackets within the name are escaped by doubling them
+func quoteSQLServerIdentifier(name string) string {
+	return "[" + strings.Replace(name, "]", "]]", -1) + "]"
+}
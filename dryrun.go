@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// printDryRunQueries prints the queries, and their arguments, that were run to obtain each countCollection
+func printDryRunQueries(countCollections map[string]countCollection) {
+	for _, countCollectionName := range getSortedKeys(countCollections) {
+		// Go through each countCollection and print its queries
+		fmt.Printf("Queries for database %s:\n", countCollectionName)
+
+		for _, query := range countCollections[countCollectionName].Queries {
+			// Go through each query and print it, along with the arguments it was run with
+			fmt.Printf("  %s\n", query.SQL)
+			if len(query.Args) > 0 {
+				fmt.Printf("    args: %s\n", formatQueryArgs(query.Args))
+			}
+		}
+
+		fmt.Println()
+	}
+}
+
+// printDryRunMetrics prints each datum that would be published to each sink
+// This is both the table metrics for the differences, and the run metrics about rowmetrics itself
+func printDryRunMetrics(sinks []sink, report runReport, runMetrics []metricDatum) {
+	for _, sink := range sinks {
+		// Go through each sink and print the datums it would publish
+		fmt.Printf("Metrics that would be published to %s:\n", sink.name())
+
+		for _, datum := range append(sink.metrics(report), runMetrics...) {
+			fmt.Printf("  %s\n", datum)
+		}
+
+		fmt.Println()
+	}
+}
+
+// printDryRunAlerts prints each alert event that would be sent
+func printDryRunAlerts(events []alertEvent) {
+	if len(events) == 0 {
+		return
+	}
+
+	fmt.Println("Alerts that would be sent:")
+	for _, event := range events {
+		fmt.Printf("  [%s] %s\n", event.Status, event.Message)
+	}
+
+	fmt.Println()
+}
+
+// printDryRunState prints the counts YAML that would be written to fileName
+func printDryRunState(fileName string, state countState) {
+	stateYaml, err := marshalYAML(&state)
+	if err != nil {
+		fmt.Printf("Counts YAML could not be generated: %s\n", err)
+		return
+	}
+
+	fmt.Printf("Counts YAML that would be written to %s:\n%s", fileName, stateYaml)
+}
+
+// formatQueryArgs formats the arguments of a query as a list, quoting strings so empty values and spaces are visible
+func formatQueryArgs(args []interface{}) string {
+	var formattedArgs []string
+	for _, arg := range args {
+		if stringArg, ok := arg.(string); ok {
+			formattedArgs = append(formattedArgs, fmt.Sprintf("%q", stringArg))
+		} else {
+			formattedArgs = append(formattedArgs, fmt.Sprintf("%v", arg))
+		}
+	}
+
+	return "[" + strings.Join(formattedArgs, ", ") + "]"
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// countingStateStore is a memoryStateStore that counts how many times it was locked and saved
+type countingStateStore struct {
+	*memoryStateStore
+	locks int
+	saves int
+}
+
+func (s *countingStateStore) lock() (func() error, error) {
+	s.locks++
+	return s.memoryStateStore.lock()
+}
+
+func (s *countingStateStore) save(state countState) error {
+	s.saves++
+	return s.memoryStateStore.save(state)
+}
+
+func TestRunCollectionDryRun(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "edge.db")
+	createSQLiteDatabase(t, path,
+		"CREATE TABLE Sale (id INTEGER PRIMARY KEY AUTOINCREMENT, total INTEGER)",
+		"INSERT INTO Sale (total) VALUES (1), (2), (3)",
+	)
+
+	historyPath := filepath.Join(dir, "history.jsonl")
+	config := applicationConfig{
+		Databases: []databaseConfig{{Name: "edge", Type: "sqlite", Host: path, Tables: tableConfig{Increment: []string{"Sale"}}}},
+		History:   historyConfig{Path: historyPath},
+	}
+	store := &countingStateStore{memoryStateStore: &memoryStateStore{}}
+	recorder := &recordingSink{}
+
+	// Without any state, a dry run neither saves the first state nor starts the history
+	result, err := runCollection(config, store, []sink{recorder}, "dry-1", true)
+	if err != nil {
+		t.Fatalf("runCollection returned an error: %s", err)
+	}
+	if !result.FirstRun || result.Tables != 1 {
+		t.Errorf("result is %+v, expected the first run over one table", result)
+	}
+	if store.locks != 0 || store.saves != 0 || store.hasState {
+		t.Errorf("state was locked %d times and saved %d times, expected a dry run to leave it alone", store.locks, store.saves)
+	}
+	if _, err := os.Stat(historyPath); !os.IsNotExist(err) {
+		t.Errorf("history file exists, expected a dry run not to append to it")
+	}
+
+	// A real run saves the state the dry run is then compared with
+	if _, err := runCollection(config, store, []sink{recorder}, "run-1", false); err != nil {
+		t.Fatalf("runCollection returned an error: %s", err)
+	}
+	state := store.state
+	history, err := ioutil.ReadFile(historyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	published := len(recorder.published)
+
+	createSQLiteDatabase(t, path, "INSERT INTO Sale (total) VALUES (4), (5)")
+	result, err = runCollection(config, store, []sink{recorder}, "dry-2", true)
+	if err != nil {
+		t.Fatalf("runCollection returned an error: %s", err)
+	}
+	if result.FirstRun || len(result.Deltas) != 1 || result.Deltas[0].Delta != 2 {
+		t.Errorf("result is %+v, expected Sale to have increased by 2", result)
+	}
+
+	if store.saves != 1 || !reflect.DeepEqual(store.state, state) {
+		t.Errorf("state was saved %d times, expected only the real run to save it", store.saves)
+	}
+	if len(recorder.published) != published {
+		t.Errorf("recorder was given %d publishes, expected the dry run to publish nothing", len(recorder.published)-published)
+	}
+	if report := recorder.reports[len(recorder.reports)-1]; report.RunID != "dry-2" || report.Differences["edge"].Increment["Sale"] != 2 {
+		t.Errorf("last report is %+v, expected the dry run's differences to be converted into metrics to print", report)
+	}
+	if after, err := ioutil.ReadFile(historyPath); err != nil || string(after) != string(history) {
+		t.Errorf("history file changed, expected a dry run not to append to it")
+	}
+}
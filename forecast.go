@@ -0,0 +1,524 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaults for the forecast configuration
+const (
+	defaultForecastLookback = "90d"
+	defaultForecastModel    = "auto"
+)
+
+// forecastHorizons are the number of days ahead every forecast projects to
+var forecastHorizons = []int{30, 90, 365}
+
+// forecastConfig is the configuration of capacity forecasting, which fits a growth trend to each table's history
+// Model is "linear", "exponential", or "auto" to use whichever fits the history best, defaulting to "auto"
+// Seasonal adds the usual difference of each day of the week to the trend
+// Lookback is how far back history is fitted, and Limits the row counts and sizes to project the time until
+type forecastConfig struct {
+	Model    string
+	Seasonal bool
+	Lookback string
+	Limits   []forecastLimit
+}
+
+// forecastLimit is a row count or size a table must not reach, such as a disk budget, partition limit or the largest value of its key
+// Database and Table are optional, and restrict the limit to one database or table, otherwise it applies to every table
+// Bytes is a size such as "500GB" or "2TiB"
+type forecastLimit struct {
+	Database string
+	Table    string
+	Rows     int64
+	Bytes    string
+}
+
+// forecastPoint is a single value of a table at a time, as fitted by fitTrend
+type forecastPoint struct {
+	Time  time.Time
+	Value float64
+}
+
+// trend is a growth trend fitted to a table's history, see fitTrend
+// Linear trends are Intercept + Slope * days since Origin, and exponential trends are e to the power of the same
+// Seasonal is the usual difference of each day of the week from the trend, on the same scale, or all zero if not seasonal
+// Error is the root mean square error of the fit, in the units of the values
+type trend struct {
+	Model     string
+	Origin    time.Time
+	Intercept float64
+	Slope     float64
+	Seasonal  [7]float64
+	Error     float64
+}
+
+// tableForecast is the forecast of a single table's row count and size
+// Rows and Bytes are nil if there was not enough history to fit them, and RowLimit and ByteLimit are 0 if no limit applies
+type tableForecast struct {
+	Database  string
+	Table     string
+	Kind      string
+	Rows      *trend
+	Bytes     *trend
+	RowsNow   float64
+	BytesNow  float64
+	RowLimit  float64
+	ByteLimit float64
+}
+
+// getForecasts fits a growth trend to the history of every table, and finds the limits that apply to it
+// filter selects the tables to forecast, from their latest history record
+// It returns the forecasts, sorted by database, kind and table, as well as an error if the configuration is invalid or the history could not be read
+func getForecasts(config applicationConfig, now time.Time, filter func(historyRecord) bool) ([]tableForecast, error) {
+	if config.History.Path == "" {
+		return nil, fmt.Errorf("forecasting needs history.path to be configured")
+	}
+
+	var forecastConfig forecastConfig
+	if config.Forecast != nil {
+		forecastConfig = *config.Forecast
+	}
+
+	lookback, model, err := getForecastParameters(forecastConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	// History older than its retention has been pruned, so a longer lookback would silently fit less than configured
+	retention, err := getHistoryRetention(config.History)
+	if err != nil {
+		return nil, err
+	}
+	if lookback > retention {
+		slog.Warn("Forecast lookback is longer than the history retention, only the retained history is fitted", "lookback", lookback, "retention", retention)
+		lookback = retention
+	}
+
+	history, err := readRecentHistory(config.History.Path, now.Add(-lookback))
+	if err != nil {
+		return nil, err
+	}
+
+	// Group the history by table, keeping the latest record of each
+	type seriesKey struct {
+		Database string
+		Table    string
+		Kind     string
+	}
+	type series struct {
+		latest historyRecord
+		rows   []forecastPoint
+		bytes  []forecastPoint
+	}
+	seriesByTable := make(map[seriesKey]*series)
+	for _, record := range history {
+		key := seriesKey{Database: record.Database, Table: record.Table, Kind: record.Kind}
+		if seriesByTable[key] == nil {
+			seriesByTable[key] = &series{}
+		}
+
+		tableSeries := seriesByTable[key]
+		tableSeries.latest = record
+		tableSeries.rows = append(tableSeries.rows, forecastPoint{Time: record.Time, Value: float64(record.Value)})
+		if record.Bytes != nil {
+			tableSeries.bytes = append(tableSeries.bytes, forecastPoint{Time: record.Time, Value: float64(*record.Bytes)})
+		}
+	}
+
+	var forecasts []tableForecast
+	for key, tableSeries := range seriesByTable {
+		if !filter(tableSeries.latest) {
+			continue
+		}
+
+		forecast := tableForecast{Database: key.Database, Table: key.Table, Kind: key.Kind, RowsNow: float64(tableSeries.latest.Value)}
+		if tableSeries.latest.Bytes != nil {
+			forecast.BytesNow = float64(*tableSeries.latest.Bytes)
+		}
+
+		if rows, err := fitTrend(tableSeries.rows, model, forecastConfig.Seasonal); err == nil {
+			forecast.Rows = &rows
+		}
+		if bytes, err := fitTrend(tableSeries.bytes, model, forecastConfig.Seasonal); err == nil {
+			forecast.Bytes = &bytes
+		}
+
+		forecast.RowLimit, forecast.ByteLimit, err = getForecastLimits(forecastConfig.Limits, key.Database, key.Table)
+		if err != nil {
+			return nil, err
+		}
+
+		forecasts = append(forecasts, forecast)
+	}
+
+	sort.Slice(forecasts, func(i, j int) bool {
+		if forecasts[i].Database != forecasts[j].Database {
+			return forecasts[i].Database < forecasts[j].Database
+		}
+		if forecasts[i].Kind != forecasts[j].Kind {
+			return forecasts[i].Kind < forecasts[j].Kind
+		}
+		return forecasts[i].Table < forecasts[j].Table
+	})
+
+	return forecasts, nil
+}
+
+// fitTrend fits a growth trend to a series of points by least squares, see trend
+// With the "auto" model, both a linear and an exponential trend are fitted, and the one with the smallest error is used
+// Exponential trends can only be fitted to series without any zero or negative values
+// It returns the trend, as well as an error if there are fewer than 3 points, or they span less than a day
+func fitTrend(points []forecastPoint, model string, seasonal bool) (trend, error) {
+	if len(points) < 3 || points[len(points)-1].Time.Sub(points[0].Time) < 24*time.Hour {
+		return trend{}, fmt.Errorf("not enough history, at least 3 points over a day are needed")
+	}
+
+	if model == "auto" {
+		linear, _ := fitTrend(points, "linear", seasonal)
+		exponential, err := fitTrend(points, "exponential", seasonal)
+		if err != nil || linear.Error <= exponential.Error {
+			return linear, nil
+		}
+		return exponential, nil
+	}
+
+	fitted := trend{Model: model, Origin: points[0].Time}
+
+	// Exponential trends are fitted as linear trends of the logarithm of the values
+	xs := make([]float64, len(points))
+	ys := make([]float64, len(points))
+	for i, point := range points {
+		xs[i] = point.Time.Sub(fitted.Origin).Hours() / 24
+		ys[i] = point.Value
+		if model == "exponential" {
+			if point.Value <= 0 {
+				return trend{}, fmt.Errorf("exponential trends need values above zero")
+			}
+			ys[i] = math.Log(point.Value)
+		}
+	}
+
+	var meanX, meanY float64
+	for i := range xs {
+		meanX += xs[i]
+		meanY += ys[i]
+	}
+	meanX /= float64(len(xs))
+	meanY /= float64(len(ys))
+
+	var covariance, variance float64
+	for i := range xs {
+		covariance += (xs[i] - meanX) * (ys[i] - meanY)
+		variance += (xs[i] - meanX) * (xs[i] - meanX)
+	}
+	fitted.Slope = covariance / variance
+	fitted.Intercept = meanY - fitted.Slope*meanX
+
+	if seasonal {
+		// The seasonal difference of each day of the week is the average of the differences from the trend on that day
+		var sums, counts [7]float64
+		for i, point := range points {
+			weekday := point.Time.UTC().Weekday()
+			sums[weekday] += ys[i] - (fitted.Intercept + fitted.Slope*xs[i])
+			counts[weekday]++
+		}
+		for weekday := range sums {
+			if counts[weekday] > 0 {
+				fitted.Seasonal[weekday] = sums[weekday] / counts[weekday]
+			}
+		}
+	}
+
+	var squares float64
+	for _, point := range points {
+		difference := fitted.at(point.Time) - point.Value
+		squares += difference * difference
+	}
+	fitted.Error = math.Sqrt(squares / float64(len(points)))
+
+	return fitted, nil
+}
+
+// at returns the value of the trend at a time
+func (t trend) at(when time.Time) float64 {
+	value := t.Intercept + t.Slope*when.Sub(t.Origin).Hours()/24 + t.Seasonal[when.UTC().Weekday()]
+	if t.Model == "exponential" {
+		return math.Exp(value)
+	}
+
+	return value
+}
+
+// daysUntil finds the number of days from now until the trend reaches a limit
+// Seasonal trends reach it on the first day of the week that would reach it, so the result errs early
+// It returns the number of days, 0 if the limit has already been reached, as well as false if the trend never reaches it
+func (t trend) daysUntil(limit float64, now time.Time) (float64, bool) {
+	if t.at(now) >= limit {
+		return 0, true
+	}
+	if t.Slope <= 0 || limit <= 0 {
+		return 0, false
+	}
+
+	target := limit
+	if t.Model == "exponential" {
+		target = math.Log(limit)
+	}
+
+	highest := t.Seasonal[0]
+	for _, difference := range t.Seasonal {
+		highest = math.Max(highest, difference)
+	}
+
+	days := (target-highest-t.Intercept)/t.Slope - now.Sub(t.Origin).Hours()/24
+	return math.Max(days, 0), true
+}
+
+// getForecastLimits finds the row and byte limits that apply to a table, from the first limit that matches it with each set
+// It returns the limits, 0 if none apply, as well as an error if a byte limit could not be parsed
+func getForecastLimits(limits []forecastLimit, database string, table string) (float64, float64, error) {
+	var rowLimit, byteLimit float64
+
+	for _, limit := range limits {
+		if (limit.Database != "" && limit.Database != database) || (limit.Table != "" && limit.Table != table) {
+			continue
+		}
+
+		if rowLimit == 0 && limit.Rows > 0 {
+			rowLimit = float64(limit.Rows)
+		}
+		if byteLimit == 0 && limit.Bytes != "" {
+			bytes, err := parseByteSize(limit.Bytes)
+			if err != nil {
+				return 0, 0, err
+			}
+			byteLimit = float64(bytes)
+		}
+	}
+
+	return rowLimit, byteLimit, nil
+}
+
+// getForecastParameters parses a forecastConfig, filling in the defaults
+// It returns the lookback and model, as well as an error if either is invalid
+func getForecastParameters(config forecastConfig) (time.Duration, string, error) {
+	lookbackValue := config.Lookback
+	if lookbackValue == "" {
+		lookbackValue = defaultForecastLookback
+	}
+	lookback, err := parseLongDuration(lookbackValue)
+	if err != nil || lookback <= 0 {
+		return 0, "", fmt.Errorf("invalid forecast lookback %q", lookbackValue)
+	}
+
+	model := config.Model
+	if model == "" {
+		model = defaultForecastModel
+	}
+	if model != "auto" && model != "linear" && model != "exponential" {
+		return 0, "", fmt.Errorf("invalid forecast model %q, must be auto, linear or exponential", model)
+	}
+
+	return lookback, model, nil
+}
+
+// byteUnits are the multipliers of the units parseByteSize accepts, longest first so that "KiB" isn't mistaken for "B"
+var byteUnits = []struct {
+	suffix     string
+	multiplier float64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40}, {"PiB", 1 << 50},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12}, {"PB", 1e15},
+	{"B", 1},
+}
+
+// parseByteSize parses a size such as "500GB" or "1.5TiB", or a plain number of bytes
+func parseByteSize(value string) (int64, error) {
+	number, multiplier := strings.TrimSpace(value), float64(1)
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(number, unit.suffix) {
+			number, multiplier = strings.TrimSpace(strings.TrimSuffix(number, unit.suffix)), unit.multiplier
+			break
+		}
+	}
+
+	size, err := strconv.ParseFloat(number, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q, must be a number of bytes or a size such as 500GB", value)
+	}
+
+	return int64(size * multiplier), nil
+}
+
+// getForecastMetrics converts forecasts into datums
+// ProjectedRows and ProjectedBytes are published for each horizon, and DaysUntilLimit for each limit the trend reaches
+// DaysUntilLimit has no unit, as CloudWatch has no unit of days
+// Every datum has the table's kind as a dimension, as the same table may be configured as both kinds
+func getForecastMetrics(forecasts []tableForecast, now time.Time) []metricDatum {
+	var datums []metricDatum
+
+	for _, forecast := range forecasts {
+		for _, projection := range []struct {
+			name  string
+			limit string
+			trend *trend
+			value float64
+			unit  string
+		}{
+			{"ProjectedRows", "rows", forecast.Rows, forecast.RowLimit, "Count"},
+			{"ProjectedBytes", "bytes", forecast.Bytes, forecast.ByteLimit, "Bytes"},
+		} {
+			if projection.trend == nil {
+				continue
+			}
+
+			for _, days := range forecastHorizons {
+				datums = append(datums, metricDatum{
+					Name: projection.name,
+					Dimensions: []metricDimension{
+						{Name: "database", Value: forecast.Database},
+						{Name: "kind", Value: forecast.Kind},
+						{Name: "table", Value: forecast.Table},
+						{Name: "horizon", Value: fmt.Sprintf("%dd", days)},
+					},
+					Value: math.Max(projection.trend.at(now.AddDate(0, 0, days)), 0),
+					Unit:  projection.unit,
+				})
+			}
+
+			if projection.value <= 0 {
+				continue
+			}
+			if days, ok := projection.trend.daysUntil(projection.value, now); ok {
+				datums = append(datums, metricDatum{
+					Name: "DaysUntilLimit",
+					Dimensions: []metricDimension{
+						{Name: "database", Value: forecast.Database},
+						{Name: "kind", Value: forecast.Kind},
+						{Name: "table", Value: forecast.Table},
+						{Name: "limit", Value: projection.limit},
+					},
+					Value: days,
+					Unit:  "None",
+				})
+			}
+		}
+	}
+
+	return datums
+}
+
+// runForecastCommand runs the forecast subcommand, printing the projected rows and sizes of each table
+// It returns the exit code, 0 if the forecasts could be printed
+func runForecastCommand(args []string) int {
+	var (
+		configPath string
+		database   string
+		table      string
+		format     string
+	)
+
+	flags := flag.NewFlagSet("forecast", flag.ExitOnError)
+	flags.StringVar(&configPath, "config", "config.yml", "path to the application config YAML file")
+	flags.StringVar(&database, "db", "", "only forecast tables in this database")
+	flags.StringVar(&table, "table", "", "only forecast this table")
+	flags.StringVar(&format, "format", "table", "output format: table or csv")
+	flags.Parse(args)
+
+	if format != "table" && format != "csv" {
+		fmt.Fprintf(os.Stderr, "rowmetrics: unknown format %q, must be table or csv\n", format)
+		return 2
+	}
+
+	config, err := loadApplicationConfig(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rowmetrics: failed to load application config YAML: %s\n", err)
+		return 1
+	}
+
+	now := time.Now()
+	forecasts, err := getForecasts(config, now, func(record historyRecord) bool {
+		return (database == "" || record.Database == database) && (table == "" || record.Table == table)
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rowmetrics: %s\n", err)
+		return 1
+	}
+
+	header := []string{"database", "table", "kind", "row_model", "rows"}
+	for _, days := range forecastHorizons {
+		header = append(header, fmt.Sprintf("rows_%dd", days))
+	}
+	header = append(header, "days_to_row_limit", "byte_model", "bytes")
+	for _, days := range forecastHorizons {
+		header = append(header, fmt.Sprintf("bytes_%dd", days))
+	}
+	header = append(header, "days_to_byte_limit")
+
+	var rows [][]string
+	for _, forecast := range forecasts {
+		rows = append(rows, getForecastColumns(forecast, now))
+	}
+
+	err = writeReport(os.Stdout, format, header, rows)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rowmetrics: %s\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// getForecastColumns returns the values of a forecast to print, blank where there is no trend or limit
+// The model is "learning" when there is not enough history to fit a trend, and has "+weekly" appended when it is seasonal
+func getForecastColumns(forecast tableForecast, now time.Time) []string {
+	columns := []string{forecast.Database, forecast.Table, forecast.Kind}
+	for _, projection := range []struct {
+		trend *trend
+		now   float64
+		limit float64
+	}{
+		{forecast.Rows, forecast.RowsNow, forecast.RowLimit},
+		{forecast.Bytes, forecast.BytesNow, forecast.ByteLimit},
+	} {
+		model, current := "learning", strconv.FormatFloat(projection.now, 'f', 0, 64)
+		if projection.trend != nil {
+			model = projection.trend.Model
+			if projection.trend.Seasonal != [7]float64{} {
+				model += "+weekly"
+			}
+		} else if projection.now == 0 {
+			// Tables without any sizes, such as those of dialects that can't report them, have nothing to show
+			model, current = "", ""
+		}
+
+		columns = append(columns, model, current)
+		for _, days := range forecastHorizons {
+			if projection.trend == nil {
+				columns = append(columns, "")
+				continue
+			}
+			columns = append(columns, strconv.FormatFloat(math.Max(projection.trend.at(now.AddDate(0, 0, days)), 0), 'f', 0, 64))
+		}
+
+		limit := ""
+		if projection.trend != nil && projection.limit > 0 {
+			limit = "never"
+			if days, ok := projection.trend.daysUntil(projection.limit, now); ok {
+				limit = strconv.FormatFloat(days, 'f', 1, 64)
+			}
+		}
+		columns = append(columns, limit)
+	}
+
+	return columns
+}
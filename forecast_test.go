@@ -0,0 +1,135 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// getDailyPoints returns a point a day for each value, starting at origin
+func getDailyPoints(origin time.Time, values ...float64) []forecastPoint {
+	points := make([]forecastPoint, len(values))
+	for i, value := range values {
+		points[i] = forecastPoint{Time: origin.AddDate(0, 0, i), Value: value}
+	}
+
+	return points
+}
+
+func TestFitTrend(t *testing.T) {
+	origin := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	linear := getDailyPoints(origin, 100, 110, 120, 130, 140)
+	exponential := getDailyPoints(origin, 100, 200, 400, 800, 1600)
+
+	tests := []struct {
+		name              string
+		points            []forecastPoint
+		model             string
+		expectedModel     string
+		expectedIntercept float64
+		expectedSlope     float64
+	}{
+		{name: "linear", points: linear, model: "linear", expectedModel: "linear", expectedIntercept: 100, expectedSlope: 10},
+		{name: "exponential", points: exponential, model: "exponential", expectedModel: "exponential", expectedIntercept: math.Log(100), expectedSlope: math.Ln2},
+		{name: "auto picks linear", points: linear, model: "auto", expectedModel: "linear", expectedIntercept: 100, expectedSlope: 10},
+		{name: "auto picks exponential", points: exponential, model: "auto", expectedModel: "exponential", expectedIntercept: math.Log(100), expectedSlope: math.Ln2},
+		// An empty table can't be fitted exponentially, so auto falls back to linear
+		{name: "auto with zero", points: getDailyPoints(origin, 0, 0, 0), model: "auto", expectedModel: "linear"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fitted, err := fitTrend(test.points, test.model, false)
+			if err != nil {
+				t.Fatalf("fitTrend returned an error: %s", err)
+			}
+			if fitted.Model != test.expectedModel || !fitted.Origin.Equal(origin) {
+				t.Fatalf("trend is %+v, expected a %s trend from %s", fitted, test.expectedModel, origin)
+			}
+			if math.Abs(fitted.Intercept-test.expectedIntercept) > 1e-9 || math.Abs(fitted.Slope-test.expectedSlope) > 1e-9 || fitted.Error > 1e-6 {
+				t.Errorf("trend is %+v, expected an intercept of %g and slope of %g that fit exactly", fitted, test.expectedIntercept, test.expectedSlope)
+			}
+			if last := test.points[len(test.points)-1]; math.Abs(fitted.at(last.Time)-last.Value) > 1e-6 {
+				t.Errorf("trend is %g at %s, expected %g", fitted.at(last.Time), last.Time, last.Value)
+			}
+		})
+	}
+
+	if _, err := fitTrend(getDailyPoints(origin, 0, 1, 2), "exponential", false); err == nil {
+		t.Errorf("fitTrend fitted an exponential trend to a series with a zero")
+	}
+}
+
+func TestFitTrendSpan(t *testing.T) {
+	origin := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		points []forecastPoint
+		valid  bool
+	}{
+		{name: "two points", points: getDailyPoints(origin, 100, 110)},
+		{name: "under a day", points: []forecastPoint{{origin, 100}, {origin.Add(12 * time.Hour), 105}, {origin.Add(23 * time.Hour), 110}}},
+		{name: "a day", points: []forecastPoint{{origin, 100}, {origin.Add(12 * time.Hour), 105}, {origin.Add(24 * time.Hour), 110}}, valid: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := fitTrend(test.points, "linear", false); (err == nil) != test.valid {
+				t.Errorf("fitTrend returned the error %v, expected valid to be %t", err, test.valid)
+			}
+		})
+	}
+}
+
+func TestTrendDaysUntil(t *testing.T) {
+	origin := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	linear := trend{Model: "linear", Origin: origin, Intercept: 100, Slope: 10}
+	exponential := trend{Model: "exponential", Origin: origin, Intercept: math.Log(100), Slope: math.Ln2}
+
+	tests := []struct {
+		name     string
+		trend    trend
+		limit    float64
+		now      time.Time
+		expected float64
+		reached  bool
+	}{
+		{name: "linear", trend: linear, limit: 200, now: origin, expected: 10, reached: true},
+		{name: "linear from later", trend: linear, limit: 200, now: origin.AddDate(0, 0, 4), expected: 6, reached: true},
+		{name: "already reached", trend: linear, limit: 150, now: origin.AddDate(0, 0, 6), expected: 0, reached: true},
+		{name: "exponential", trend: exponential, limit: 1600, now: origin, expected: 4, reached: true},
+		{name: "shrinking", trend: trend{Model: "linear", Origin: origin, Intercept: 100, Slope: -1}, limit: 200, now: origin},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			days, reached := test.trend.daysUntil(test.limit, test.now)
+			if reached != test.reached || math.Abs(days-test.expected) > 1e-9 {
+				t.Errorf("daysUntil is %g and %t, expected %g and %t", days, reached, test.expected, test.reached)
+			}
+		})
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected int64
+		valid    bool
+	}{
+		{value: "1024", expected: 1024, valid: true},
+		{value: "500GB", expected: 500e9, valid: true},
+		{value: "1.5 KiB", expected: 1536, valid: true},
+		{value: "2TiB", expected: 2 << 40, valid: true},
+		{value: "-1GB"},
+		{value: "lots"},
+	}
+
+	for _, test := range tests {
+		size, err := parseByteSize(test.value)
+		if (err == nil) != test.valid || size != test.expected {
+			t.Errorf("size %q is %d with error %v, expected %d", test.value, size, err, test.expected)
+		}
+	}
+}
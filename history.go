@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// defaultHistoryRetention is how long history records are kept when no retention is configured
+// It is as long as defaultForecastLookback, so that forecasts have their whole lookback of history by default
+const defaultHistoryRetention = "90d"
+
+// historyConfig is the configuration of the history file every collected snapshot is appended to
+// Path is the JSONL file to append to, history is only kept if it is set
+// Retention is how long records are kept for, such as "72h" or "90d", defaulting to defaultHistoryRetention
+type historyConfig struct {
+	Path      string
+	Retention string
+}
+
+// historyRecord is a single table's count in a single run, as recorded in the history file
+// Delta is the difference from the previous run, and is omitted when there was no previous run to compare with
+// Interval is the number of seconds since the previous run, which the delta was accumulated over
+// Bytes is the size of the table, including indexes, and is omitted if the dialect couldn't report it
+type historyRecord struct {
+	Time     time.Time `json:"time"`
+	Database string    `json:"database"`
+	Table    string    `json:"table"`
+	Kind     string    `json:"kind"`
+	Value    int       `json:"value"`
+	Delta    *int      `json:"delta,omitempty"`
+	Interval float64   `json:"interval,omitempty"`
+	Bytes    *int64    `json:"bytes,omitempty"`
+}
+
+// getHistoryRecords takes the countCollections of a run and their differences from the previous run, and creates the records to append
+// diffCountCollections may be nil, or lack a database, if there was no previous run to compare with
+// interval is the time since the previous run, or 0 if it is unknown
+func getHistoryRecords(collectedAt time.Time, curCountCollections map[string]countCollection, diffCountCollections map[string]countCollection, interval time.Duration) []historyRecord {
+	var records []historyRecord
+
+	for _, countCollectionName := range getSortedKeys(curCountCollections) {
+		// Go through each database, and each of its counts in a stable order
+		curCountCollection := curCountCollections[countCollectionName]
+		diffCountCollection, hasDiff := diffCountCollections[countCollectionName]
+
+		for _, kind := range []string{"increment", "row"} {
+			counts, diffs := curCountCollection.Increment, diffCountCollection.Increment
+			if kind == "row" {
+				counts, diffs = curCountCollection.Row, diffCountCollection.Row
+			}
+
+			for _, table := range getSortedKeys(counts) {
+				record := historyRecord{
+					Time:     collectedAt.UTC(),
+					Database: countCollectionName,
+					Table:    table,
+					Kind:     kind,
+					Value:    counts[table],
+				}
+
+				if delta, ok := diffs[table]; hasDiff && ok {
+					// Only record a delta when the table was also counted last run
+					record.Delta = &delta
+					record.Interval = interval.Seconds()
+				}
+
+				if size, ok := curCountCollection.Sizes[table]; ok {
+					record.Bytes = &size
+				}
+
+				records = append(records, record)
+			}
+		}
+	}
+
+	return records
+}
+
+// appendHistory appends records to the history file, creating it if it doesn't exist
+// Records older than the retention are then pruned, see pruneHistory
+// It returns an error if any issues were encountered
+func appendHistory(config historyConfig, records []historyRecord) error {
+	retention, err := getHistoryRetention(config)
+	if err != nil {
+		return err
+	}
+
+	// Encode every record first, so a failure can't leave a partial run in the file
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	for _, record := range records {
+		err = encoder.Encode(record)
+		if err != nil {
+			return err
+		}
+	}
+
+	historyFile, err := os.OpenFile(config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = historyFile.Write(buffer.Bytes())
+	if err == nil {
+		err = historyFile.Sync()
+	}
+	if closeErr := historyFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return pruneHistory(config.Path, time.Now().Add(-retention))
+}
+
+// pruneHistory removes records collected before cutoff from the history file
+// Records are appended in time order, so the file is only rewritten when its first record is older than cutoff
+// The file is replaced atomically, see writeFileAtomic
+// It returns an error if any issues were encountered
+func pruneHistory(fileName string, cutoff time.Time) error {
+	historyFile, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer historyFile.Close()
+
+	// Check the first record, to avoid rewriting the file on every run
+	reader := bufio.NewReader(historyFile)
+	firstLine, err := reader.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	var first historyRecord
+	if json.Unmarshal(firstLine, &first) == nil && !first.Time.Before(cutoff) {
+		return nil
+	}
+
+	// Otherwise, keep every line from the first record within the retention onwards
+	_, err = historyFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	var kept bytes.Buffer
+	keeping := false
+	scanner := newHistoryScanner(historyFile)
+	for scanner.Scan() {
+		if !keeping {
+			var record historyRecord
+			if json.Unmarshal(scanner.Bytes(), &record) != nil || record.Time.Before(cutoff) {
+				// Drop expired records, and any unreadable lines among them
+				continue
+			}
+			keeping = true
+		}
+
+		kept.Write(scanner.Bytes())
+		kept.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return writeFileAtomic(fileName, kept.Bytes(), false)
+}
+
+// readHistory reads the records in the history file that match a filter
+// Lines that can't be parsed, such as one cut short by a crash mid-append, are skipped
+// It returns the matching records in the order they were appended, as well as an error if the file could not be read
+func readHistory(fileName string, filter func(historyRecord) bool) ([]historyRecord, error) {
+	historyFile, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer historyFile.Close()
+
+	var records []historyRecord
+	scanner := newHistoryScanner(historyFile)
+	for scanner.Scan() {
+		var record historyRecord
+		if json.Unmarshal(scanner.Bytes(), &record) != nil {
+			continue
+		}
+
+		if filter(record) {
+			records = append(records, record)
+		}
+	}
+
+	return records, scanner.Err()
+}
+
+// readRecentHistory reads the records in the history file collected since a time
+// A history file that doesn't exist yet has no records
+// It returns the records in the order they were appended, as well as an error if the file could not be read
+func readRecentHistory(fileName string, since time.Time) ([]historyRecord, error) {
+	records, err := readHistory(fileName, func(record historyRecord) bool {
+		return !record.Time.Before(since)
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	return records, err
+}
+
+// newHistoryScanner creates a line scanner for a history file
+func newHistoryScanner(reader io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	return scanner
+}
+
+// getHistoryRetention parses the configured retention, or the default if none is configured
+// It returns the retention, as well as an error if it could not be parsed
+func getHistoryRetention(config historyConfig) (time.Duration, error) {
+	retention := config.Retention
+	if retention == "" {
+		retention = defaultHistoryRetention
+	}
+
+	duration, err := parseLongDuration(retention)
+	if err != nil {
+		return 0, fmt.Errorf("invalid history retention %q: %s", retention, err)
+	}
+	if duration <= 0 {
+		return 0, fmt.Errorf("invalid history retention %q: must be positive", retention)
+	}
+
+	return duration, nil
+}
+
+// parseLongDuration parses a duration like time.ParseDuration, additionally accepting days and weeks, such as "7d" or "2w"
+func parseLongDuration(value string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if number := strings.TrimSuffix(value, suffix); number != value {
+			count, err := strconv.ParseFloat(number, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", value)
+			}
+			return time.Duration(count * float64(unit)), nil
+		}
+	}
+
+	return time.ParseDuration(value)
+}
+
+// parseSince parses the start of a time range, either a duration before now, such as "24h" or "7d", or an RFC 3339 timestamp
+func parseSince(value string, now time.Time) (time.Time, error) {
+	if since, err := time.Parse(time.RFC3339, value); err == nil {
+		return since, nil
+	}
+
+	duration, err := parseLongDuration(value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, must be a duration such as 24h or 7d, or an RFC 3339 timestamp", value)
+	}
+
+	return now.Add(-duration), nil
+}
+
+// runHistoryCommand runs the history subcommand, printing the deltas and rates recorded in the history file
+// It returns the exit code, 0 if the history could be printed
+func runHistoryCommand(args []string) int {
+	var (
+		configPath string
+		database   string
+		table      string
+		kind       string
+		since      string
+		format     string
+	)
+
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	flags.StringVar(&configPath, "config", "config.yml", "path to the application config YAML file")
+	flags.StringVar(&database, "db", "", "only print records for this database")
+	flags.StringVar(&table, "table", "", "only print records for this table")
+	flags.StringVar(&kind, "kind", "", "only print records of this kind: increment or row")
+	flags.StringVar(&since, "since", "24h", "only print records collected since this duration ago, such as 24h or 7d, or an RFC 3339 timestamp")
+	flags.StringVar(&format, "format", "table", "output format: table or csv")
+	flags.Parse(args)
+
+	if format != "table" && format != "csv" {
+		fmt.Fprintf(os.Stderr, "rowmetrics: unknown format %q, must be table or csv\n", format)
+		return 2
+	}
+
+	sinceTime, err := parseSince(since, time.Now())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rowmetrics: %s\n", err)
+		return 2
+	}
+
+	config, err := loadApplicationConfig(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rowmetrics: failed to load application config YAML: %s\n", err)
+		return 1
+	}
+	if config.History.Path == "" {
+		fmt.Fprintf(os.Stderr, "rowmetrics: %s has no history.path configured\n", configPath)
+		return 1
+	}
+
+	records, err := readHistory(config.History.Path, func(record historyRecord) bool {
+		return !record.Time.Before(sinceTime) &&
+			(database == "" || record.Database == database) &&
+			(table == "" || record.Table == table) &&
+			(kind == "" || record.Kind == kind)
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rowmetrics: failed to read history: %s\n", err)
+		return 1
+	}
+
+	var rows [][]string
+	for _, record := range records {
+		rows = append(rows, getHistoryColumns(record))
+	}
+
+	err = writeReport(os.Stdout, format, historyHeader, rows)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rowmetrics: %s\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// getHistoryColumns returns the values of a record to print, with the delta and rate blank if there is no delta
+// The rate is the delta per second over the interval since the previous run
+func getHistoryColumns(record historyRecord) []string {
+	delta, rate := "", ""
+	if record.Delta != nil {
+		delta = strconv.Itoa(*record.Delta)
+		if record.Interval > 0 {
+			rate = strconv.FormatFloat(float64(*record.Delta)/record.Interval, 'f', 3, 64)
+		}
+	}
+
+	return []string{record.Time.Format(time.RFC3339), record.Database, record.Table, record.Kind, strconv.Itoa(record.Value), delta, rate}
+}
+
+// historyHeader is the header printed above the columns from getHistoryColumns
+var historyHeader = []string{"time", "database", "table", "kind", "value", "delta", "rate_per_second"}
+
+// writeReport writes the rows of a report, such as the history or forecast subcommands print
+// Format is either "table", for a table aligned with spaces, or "csv", and both start with the header
+func writeReport(out io.Writer, format string, header []string, rows [][]string) error {
+	if format == "csv" {
+		writer := csv.NewWriter(out)
+		writer.Write(header)
+		writer.WriteAll(rows)
+
+		return writer.Error()
+	}
+
+	writer := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, strings.ToUpper(strings.Join(header, "\t")))
+	for _, row := range rows {
+		fmt.Fprintln(writer, strings.Join(row, "\t"))
+	}
+
+	return writer.Flush()
+}
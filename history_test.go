@@ -0,0 +1,166 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeHistoryLines writes a history file with the given lines, as if they had been appended by earlier runs
+func writeHistoryLines(t *testing.T, path string, lines ...string) {
+	t.Helper()
+
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetHistoryRecords(t *testing.T) {
+	collectedAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	cur := map[string]countCollection{
+		"shop": {Increment: map[string]int{"Sale": 120}, Row: map[string]int{"Product": 30}, Sizes: map[string]int64{"Sale": 4096}},
+		"edge": {Increment: map[string]int{"Msg": 7}, Row: map[string]int{}},
+	}
+	// edge wasn't counted last run, and Product is new to shop
+	diffs := map[string]countCollection{
+		"shop": {Increment: map[string]int{"Sale": 60}, Row: map[string]int{}},
+	}
+
+	records := getHistoryRecords(collectedAt, cur, diffs, time.Minute)
+	if len(records) != 3 {
+		t.Fatalf("got %d records, expected one for each table", len(records))
+	}
+
+	if records[0].Database != "edge" || records[0].Delta != nil || records[0].Interval != 0 {
+		t.Errorf("record of Msg is %+v, expected no delta", records[0])
+	}
+	sale := records[1]
+	if sale.Table != "Sale" || sale.Value != 120 || sale.Delta == nil || *sale.Delta != 60 || sale.Interval != 60 || sale.Bytes == nil || *sale.Bytes != 4096 {
+		t.Errorf("record of Sale is %+v, expected its value, delta over a minute and size", sale)
+	}
+	if product := records[2]; product.Table != "Product" || product.Kind != "row" || product.Delta != nil || product.Bytes != nil {
+		t.Errorf("record of Product is %+v, expected only its value", product)
+	}
+}
+
+func TestAppendHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	config := historyConfig{Path: path}
+	now := time.Now().UTC().Truncate(time.Second)
+	cur := map[string]countCollection{"shop": {Increment: map[string]int{"Sale": 120}, Row: map[string]int{}}}
+
+	// Append two runs, the second with a delta from the first
+	first := getHistoryRecords(now.Add(-time.Minute), cur, nil, 0)
+	second := getHistoryRecords(now, cur, map[string]countCollection{"shop": {Increment: map[string]int{"Sale": 0}}}, time.Minute)
+	for _, records := range [][]historyRecord{first, second} {
+		if err := appendHistory(config, records); err != nil {
+			t.Fatalf("appendHistory returned an error: %s", err)
+		}
+	}
+
+	records, err := readHistory(path, func(historyRecord) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := append(first, second...); !reflect.DeepEqual(records, expected) {
+		t.Errorf("history is %+v, expected %+v", records, expected)
+	}
+}
+
+func TestAppendHistoryPrunes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	now := time.Now().UTC()
+
+	// Two records are older than the retention, with an unreadable line among them
+	writeHistoryLines(t, path,
+		`{"time":"`+now.Add(-72*time.Hour).Format(time.RFC3339)+`","database":"shop","table":"Sale","kind":"increment","value":1}`,
+		`not a record`,
+		`{"time":"`+now.Add(-48*time.Hour).Format(time.RFC3339)+`","database":"shop","table":"Sale","kind":"increment","value":2}`,
+		`{"time":"`+now.Add(-time.Hour).Format(time.RFC3339)+`","database":"shop","table":"Sale","kind":"increment","value":3}`,
+		``,
+	)
+
+	cur := map[string]countCollection{"shop": {Increment: map[string]int{"Sale": 4}, Row: map[string]int{}}}
+	if err := appendHistory(historyConfig{Path: path, Retention: "1d"}, getHistoryRecords(now, cur, nil, 0)); err != nil {
+		t.Fatalf("appendHistory returned an error: %s", err)
+	}
+
+	records, err := readHistory(path, func(historyRecord) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	var values []int
+	for _, record := range records {
+		values = append(values, record.Value)
+	}
+	if !reflect.DeepEqual(values, []int{3, 4}) {
+		t.Errorf("history has the values %v, expected only those within the retention", values)
+	}
+
+	// A file with nothing to prune isn't rewritten
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := pruneHistory(path, now.Add(-24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) {
+		t.Errorf("history was rewritten, expected it to be left alone")
+	}
+}
+
+func TestReadRecentHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	since := time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	// A run crashed while appending, cutting its last line short
+	writeHistoryLines(t, path,
+		`{"time":"2026-01-01T12:00:00Z","database":"shop","table":"Sale","kind":"increment","value":1}`,
+		`{"time":"2026-01-02T12:00:00Z","database":"shop","table":"Sale","kind":"increment","value":2,"delta":1,"interval":86400}`,
+		`{"time":"2026-01-03T12:00:00Z","database":"shop","table":"Sa`,
+	)
+
+	records, err := readRecentHistory(path, since)
+	if err != nil {
+		t.Fatalf("readRecentHistory returned an error: %s", err)
+	}
+	if len(records) != 1 || records[0].Value != 2 || records[0].Delta == nil || *records[0].Delta != 1 {
+		t.Errorf("records are %+v, expected only the complete record since %s", records, since)
+	}
+
+	records, err = readRecentHistory(filepath.Join(t.TempDir(), "missing.jsonl"), since)
+	if err != nil || records != nil {
+		t.Errorf("readRecentHistory returned %v and %v for a missing file, expected no records", records, err)
+	}
+}
+
+func TestGetHistoryRetention(t *testing.T) {
+	tests := []struct {
+		retention string
+		expected  time.Duration
+		valid     bool
+	}{
+		{retention: "", expected: 90 * 24 * time.Hour, valid: true},
+		{retention: "72h", expected: 72 * time.Hour, valid: true},
+		{retention: "2w", expected: 14 * 24 * time.Hour, valid: true},
+		{retention: "0d"},
+		{retention: "-1h"},
+		{retention: "forever"},
+	}
+
+	for _, test := range tests {
+		retention, err := getHistoryRetention(historyConfig{Retention: test.retention})
+		if (err == nil) != test.valid || retention != test.expected {
+			t.Errorf("retention %q is %s with error %v, expected %s", test.retention, retention, err, test.expected)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"time"
+)
+
+// runStats is the set of operational measurements taken during a single run, published as metrics about rowmetrics itself
+// CollectionDurations is keyed by database name, and PublishFailures by sink name
+// StateWriteLatency is 0 if the counts YAML was not written, and LastRunTime is zero if there was no previous run
+type runStats struct {
+	CollectionDurations map[string]time.Duration
+	PublishFailures     map[string]int
+	StateWriteLatency   time.Duration
+	LastRunTime         time.Time
+}
+
+// getRunMetrics converts the operational measurements of a run into datums, so rowmetrics itself can be monitored
+// Heartbeat is always included, so an alarm on it going missing catches rowmetrics silently not running
+// It returns the datums, to be published to every sink alongside the table metrics
+func getRunMetrics(stats runStats, countCollections map[string]countCollection) []metricDatum {
+	datums := []metricDatum{
+		{Name: "Heartbeat", Value: 1, Unit: "Count"},
+	}
+
+	if !stats.LastRunTime.IsZero() {
+		// If there was a previous run, add how long ago it was
+		datums = append(datums, metricDatum{Name: "SecondsSinceLastRun", Value: time.Since(stats.LastRunTime).Seconds(), Unit: "Seconds"})
+	}
+
+	if stats.StateWriteLatency > 0 {
+		// If the counts YAML was written, add how long that took
+		datums = append(datums, metricDatum{Name: "StateWriteLatency", Value: getMilliseconds(stats.StateWriteLatency), Unit: "Milliseconds"})
+	}
+
+	for _, countCollectionName := range getSortedKeys(countCollections) {
+		// Go through each countCollection and add how it was collected
+		countCollection := countCollections[countCollectionName]
+		dimensions := []metricDimension{{Name: "database", Value: countCollectionName}}
+
+		datums = append(datums,
+			metricDatum{Name: "CollectionDuration", Dimensions: dimensions, Value: getMilliseconds(stats.CollectionDurations[countCollectionName]), Unit: "Milliseconds"},
+			metricDatum{Name: "TablesCollected", Dimensions: dimensions, Value: float64(len(countCollection.Increment) + len(countCollection.Row)), Unit: "Count"},
+			metricDatum{Name: "MissingTables", Dimensions: dimensions, Value: float64(len(countCollection.Missing)), Unit: "Count"},
+		)
+
+		for _, query := range countCollection.Queries {
+			// Go through each query that completed, and add its latency broken down by dialect and query kind
+			if query.Duration == 0 {
+				continue
+			}
+
+			datums = append(datums, metricDatum{
+				Name: "QueryLatency",
+				Dimensions: []metricDimension{
+					{Name: "database", Value: countCollectionName},
+					{Name: "dialect", Value: countCollection.Dialect},
+					{Name: "query", Value: query.Kind},
+				},
+				Value: getMilliseconds(query.Duration),
+				Unit:  "Milliseconds",
+			})
+		}
+	}
+
+	for _, sinkName := range getSortedKeys(stats.PublishFailures) {
+		// Go through each sink that was published to, and add whether publishing failed
+		datums = append(datums, metricDatum{
+			Name:       "PublishFailures",
+			Dimensions: []metricDimension{{Name: "sink", Value: sinkName}},
+			Value:      float64(stats.PublishFailures[sinkName]),
+			Unit:       "Count",
+		})
+	}
+
+	return datums
+}
+
+// getMilliseconds converts a duration into fractional milliseconds
+func getMilliseconds(duration time.Duration) float64 {
+	return float64(duration) / float64(time.Millisecond)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaults for running in AWS Lambda
+const (
+	defaultLambdaConfigPath = "config.yml"
+	defaultLambdaCountPath  = "/tmp/counts.yml"
+)
+
+// lambdaEvent is the event a Lambda invocation is given, such as an EventBridge scheduled event
+// Config overrides whole sections of the config YAML, such as "databases" or "state", keyed the same as in the config YAML
+// It can be given at the top level of the event, as a target's constant input is, or in its detail, as a custom event's is
+type lambdaEvent struct {
+	ID         string                 `json:"id"`
+	DetailType string                 `json:"detail-type"`
+	Config     map[string]interface{} `json:"config"`
+	Detail     struct {
+		Config map[string]interface{} `json:"config"`
+	} `json:"detail"`
+}
+
+// lambdaDeps creates what a Lambda invocation runs a collection with from its config, so the handler can be run without AWS
+type lambdaDeps struct {
+	getStateStore func(config applicationConfig) (stateStore, error)
+	getSinks      func(config applicationConfig) ([]sink, error)
+}
+
+// defaultLambdaDeps creates the state store and sinks configured by the config YAML
+var defaultLambdaDeps = lambdaDeps{getStateStore: getStateStore, getSinks: getSinks}
+
+// handleLambdaEvent runs a single collection for a Lambda invocation, with the config YAML at $ROWMETRICS_CONFIG overridden by the event
+// The state must be kept in S3 or DynamoDB, as nothing written to the function's filesystem outlives it
+// Log lines are written as JSON, at the level in $ROWMETRICS_LOG_LEVEL, tagged with a new run ID for each invocation
+// It returns the result of the run, as well as an error if the run failed, so the invocation is reported as failed
+func handleLambdaEvent(ctx context.Context, event lambdaEvent) (runResult, error) {
+	return defaultLambdaDeps.handleEvent(ctx, event)
+}
+
+// handleEvent handles a Lambda invocation as handleLambdaEvent does, creating the state store and sinks with deps
+func (deps lambdaDeps) handleEvent(ctx context.Context, event lambdaEvent) (runResult, error) {
+	result := runResult{RunID: newRunID()}
+
+	logLevel := os.Getenv("ROWMETRICS_LOG_LEVEL")
+	if logLevel == "" {
+		logLevel = "info"
+	}
+	logger, err := newLogger(os.Stderr, logLevel, "json", result.RunID)
+	if err != nil {
+		result.Error = err.Error()
+		return result, err
+	}
+	slog.SetDefault(logger)
+
+	// fail logs why the invocation failed before a run could start, and returns it as the result
+	fail := func(msg string, args ...interface{}) (runResult, error) {
+		slog.Error(msg, args...)
+		result.Error = formatFailure(msg, args...)
+		return result, fmt.Errorf("%s", result.Error)
+	}
+
+	configPath := os.Getenv("ROWMETRICS_CONFIG")
+	if configPath == "" {
+		configPath = defaultLambdaConfigPath
+	}
+
+	// Overrides in the detail take precedence over those at the top level of the event
+	overrides := make(map[string]interface{})
+	for section, value := range event.Config {
+		overrides[section] = value
+	}
+	for section, value := range event.Detail.Config {
+		overrides[section] = value
+	}
+
+	config, err := loadLambdaConfig(configPath, overrides)
+	if err != nil {
+		return fail("Failed to load application config YAML", "path", configPath, "error", err)
+	}
+
+	if config.State.Type == "" || config.State.Type == "file" {
+		return fail("State must be kept in S3 or DynamoDB when running in Lambda", "type", config.State.Type)
+	}
+	if config.CountPath == "" {
+		// The notification state is still kept next to countPath, and /tmp is the only writable path in Lambda
+		// It only lasts as long as the execution environment, so rate limits and run failures aren't remembered across cold starts
+		config.CountPath = defaultLambdaCountPath
+	}
+
+	store, err := deps.getStateStore(config)
+	if err != nil {
+		return fail("Failed to create state store", "error", err)
+	}
+
+	sinks, err := deps.getSinks(config)
+	if err != nil {
+		return fail("Failed to create sinks", "error", err)
+	}
+
+	slog.Info("Handling Lambda event", "event_id", event.ID, "detail_type", event.DetailType, "overrides", len(overrides), "state", store.describe())
+
+	return runCollection(config, store, sinks, result.RunID, false)
+}
+
+// loadLambdaConfig loads the config YAML file, replacing any of its top level sections with those in overrides
+// The file may be missing if overrides configures everything instead
+// It returns an applicationConfig with the mapped values, as well as an error
+func loadLambdaConfig(fileName string, overrides map[string]interface{}) (applicationConfig, error) {
+	var config applicationConfig
+
+	sections := make(map[string]interface{})
+	configSource, err := ioutil.ReadFile(fileName)
+	if err != nil && !(os.IsNotExist(err) && len(overrides) > 0) {
+		return config, err
+	}
+
+	err = yaml.Unmarshal(configSource, &sections)
+	if err != nil {
+		return config, err
+	}
+
+	for section, value := range overrides {
+		sections[section] = value
+	}
+
+	// Round trip the merged sections through YAML, so they are mapped exactly as the config YAML file would be
+	mergedSource, err := marshalYAML(sections)
+	if err != nil {
+		return config, err
+	}
+
+	err = yaml.Unmarshal(mergedSource, &config)
+	if err != nil {
+		return config, err
+	}
+
+	return config, nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// memoryStateStore keeps the state in memory, standing in for S3 or DynamoDB
+type memoryStateStore struct {
+	state    countState
+	hasState bool
+}
+
+func (s *memoryStateStore) describe() string {
+	return "memory"
+}
+
+func (s *memoryStateStore) lock() (func() error, error) {
+	return func() error { return nil }, nil
+}
+
+func (s *memoryStateStore) load() (countState, bool, error) {
+	return s.state, s.hasState, nil
+}
+
+func (s *memoryStateStore) save(state countState) error {
+	s.state = state
+	s.hasState = true
+	return nil
+}
+
+// recordingSink records the reports it converts into metrics and the metrics it is given to publish
+type recordingSink struct {
+	reports   []runReport
+	published [][]metricDatum
+}
+
+func (s *recordingSink) name() string {
+	return "recording"
+}
+
+func (s *recordingSink) maxBackfillAge() time.Duration {
+	return unlimitedBackfill
+}
+
+func (s *recordingSink) metrics(report runReport) []metricDatum {
+	s.reports = append(s.reports, report)
+	return nil
+}
+
+func (s *recordingSink) publish(datums []metricDatum) error {
+	s.published = append(s.published, datums)
+	return nil
+}
+
+// testEventBridgeEvent returns a scheduled EventBridge event, with the given config overrides in its detail
+func testEventBridgeEvent(t *testing.T, overrides map[string]interface{}) lambdaEvent {
+	t.Helper()
+
+	source, err := json.Marshal(map[string]interface{}{
+		"version":     "0",
+		"id":          "d1c9e6b0-0000-4000-8000-000000000000",
+		"detail-type": "Scheduled Event",
+		"source":      "aws.events",
+		"time":        "2026-01-02T03:04:05Z",
+		"detail":      map[string]interface{}{"config": overrides},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var event lambdaEvent
+	if err := json.Unmarshal(source, &event); err != nil {
+		t.Fatal(err)
+	}
+
+	return event
+}
+
+func TestHandleLambdaEvent(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "edge.db")
+	createSQLiteDatabase(t, path,
+		"CREATE TABLE Sale (id INTEGER PRIMARY KEY AUTOINCREMENT, total INTEGER)",
+		"INSERT INTO Sale (total) VALUES (1), (2)",
+	)
+
+	// Everything is configured by the event, so there is no config YAML file
+	t.Setenv("ROWMETRICS_CONFIG", filepath.Join(dir, "missing.yml"))
+	t.Setenv("ROWMETRICS_LOG_LEVEL", "error")
+
+	store := &memoryStateStore{}
+	recorder := &recordingSink{}
+	deps := lambdaDeps{
+		getStateStore: func(config applicationConfig) (stateStore, error) {
+			if config.State.Type != "s3" || config.State.Bucket != "rowmetrics-state" {
+				return nil, fmt.Errorf("state is %+v, expected the overridden state", config.State)
+			}
+			return store, nil
+		},
+		getSinks: func(applicationConfig) ([]sink, error) {
+			return []sink{recorder}, nil
+		},
+	}
+
+	event := testEventBridgeEvent(t, map[string]interface{}{
+		"countPath": filepath.Join(dir, "counts.yml"),
+		"state":     map[string]interface{}{"type": "s3", "bucket": "rowmetrics-state"},
+		"databases": []interface{}{
+			map[string]interface{}{
+				"name":   "edge",
+				"type":   "sqlite",
+				"host":   path,
+				"tables": map[string]interface{}{"increment": []string{"Sale"}},
+			},
+		},
+	})
+
+	// The first invocation only saves the state
+	result, err := deps.handleEvent(context.Background(), event)
+	if err != nil {
+		t.Fatalf("handleEvent returned an error: %s", err)
+	}
+	if !result.FirstRun || result.Databases != 1 || result.Tables != 1 || result.RunID == "" {
+		t.Errorf("result is %+v, expected a first run of one table with a run ID", result)
+	}
+	if !store.hasState || store.state.getCountCollections()["edge"].Increment["Sale"] != 2 {
+		t.Errorf("state is %+v, expected the increment of Sale to be saved", store.state)
+	}
+	if len(recorder.reports) != 0 {
+		t.Errorf("sink was given %d reports, expected none on the first run", len(recorder.reports))
+	}
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO Sale (total) VALUES (3), (4), (5)"); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	// The next invocation publishes the difference, with a new run ID
+	next, err := deps.handleEvent(context.Background(), event)
+	if err != nil {
+		t.Fatalf("handleEvent returned an error: %s", err)
+	}
+	if next.FirstRun || next.RunID == "" || next.RunID == result.RunID || next.Error != "" {
+		t.Errorf("result is %+v, expected a successful run with a new run ID", next)
+	}
+	if len(next.Deltas) != 1 || next.Deltas[0] != (runDelta{Database: "edge", Table: "Sale", Kind: "increment", Delta: 3}) {
+		t.Errorf("deltas are %+v, expected the 3 new rows of Sale", next.Deltas)
+	}
+	if failures, ok := next.PublishFailures["recording"]; !ok || failures != 0 {
+		t.Errorf("publish failures are %v, expected none for the sink", next.PublishFailures)
+	}
+	if len(recorder.reports) != 1 || recorder.reports[0].Differences["edge"].Increment["Sale"] != 3 {
+		t.Errorf("sink was given %+v, expected a report of the 3 new rows of Sale", recorder.reports)
+	}
+}
+
+func TestHandleLambdaEventFileState(t *testing.T) {
+	t.Setenv("ROWMETRICS_CONFIG", filepath.Join(t.TempDir(), "missing.yml"))
+	t.Setenv("ROWMETRICS_LOG_LEVEL", "error")
+
+	deps := lambdaDeps{
+		getStateStore: func(applicationConfig) (stateStore, error) {
+			t.Fatal("the state store was created for file state")
+			return nil, nil
+		},
+		getSinks: func(applicationConfig) ([]sink, error) {
+			t.Fatal("the sinks were created for file state")
+			return nil, nil
+		},
+	}
+
+	// The state defaults to the counts YAML file, which would be lost with the function's filesystem
+	event := testEventBridgeEvent(t, map[string]interface{}{"databases": []interface{}{}})
+	result, err := deps.handleEvent(context.Background(), event)
+	if err == nil || result.Error == "" || result.RunID == "" {
+		t.Errorf("result is %+v, expected the invocation to fail", result)
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// errLocked is returned by lockFile when another process holds the lock
+var errLocked = errors.New("another rowmetrics run holds the lock")
+
+// fileLock is an exclusive lock held on a lock file, see lockFile
+type fileLock struct {
+	file *os.File
+	path string
+}
+
+// getLockPath returns the path of the lock file that guards the counts YAML
+func getLockPath(countPath string) string {
+	return countPath + ".lock"
+}
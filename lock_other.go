@@ -0,0 +1,53 @@
+//go:build !unix && !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// staleLockAge is how old a lock file must be before it is assumed to have been left behind by a process that exited
+// This is best effort, as there is no portable way to tell whether the process is still running:
+// a run that takes longer than this can have its lock taken over, and a lock left behind blocks runs until it is this old
+const staleLockAge = time.Hour
+
+// lockFile takes an exclusive lock by creating the file at path, which must not already exist
+// A lock file older than staleLockAge is taken over, see staleLockAge
+// It returns the lock, errLocked if another process holds it, or another error if it could not be taken
+func lockFile(path string) (*fileLock, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			// Record the process holding the lock, to help whoever finds it
+			fmt.Fprintf(file, "%d\n", os.Getpid())
+			return &fileLock{file: file, path: path}, nil
+		} else if !os.IsExist(err) {
+			return nil, err
+		}
+
+		// If the lock file exists, check whether it is old enough to be stale
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			// The lock was released in the meantime, so try again
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if time.Since(info.ModTime()) < staleLockAge {
+			return nil, errLocked
+		}
+
+		// The lock is stale, so remove it and try again
+		os.Remove(path)
+	}
+
+	return nil, errLocked
+}
+
+// unlock releases the lock by removing the lock file
+func (l *fileLock) unlock() error {
+	l.file.Close()
+	return os.Remove(l.path)
+}
@@ -0,0 +1,46 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive lock on the file at path, creating it if needed
+// The lock is released by unlock, or by the operating system if the process exits without unlocking
+// It returns the lock, errLocked if another process holds it, or another error if it could not be taken
+func lockFile(path string) (*fileLock, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	// Take the lock without waiting, as an overlapping run should be skipped rather than queued
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		file.Close()
+		return nil, errLocked
+	} else if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// Record the process holding the lock, to help whoever finds it
+	file.Truncate(0)
+	fmt.Fprintf(file, "%d\n", os.Getpid())
+
+	return &fileLock{file: file, path: path}, nil
+}
+
+// unlock releases the lock
+// The lock file itself is left in place, as removing it would race with another process locking it
+func (l *fileLock) unlock() error {
+	err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
@@ -0,0 +1,47 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockFile takes an exclusive lock on the file at path, creating it if needed
+// The lock is released by unlock, or by Windows if the process exits without unlocking
+// It returns the lock, errLocked if another process holds it, or another error if it could not be taken
+func lockFile(path string) (*fileLock, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	// Take the lock on the first byte without waiting, as an overlapping run should be skipped rather than queued
+	err = windows.LockFileEx(windows.Handle(file.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, new(windows.Overlapped))
+	if err == windows.ERROR_LOCK_VIOLATION {
+		file.Close()
+		return nil, errLocked
+	} else if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// Record the process holding the lock, to help whoever finds it
+	file.Truncate(0)
+	fmt.Fprintf(file, "%d\n", os.Getpid())
+
+	return &fileLock{file: file, path: path}, nil
+}
+
+// unlock releases the lock
+// The lock file itself is left in place, as removing it would race with another process locking it
+func (l *fileLock) unlock() error {
+	err := windows.UnlockFileEx(windows.Handle(l.file.Fd()), 0, 1, 0, new(windows.Overlapped))
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// newLogger creates a leveled, structured logger writing to out
+// Level is one of "debug", "info", "warn" or "error", and format is either "text" or "json"
+// Every line logged includes runID, so all the lines of a single run can be found together
+// It returns the logger, as well as an error if the level or format is not recognised
+func newLogger(out io.Writer, level string, format string, runID string) (*slog.Logger, error) {
+	var slogLevel slog.Level
+	err := slogLevel.UnmarshalText([]byte(level))
+	if err != nil {
+		return nil, fmt.Errorf("unknown log level %q, must be one of debug, info, warn or error", level)
+	}
+
+	options := &slog.HandlerOptions{Level: slogLevel}
+
+	var handler slog.Handler
+	switch strings.ToLower(format) {
+	case "text":
+		handler = slog.NewTextHandler(out, options)
+	case "json":
+		handler = slog.NewJSONHandler(out, options)
+	default:
+		return nil, fmt.Errorf("unknown log format %q, must be either text or json", format)
+	}
+
+	return slog.New(handler).With("run_id", runID), nil
+}
+
+// newRunID generates a random identifier for a single run, to correlate its log lines
+func newRunID() string {
+	runID := make([]byte, 8)
+	if _, err := rand.Read(runID); err != nil {
+		// Without randomness, the process ID at least tells overlapping runs apart
+		return fmt.Sprintf("pid-%d", os.Getpid())
+	}
+
+	return hex.EncodeToString(runID)
+}
+
+// fatal logs msg at the error level, along with its attributes, and exits the process
+// It is only used before a run starts, as runCollection returns its failures so they can be notified
+func fatal(msg string, args ...interface{}) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// formatFailure describes a failure as its log message followed by its attributes, as "msg key=value ..."
+func formatFailure(msg string, args ...interface{}) string {
+	failure := msg
+	for i := 0; i+1 < len(args); i += 2 {
+		failure += fmt.Sprintf(" %v=%v", args[i], args[i+1])
+	}
+
+	return failure
+}
@@ -2,30 +2,41 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"log/slog"
+	"net/url"
 	"os"
+	"strings"
+	"time"
 
-	"gopkg.in/yaml.v2"
-
-	_ "github.com/go-sql-driver/mysql"
-	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-lambda-go/lambda"
+	"gopkg.in/yaml.v3"
 )
 
 // applicationConfig is the struct which the config YAML will be mapped to
 // To see an example, look at config.yml.example
 type applicationConfig struct {
-	AwsConfig map[string]string `yaml:"aws"`
-	CountPath string            `yaml:"countPath"`
-	Databases []databaseConfig
+	AwsConfig     map[string]string `yaml:"aws"`
+	CountPath     string            `yaml:"countPath"`
+	History       historyConfig
+	Alerts        []alertRule
+	Notifications []notificationConfig
+	Anomaly       anomalyConfig
+	Forecast      *forecastConfig
+	Statsd        *statsdConfig
+	Influx        *influxConfig
+	Graphite      *graphiteConfig
+	OTLP          *otlpConfig `yaml:"otlp"`
+	Textfile      *textfileConfig
+	EMF           *emfConfig `yaml:"emf"`
+	GCP           *gcpConfig `yaml:"gcp"`
+	Azure         *azureConfig
+	Webhook       *webhookSinkConfig
+	State         stateConfig
+	Databases     []databaseConfig
 }
 
 // countConfig is the struct which the counts YAML will be mapped to and written as
@@ -44,6 +55,8 @@ type databaseConfig struct {
 	Password string
 	Database string
 	Schema   string
+	Instance string
+	Options  map[string]string
 	Tables   tableConfig
 }
 
@@ -62,54 +75,240 @@ type tableConfig struct {
 type countCollection struct {
 	Increment map[string]int
 	Row       map[string]int
+	Dialect   string              `yaml:"-"`
+	Sources   map[countKey]string `yaml:"-"`
+	Sizes     map[string]int64    `yaml:"-"`
+	Missing   []missingTable      `yaml:"-"`
+	Queries   []executedQuery     `yaml:"-"`
+}
+
+// countKey identifies a single count in a countCollection
+// Kind is the table list it was configured in, either "increment" or "row"
+type countKey struct {
+	Kind  string
+	Table string
+}
+
+// executedQuery is a query that was run to obtain a countCollection, along with its arguments
+// Kind is what the query obtained, either "increment", "row", "fallback" or "size"
+// Duration is how long the query took to run and read, or 0 if it failed
+type executedQuery struct {
+	Kind     string
+	SQL      string
+	Args     []interface{}
+	Duration time.Duration
+}
+
+// missingTable is a configured table that no count could be obtained for
+// Kind is the table list it was configured in, either "increment" or "row"
+// Reason describes why there is no count, for example the table not existing in the schema
+type missingTable struct {
+	Table  string
+	Kind   string
+	Reason string
 }
 
 func main() {
+	if os.Getenv("AWS_LAMBDA_RUNTIME_API") != "" {
+		// If running in AWS Lambda, hand over to the Lambda runtime, which invokes handleLambdaEvent for each event
+		lambda.Start(handleLambdaEvent)
+		return
+	}
+
+	if len(os.Args) > 1 {
+		// If a subcommand was given, run it instead of a normal collection run
+		switch os.Args[1] {
+		case "validate":
+			os.Exit(runValidateCommand(os.Args[2:]))
+		case "history":
+			os.Exit(runHistoryCommand(os.Args[2:]))
+		case "replay":
+			os.Exit(runReplayCommand(os.Args[2:]))
+		case "forecast":
+			os.Exit(runForecastCommand(os.Args[2:]))
+		}
+	}
+
 	// Load application config as flag if specified, otherwise, use config.yml in current workdir
-	var configPath string
+	var (
+		configPath string
+		dryRun     bool
+		logLevel   string
+		logFormat  string
+	)
 	flag.StringVar(&configPath, "config", "config.yml", "path to the application config YAML file")
+	flag.BoolVar(&dryRun, "dry-run", false, "print the queries, metrics and counts YAML of a run without publishing or writing anything")
+	flag.StringVar(&logLevel, "log-level", "info", "minimum level of log lines to output: debug, info, warn or error")
+	flag.StringVar(&logFormat, "log-format", "text", "format of log lines: text or json")
 	flag.Parse()
 
+	// Set up the structured logger, tagging every line with an ID for this run
+	runID := newRunID()
+	logger, err := newLogger(os.Stderr, logLevel, logFormat, runID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rowmetrics: %s\n", err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+
 	// Load application configuration
 	config, err := loadApplicationConfig(configPath)
 	if err != nil {
-		log.Panicf("FATAL: Failed to load application config YAML: %s", err)
+		fatal("Failed to load application config YAML", "error", err)
+	}
+
+	// Create the store the last run's state is loaded from and this run's is saved to
+	store, err := getStateStore(config)
+	if err != nil {
+		fatal("Failed to create state store", "error", err)
+	}
+
+	// Create the sinks the differences will be published to
+	sinks, err := getSinks(config)
+	if err != nil {
+		fatal("Failed to create sinks", "error", err)
+	}
+
+	// Run a single collection, which has already logged why if it failed
+	_, err = runCollection(config, store, sinks, runID, dryRun)
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+// runResult is the outcome of a single collection run, as returned by the Lambda handler
+// Error describes why the run failed, or is empty if it succeeded
+type runResult struct {
+	RunID           string         `json:"runId,omitempty"`
+	CollectedAt     time.Time      `json:"collectedAt"`
+	FirstRun        bool           `json:"firstRun"`
+	Databases       int            `json:"databases"`
+	Tables          int            `json:"tables"`
+	MissingTables   int            `json:"missingTables"`
+	Deltas          []runDelta     `json:"deltas"`
+	PublishFailures map[string]int `json:"publishFailures"`
+	AlertEvents     int            `json:"alertEvents"`
+	Error           string         `json:"error,omitempty"`
+}
+
+// runDelta is the difference in a single table's count since the last run, as included in a runResult
+type runDelta struct {
+	Database string `json:"database"`
+	Table    string `json:"table"`
+	Kind     string `json:"kind"`
+	Delta    int    `json:"delta"`
+}
+
+// runCollection runs a single collection: it collects the counts, compares them with the last run's state, publishes the differences to sinks and saves the new state
+// runID is the ID the run's log lines are tagged with, which is included in its result and in what is published
+// If dryRun is set, it prints what would be published and saved instead, without locking, publishing or saving anything
+// It returns the result of the run, as well as an error if the run failed, which has been logged and notified
+func runCollection(config applicationConfig, store stateStore, sinks []sink, runID string, dryRun bool) (runResult, error) {
+	result := runResult{RunID: runID, Deltas: []runDelta{}, PublishFailures: make(map[string]int)}
+
+	// Run failures are only notified once the state is locked, so overlapping runs don't notify each other's failures
+	notify := false
+	fail := func(msg string, args ...interface{}) (runResult, error) {
+		slog.Error(msg, args...)
+		result.Error = formatFailure(msg, args...)
+		if notify {
+			notifyRunStatus(config, store.describe(), result.Error)
+		}
+		return result, errors.New(result.Error)
+	}
+
+	if !dryRun {
+		// Lock the state for the whole run, so overlapping runs can't interleave loads and saves
+		unlock, err := store.lock()
+		if err != nil {
+			return fail("Failed to lock state", "state", store.describe(), "error", err)
+		}
+		defer unlock()
+
+		// Notify the channels if the rest of the run fails
+		notify = true
+	}
+
+	// Create the runStats that operational measurements of this run will be recorded in
+	stats := runStats{
+		CollectionDurations: make(map[string]time.Duration),
+		PublishFailures:     make(map[string]int),
 	}
 
 	// Create the countCollections map that represents the current values to be grabbed
 	var curCountCollections map[string]countCollection
 	curCountCollections = make(map[string]countCollection)
+	collectedAt := time.Now()
+	result.CollectedAt = collectedAt
 
 	for _, database := range config.Databases {
 		// Go through each configured database
 		// Obtain the countCollection for this database
-		curCountCollection, err := getCountCollection(database)
+		collectionStart := time.Now()
+		curCountCollection, err := getCountCollection(database, config.History.Path != "")
 		if err != nil {
-			log.Panicf("FATAL: Failed to get counts for database %s: %s", database.Name, err)
+			return fail("Failed to get counts", "database", database.Name, "error", err)
 		}
+		stats.CollectionDurations[database.Name] = time.Since(collectionStart)
+		slog.Info("Collected counts", "database", database.Name, "tables", len(curCountCollection.Increment)+len(curCountCollection.Row), "missing", len(curCountCollection.Missing), "duration", stats.CollectionDurations[database.Name])
 
 		// Set the countCollection associated with this database
 		curCountCollections[database.Name] = curCountCollection
+
+		result.Databases++
+		result.Tables += len(curCountCollection.Increment) + len(curCountCollection.Row)
+		result.MissingTables += len(curCountCollection.Missing)
 	}
 
-	if _, err := os.Stat(config.CountPath); os.IsNotExist(err) {
-		// If the counts YAML doesn't exist, just write it out and be done
-		// Write counts YAML to file
-		err := writeCountCollections(config.CountPath, curCountCollections)
+	// Create the state to be written, recording when and where the counts were collected
+	curState := newCountState(curCountCollections, collectedAt)
+
+	if dryRun {
+		// If this is a dry run, print the queries used to obtain the counts
+		printDryRunQueries(curCountCollections)
+	}
+
+	// Gather what this session collected for the sinks to convert into metrics, along with the differences if there was a last session
+	report := runReport{RunID: runID, CollectedAt: collectedAt, Current: curCountCollections}
+
+	// Create the countCollections map to store the difference between the two sessions' counts, if there was a last session
+	var diffCountCollections map[string]countCollection
+
+	// The anomaly results of each table in the differences, if anomaly detection is configured
+	var anomalies map[string]map[countKey]anomalyResult
+
+	// Load the last session's state from the store
+	lastState, hasLastState, err := store.load()
+	if err != nil {
+		return fail("Failed to load state", "state", store.describe(), "error", err)
+	}
+
+	if !hasLastState {
+		// If there is no state yet, just save it and be done
+		result.FirstRun = true
+		if dryRun {
+			// If this is a dry run, print what would be written instead
+			fmt.Printf("No state at %s, so no table metrics would be published\n\n", store.describe())
+			printDryRunMetrics(sinks, report, getRunMetrics(stats, curCountCollections))
+			printDryRunState(store.describe(), curState)
+			return result, nil
+		}
+
+		// Save the state to the store
+		writeStart := time.Now()
+		err := store.save(curState)
 		if err != nil {
-			log.Panicf("FATAL: Failed to write counts YAML: %s", err)
+			return fail("Failed to save state", "state", store.describe(), "error", err)
 		}
+		stats.StateWriteLatency = time.Since(writeStart)
 
 	} else {
 		// Otherwise, compare them with the current values and publish metrics
-		// Load the last session's countCollections from the counts YAML
-		lastCountCollections, err := loadCountCollections(config.CountPath)
-		if err != nil {
-			log.Panicf("FATAL: Failed to load counts YAML: %s", err)
-		}
+		lastCountCollections := lastState.getCountCollections()
+
+		// The state is saved at the end of every successful run, so it was collected by the last one
+		stats.LastRunTime = lastState.CollectedAt
 
-		// Create the countCollections map to store the difference between the two sessions' counts
-		var diffCountCollections map[string]countCollection
 		diffCountCollections = make(map[string]countCollection)
 
 		for curCountCollectionName, curCountCollection := range curCountCollections {
@@ -128,323 +327,401 @@ func main() {
 			// Store the difference for this database's countCollection
 			diffCountCollections[curCountCollectionName] = diffCountCollection
 		}
+		result.Deltas = getRunDeltas(diffCountCollections)
 
-		// Put the differences as AWS metrics
-		err = putAWSCountCollectionMetrics(diffCountCollections, config.AwsConfig)
-		if err != nil {
-			log.Printf("ERROR: Failed to push Cloudwatch metrics: %s", err)
+		report.Interval = collectedAt.Sub(lastState.CollectedAt)
+		report.Differences = diffCountCollections
+
+		// Score each table's rate against its history from the same time of day or week
+		if config.Anomaly.Seasonality != "" {
+			anomalies, err = getAnomalies(config, diffCountCollections, collectedAt.Sub(lastState.CollectedAt), collectedAt)
+			if err != nil {
+				slog.Error("Failed to detect anomalies", "error", err)
+			}
 		}
 
-		// Overwrite the last session's counts YAML with the new one
-		err = writeCountCollections(config.CountPath, curCountCollections)
-		if err != nil {
-			log.Panicf("FATAL: Failed to save counts YAML: %s", err)
+		// Check the alert rules against the differences, carrying on the state of the last session's alerts
+		var alertEvents []alertEvent
+		curState.Alerts = lastState.Alerts
+		if len(config.Alerts) > 0 {
+			curState.Alerts, alertEvents, err = getAlerts(config, diffCountCollections, lastState, collectedAt.Sub(lastState.CollectedAt), collectedAt, anomalies)
+			if err != nil {
+				slog.Error("Failed to evaluate alerts", "error", err)
+			}
+		}
+		result.AlertEvents = len(alertEvents)
+
+		if dryRun {
+			// If this is a dry run, print what would be published and written instead
+			printDryRunMetrics(sinks, report, append(getRunMetrics(stats, curCountCollections), getAnomalyMetrics(anomalies)...))
+			printDryRunAlerts(alertEvents)
+			printDryRunState(store.describe(), curState)
+			return result, nil
 		}
-	}
 
-	os.Exit(0)
-}
+		for _, sink := range sinks {
+			// Publish the differences to each sink
+			stats.PublishFailures[sink.name()] = 0
+			err = publishReport(sink, report, sink.metrics(report))
+			if err != nil {
+				stats.PublishFailures[sink.name()]++
+				slog.Error("Failed to publish metrics", "sink", sink.name(), "error", err)
+			}
+		}
+		result.PublishFailures = stats.PublishFailures
 
-// putAWSCountCollectionMetrics takes a countCollection and publishes each value as a metric on AWS CloudWatch
-// Unless an explicit set of AWS configuration values is specified, it will use the normal avenues for obtaining credentials
-// That is, Environment Variables -> Shared Credentials File -> EC2 IAM Role
-// Unless a namespace is specified, it will put the metrics in the namepace "RowMetrics"
-// It returns an error, or nil if the operation was successful
-func putAWSCountCollectionMetrics(countCollections map[string]countCollection, awsConfig map[string]string) error {
-	var (
-		awsSession *session.Session
-		err        error
-		namespace  string
-	)
+		// Send any alerts that started firing or were resolved
+		sendAlertEvents(config, alertEvents)
 
-	if awsConfig["namespace"] == "" {
-		// If a namespace is not defined in the config YAML, use the default, "RowMetrics"
-		namespace = "RowMetrics"
-	} else {
-		// Otherwise, use the namespace specified in the config YAML
-		namespace = awsConfig["namespace"]
+		// Replace the last session's state with the new one
+		writeStart := time.Now()
+		err = store.save(curState)
+		if err != nil {
+			return fail("Failed to save state", "state", store.describe(), "error", err)
+		}
+		stats.StateWriteLatency = time.Since(writeStart)
 	}
 
-	if awsConfig == nil {
-		// If no credentials are explicitly specified in the config YAML, open an AWS session using the default credential provider chain
-		awsSession, err = session.NewSession()
-	} else {
-		// Otherwise, open an AWS session using the credentials explicitly specified
-		awsSession, err = session.NewSession(&aws.Config{
-			Region:      aws.String(awsConfig["region"]),
-			Credentials: credentials.NewStaticCredentials(awsConfig["accessKeyId"], awsConfig["secretAccessKey"], ""),
-		})
-	}
-	if err != nil {
-		return err
+	if config.History.Path != "" {
+		// Append this session's counts and differences to the history file
+		var interval time.Duration
+		if !stats.LastRunTime.IsZero() {
+			interval = collectedAt.Sub(stats.LastRunTime)
+		}
+
+		err = appendHistory(config.History, getHistoryRecords(collectedAt, curCountCollections, diffCountCollections, interval))
+		if err != nil {
+			slog.Error("Failed to append to history file", "path", config.History.Path, "error", err)
+		}
 	}
 
-	// Test the credentials, and fail if there are issues
-	_, err = awsSession.Config.Credentials.Get()
-	if err != nil {
-		return err
-	}
-
-	// Create a Cloudwatch service instance using the AWS session
-	cwService := cloudwatch.New(awsSession)
-
-	for countCollectionName, countCollection := range countCollections {
-		// Go through each countCollection and publish it's tableCounts as metrics
-		for countName, count := range countCollection.Increment {
-			// Go through each count in the Increment map, and put the cloudwatch metrics
-			_, err := cwService.PutMetricData(&cloudwatch.PutMetricDataInput{
-				MetricData: []*cloudwatch.MetricDatum{
-					&cloudwatch.MetricDatum{
-						MetricName: aws.String(countName),                    // Name of the table as MetricName
-						Unit:       aws.String(cloudwatch.StandardUnitCount), // Count as the CW metric Unit
-						Value:      aws.Float64(float64(count)),              // Float64 Count of the table as the Metric Value
-						Dimensions: []*cloudwatch.Dimension{
-							&cloudwatch.Dimension{
-								Name:  aws.String("DBInstanceIdentifier"), // DBInstanceIdentifier as the metric dimension
-								Value: aws.String(countCollectionName),    // Name of the database as the metric dimension's value
-							},
-						},
-					},
-				},
-				Namespace: aws.String(namespace), // Put the metrics in the namespace specified
-			})
-
-			// If there is a failure in the PUT, just output it to stdout
-			if err != nil {
-				log.Printf("WARN: Failed to push Cloudwatch metric for table %s with count %d: %s", countName, count, err)
-			} else {
-				log.Printf("INFO: Pushed Cloudwatch metric for table %s with count %d", countName, count)
-			}
+	// Forecast the growth of each table from its history, including this session's counts
+	var forecastMetrics []metricDatum
+	if config.Forecast != nil {
+		forecasts, err := getForecasts(config, collectedAt, func(historyRecord) bool { return true })
+		if err != nil {
+			slog.Error("Failed to forecast table growth", "error", err)
 		}
+		forecastMetrics = getForecastMetrics(forecasts, collectedAt)
+	}
 
-		for countName, count := range countCollection.Row {
-			// Go through each count in the Increment map, and put the cloudwatch metrics
-			_, err := cwService.PutMetricData(&cloudwatch.PutMetricDataInput{
-				MetricData: []*cloudwatch.MetricDatum{
-					&cloudwatch.MetricDatum{
-						MetricName: aws.String(countName),                    // Name of the table as MetricName
-						Unit:       aws.String(cloudwatch.StandardUnitCount), // Count as the CW metric Unit
-						Value:      aws.Float64(float64(count)),              // Float64 Count of the table as the Metric Value
-						Dimensions: []*cloudwatch.Dimension{
-							&cloudwatch.Dimension{
-								Name:  aws.String("DBInstanceIdentifier"), // DBInstanceIdentifier as the metric dimension
-								Value: aws.String(countCollectionName),    // Name of the database as the metric dimension's value
-							},
-						},
-					},
-				},
-				Namespace: aws.String(namespace), // Put the metrics in the namespace specified
-			})
-
-			// If there is a failure in the PUT, just output it to stdout
-			if err != nil {
-				log.Printf("ERROR: Failed to push Cloudwatch metric for table %s with difference %d: %s", countName, count, err)
-			} else {
-				log.Printf("INFO: Pushed Cloudwatch metric for table %s with difference %d", countName, count)
-			}
+	// Publish the operational metrics about this run to each sink, including the heartbeat
+	runMetrics := append(append(getRunMetrics(stats, curCountCollections), getAnomalyMetrics(anomalies)...), forecastMetrics...)
+	for _, sink := range sinks {
+		err = publishRunMetrics(sink, report, runMetrics)
+		if err != nil {
+			slog.Error("Failed to publish run metrics", "sink", sink.name(), "error", err)
 		}
 	}
 
-	// Assuming no errors, return nil
-	return nil
+	// Resolve the run failure notified by the last run, if it failed
+	notifyRunStatus(config, store.describe(), "")
+
+	return result, nil
+}
+
+// getRunDeltas flattens the differences of every database into a list of deltas, in a stable order
+func getRunDeltas(diffCountCollections map[string]countCollection) []runDelta {
+	deltas := []runDelta{}
+	for _, delta := range getTableDeltas(runReport{Differences: diffCountCollections}) {
+		deltas = append(deltas, runDelta{Database: delta.Database, Table: delta.Table, Kind: delta.Kind, Delta: delta.Delta})
+	}
+
+	return deltas
 }
 
 // getCountCollection takes a databaseConfig and then retrieves the requested table counts as a countCollection
 // It returns the countCollection, as well as an error if there was any trouble retrieving the counts
-func getCountCollection(dbConfig databaseConfig) (countCollection, error) {
+func getCountCollection(dbConfig databaseConfig, collectSizes bool) (countCollection, error) {
 	// countCollection to store the tableCounts
 	var countCollection countCollection
 	// Initialize both Increment and Row maps
 	countCollection.Increment = make(map[string]int)
 	countCollection.Row = make(map[string]int)
 
-	// Database Source Name
-	var dsn string
-
-	var dbType string
-	if dbConfig.Type == "" {
-		// If no type is specified, set it to MySQL, since that is the default anyway
-		dbType = "mysql"
-	} else {
-		// Otherwise, set it to the type specified in the config YAML
-		dbType = dbConfig.Type
-	}
-
-	var dbSchema string
-	if dbConfig.Schema == "" {
-		// If no schema was explicitly defined, use a default value
-		if dbType == "mysql" {
-			// If it's a MySQL db, use the db name as the default schema
-			dbSchema = dbConfig.Database
-		} else if dbType == "postgres" {
-			// If it's a PostgreSQL db, use the public schema as the default
-			dbSchema = "public"
-		} else {
-			// Otherwise, use the db name as the default schema
-			dbSchema = dbConfig.Name
-		}
-	} else {
-		// Otherwise, use the defined schema
-		dbSchema = dbConfig.Schema
+	// Look up the dialect for the database type, which fails for unsupported types
+	dialect, err := getDialect(dbConfig)
+	if err != nil {
+		return countCollection, err
 	}
+	countCollection.Dialect = getDatabaseType(dbConfig)
+	countCollection.Sources = make(map[countKey]string)
 
-	if dbType == "mysql" {
-		// If it's a MySQL db, generate a MySQL DSN
-		dsn = fmt.Sprintf("%s:%s@tcp(%s)/%s", dbConfig.User, dbConfig.Password, dbConfig.Host, dbConfig.Database)
-	} else if dbType == "postgres" {
-		// If it's a PostgreSQL db, generate a PostgreSQL DSN
-		dsn = fmt.Sprintf("postgres://%s:%s@%s/%s", dbConfig.User, dbConfig.Password, dbConfig.Host, dbConfig.Database)
-	} else {
-		// Otherwise, generate a MySQL DSN by default as it is the most consistent
-		dsn = fmt.Sprintf("%s:%s@tcp(%s)/%s", dbConfig.User, dbConfig.Password, dbConfig.Host, dbConfig.Database)
+	// Determine the schema and DSN from the config
+	dbSchema := getDatabaseSchema(dbConfig, dialect)
+	dsn, err := getDatabaseDSN(dbConfig, dialect)
+	if err != nil {
+		return countCollection, err
 	}
 
-	// Create the database connection using the type and DSN
-	db, err := sql.Open(dbType, dsn)
+	// Create the database connection using the dialect's driver and DSN
+	db, err := sql.Open(dialect.driverName(), dsn)
 	if err != nil {
 		return countCollection, err
 	}
 	defer db.Close()
 
-	var (
-		incrementQuery string
-		incrementArgs  []interface{}
-		rowQuery       string
-		rowArgs        []interface{}
-	)
-
-	if dbConfig.Type == "mysql" {
-		// If it's a MySQL database, generate MySQL query interfaces
-		if len(dbConfig.Tables.Increment) > 0 {
-			// Generate the query and slice of arguments to pull auto increment values for the specified tables
-			incrementQuery, incrementArgs, err = sqlx.In("SELECT `TABLE_NAME`, `AUTO_INCREMENT` FROM information_schema.TABLES WHERE TABLE_NAME IN (?) AND TABLE_SCHEMA = ?", dbConfig.Tables.Increment, dbSchema)
-			if err != nil {
-				log.Printf("ERROR: Failed to assemble increment query interface: %s", err)
-			}
+	if len(dbConfig.Tables.Increment) > 0 {
+		if !dialect.capabilities().Increment {
+			// If the dialect can't report auto increment values, warn that row counts are used instead
+			slog.Warn("Database cannot report auto increment values, increment tables will use row counts instead", "database", dbConfig.Name)
 		}
 
-		if len(dbConfig.Tables.Row) > 0 {
-			// Generate the query and slice of arguments to pull the number of rows for the specified tables
-			rowQuery, rowArgs, err = sqlx.In("SELECT `TABLE_NAME`, `TABLE_ROWS` FROM information_schema.TABLES WHERE TABLE_NAME IN (?) AND TABLE_SCHEMA = ?", dbConfig.Tables.Row, dbSchema)
-			if err != nil {
-				log.Printf("ERROR: Failed to assemble row query interface: %s", err)
-			}
+		// Generate the query and slice of arguments to pull auto increment values for the specified tables
+		incrementQuery, incrementArgs, err := buildDialectQuery(dialect, dialect.incrementQuery(db, dbSchema), dbConfig.Tables.Increment)
+		if err != nil {
+			slog.Error("Failed to assemble increment query interface", "database", dbConfig.Name, "error", err)
 		}
-	} else if dbConfig.Type == "postgres" {
-		// If it's a PostgreSQL datbase, generate PostgreSQL query interfaces
-		// Currently, both Increment and Row use the same query, as it is non-trivial to obtain the auto-increment value
-		// TODO: Figure out how to obtain auto-increment values efficiently
-		if len(dbConfig.Tables.Increment) > 0 {
-			// Generate the query and slice of arguments to pull the number of rows for the specified tables
-			incrementQuery, incrementArgs, err = sqlx.In("SELECT relname,n_live_tup FROM pg_stat_user_tables WHERE relname IN (?) AND schemaname = ?", dbConfig.Tables.Increment, dbSchema)
-			if err != nil {
-				log.Printf("ERROR: Failed to assemble increment query interface: %s", err)
-			}
-			// Rebind the interface to use $1, $2, etc instead of ?, ?, etc as this is required by the PostgreSQL driver
-			incrementQuery = sqlx.Rebind(sqlx.DOLLAR, incrementQuery)
+
+		// Query for all of the auto increment tables
+		queryCounts(db, dbConfig, dialect, dbSchema, "increment", dbConfig.Tables.Increment, incrementQuery, incrementArgs, countCollection.Increment, &countCollection)
+	}
+
+	if len(dbConfig.Tables.Row) > 0 {
+		// Generate the query and slice of arguments to pull the number of rows for the specified tables
+		rowQuery, rowArgs, err := buildDialectQuery(dialect, dialect.rowQuery(db, dbSchema), dbConfig.Tables.Row)
+		if err != nil {
+			slog.Error("Failed to assemble row query interface", "database", dbConfig.Name, "error", err)
 		}
 
-		if len(dbConfig.Tables.Row) > 0 {
-			// Generate the query and slice of arguments to pull the number of rows for the specified tables
-			rowQuery, rowArgs, err = sqlx.In("SELECT relname,n_live_tup FROM pg_stat_user_tables WHERE relname IN (?) AND schemaname = ?", dbConfig.Tables.Row, dbSchema)
-			if err != nil {
-				log.Printf("ERROR: Failed to assemble row query interface: %s", err)
-			}
-			// Rebind the interface to use $1, $2, etc instead of ?, ?, etc as this is required by the PostgreSQL driver
-			rowQuery = sqlx.Rebind(sqlx.DOLLAR, rowQuery)
+		// Query for all of the row count tables
+		queryCounts(db, dbConfig, dialect, dbSchema, "row", dbConfig.Tables.Row, rowQuery, rowArgs, countCollection.Row, &countCollection)
+	}
+
+	if collectSizes && dialect.capabilities().Size {
+		// Query for the size of every table, counted as either kind
+		querySizes(db, dbConfig, dialect, dbSchema, append(append([]string{}, dbConfig.Tables.Increment...), dbConfig.Tables.Row...), &countCollection)
+	}
+
+	for _, missing := range countCollection.Missing {
+		// Report every configured table that didn't make it into the counts
+		slog.Warn("No count obtained for table", "database", dbConfig.Name, "table", missing.Table, "kind", missing.Kind, "reason", missing.Reason)
+	}
+
+	// Assuming no fatal errors, return nil
+	return countCollection, nil
+}
+
+// queryCounts runs a count query for a kind of table, and sets the count for each table returned in counts
+// Tables that are configured but not returned, or whose count is NULL or can't be scanned, are recorded in collection's Missing
+// Tables whose count is NULL are first retried with a fallback query, see getFallbackCount
+func queryCounts(db *sql.DB, dbConfig databaseConfig, dialect dialect, dbSchema string, kind string, tables []string, query string, args []interface{}, counts map[string]int, collection *countCollection) {
+	// Reasons keyed by table name, for each configured table that has no count yet
+	reasons := make(map[string]string)
+	for _, table := range tables {
+		reasons[table] = "not returned by the query, check the table name and schema"
+	}
+
+	// Record the query, so it can be printed by --dry-run and its latency published
+	queryIndex := len(collection.Queries)
+	if query != "" {
+		collection.Queries = append(collection.Queries, executedQuery{Kind: kind, SQL: query, Args: args})
+	}
+
+	queryStart := time.Now()
+	if query == "" {
+		// If the query could not be assembled, none of the tables have counts
+		for table := range reasons {
+			reasons[table] = "query could not be assembled"
+		}
+	} else if rows, err := db.Query(query, args...); err != nil {
+		// If the query failed, none of the tables have counts
+		slog.Error("Failed to query database", "database", dbConfig.Name, "kind", kind, "duration", time.Since(queryStart), "error", err)
+		for table := range reasons {
+			reasons[table] = fmt.Sprintf("query failed: %s", err)
 		}
 	} else {
-		// Otherwise, generate MySQL query interfaces by default, as MySQL is the default type anyway
-		if len(dbConfig.Tables.Increment) > 0 {
-			// Generate the query and slice of arguments to pull auto increment values for the specified tables
-			incrementQuery, incrementArgs, err = sqlx.In("SELECT TABLE_NAME,AUTO_INCREMENT FROM information_schema.TABLES WHERE TABLE_NAME IN (?) AND TABLE_SCHEMA = ?", dbConfig.Tables.Increment, dbSchema)
+		defer rows.Close()
+
+		for rows.Next() {
+			// Go through each row retrieved
+			var (
+				tableName  string
+				tableCount sql.NullInt64
+			)
+
+			// Assign the values to vars
+			err := rows.Scan(&tableName, &tableCount)
 			if err != nil {
-				log.Printf("ERROR: Failed to assemble increment query interface: %s", err)
+				slog.Error("Failed to obtain value", "database", dbConfig.Name, "table", tableName, "kind", kind, "error", err)
+				if tableName != "" {
+					reasons[tableName] = fmt.Sprintf("value could not be read: %s", err)
+				}
+				continue
 			}
-		}
 
-		if len(dbConfig.Tables.Row) > 0 {
-			// Generate the query and slice of arguments to pull the number of rows for the specified tables
-			rowQuery, rowArgs, err = sqlx.In("SELECT TABLE_NAME,TABLE_ROWS FROM information_schema.TABLES WHERE TABLE_NAME IN (?) AND TABLE_SCHEMA = ?", dbConfig.Tables.Row, dbSchema)
-			if err != nil {
-				log.Printf("ERROR: Failed to assemble row query interface: %s", err)
+			if !tableCount.Valid {
+				// If the count is NULL, try the fallback for this table instead
+				fallbackStart := time.Now()
+				fallbackCount, source, err := getFallbackCount(db, dialect, dbSchema, kind, tableName)
+				if source != "" {
+					collection.Queries = append(collection.Queries, executedQuery{Kind: "fallback", SQL: source, Duration: time.Since(fallbackStart)})
+				}
+				if err != nil {
+					reasons[tableName] = fmt.Sprintf("value is NULL, and the fallback failed: %s", err)
+					continue
+				}
+
+				slog.Debug("Value is NULL, using fallback instead", "database", dbConfig.Name, "table", tableName, "kind", kind, "query", source)
+				tableCount.Int64 = fallbackCount
+				collection.Sources[countKey{Kind: kind, Table: tableName}] = collection.Dialect + ".fallback"
+			} else {
+				collection.Sources[countKey{Kind: kind, Table: tableName}] = collection.Dialect + "." + kind
 			}
+
+			// Set the count for the table key in the counts map
+			counts[tableName] = int(tableCount.Int64)
+			delete(reasons, tableName)
+
+			slog.Debug("Obtained value", "database", dbConfig.Name, "table", tableName, "kind", kind, "count", tableCount.Int64)
 		}
-	}
 
-	if incrementQuery != "" && len(incrementArgs) > 0 {
-		// Query for all of the auto increment tables
-		rows, err := db.Query(incrementQuery, incrementArgs...)
+		// If there were any errors, output
+		err = rows.Err()
 		if err != nil {
-			log.Printf("ERROR: Failed to query database %s: %s", dbConfig.Name, err)
-		} else {
-			defer rows.Close()
+			slog.Error("Row failures", "database", dbConfig.Name, "kind", kind, "error", err)
+		}
 
-			for rows.Next() {
-				// Go through each row retrieved
-				var (
-					tableName  string
-					tableCount int
-				)
+		collection.Queries[queryIndex].Duration = time.Since(queryStart)
+		slog.Debug("Queried database", "database", dbConfig.Name, "kind", kind, "duration", collection.Queries[queryIndex].Duration)
+	}
 
-				// Assign the values to vars
-				err := rows.Scan(&tableName, &tableCount)
-				if err != nil {
-					log.Printf("ERROR: Failed to obtain values in database %s for table %s: %s", dbConfig.Name, tableName, err)
-				} else {
-					// Set the count for the table key in the Increment map
-					countCollection.Increment[tableName] = tableCount
+	for _, table := range tables {
+		// Go through each configured table in order, and record the ones without a count
+		if reason, ok := reasons[table]; ok {
+			collection.Missing = append(collection.Missing, missingTable{Table: table, Kind: kind, Reason: reason})
+		}
+	}
+}
 
-					log.Printf("INFO: Obtained value in database %s for table %s with count %d", dbConfig.Name, tableName, tableCount)
-				}
+// getFallbackCount retrieves a count for a single table, for when its value in the usual query is NULL
+// The query used is the dialect's fallback query, such as the largest primary key or an exact COUNT(*)
+// It returns the count, the query it came from if one was run, as well as an error if it could not be retrieved
+func getFallbackCount(db *sql.DB, dialect dialect, dbSchema string, kind string, table string) (int64, string, error) {
+	var count sql.NullInt64
 
-				// If there were any errors, output
-				err = rows.Err()
-				if err != nil {
-					log.Printf("ERROR: Row failures for database %s: %s", dbConfig.Name, err)
-				}
-			}
-		}
+	query, err := dialect.fallbackQuery(db, dbSchema, kind, table)
+	if err != nil {
+		return 0, "", err
 	}
 
-	if rowQuery != "" && len(rowArgs) > 0 {
-		// If the number of row tables isn't empty, query
-		// Query for all of the row count tables
-		rows, err := db.Query(rowQuery, rowArgs...)
+	err = db.QueryRow(query).Scan(&count)
+	if err != nil {
+		return 0, query, err
+	}
+
+	// MAX of an empty table is NULL, which is the same as a count of zero
+	return count.Int64, query, nil
+}
+
+// getDatabaseType takes a databaseConfig and returns the type of database it describes
+// If no type is specified, it returns "mysql", since that is the default anyway
+func getDatabaseType(dbConfig databaseConfig) string {
+	if dbConfig.Type == "" {
+		// If no type is specified, set it to MySQL, since that is the default anyway
+		return "mysql"
+	}
+
+	// Otherwise, return the type specified in the config YAML
+	return dbConfig.Type
+}
+
+// getDatabaseSchema takes a databaseConfig and returns the schema the configured tables live in
+// If no schema is explicitly defined, the dialect's default schema is returned
+func getDatabaseSchema(dbConfig databaseConfig, dialect dialect) string {
+	if dbConfig.Schema != "" {
+		// If a schema was explicitly defined, use it
+		return dbConfig.Schema
+	}
+
+	// Otherwise, use the dialect's default value
+	return dialect.defaultSchema(dbConfig)
+}
+
+// getDatabaseDSN takes a databaseConfig and generates the Database Source Name used to connect to it
+// It returns the DSN, as well as an error if the password could not be resolved
+func getDatabaseDSN(dbConfig databaseConfig, dialect dialect) (string, error) {
+	// Resolve the password, in case it references a secret
+	password, err := resolveSecret(dbConfig.Password)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve password for database %s: %s", dbConfig.Name, err)
+	}
+
+	// Encode any additional DSN options, such as TLS settings, as query parameters
+	options := url.Values{}
+	for name, value := range dbConfig.Options {
+		options.Set(name, value)
+	}
+
+	return dialect.dsn(dbConfig, password, options), nil
+}
+
+// resolveSecret takes a configured value and resolves it if it references a secret
+// Values of the form "env:NAME" are read from the environment variable NAME
+// Values of the form "file:PATH" are read from the file at PATH, without the trailing newline
+// Any other value is returned as-is
+// It returns the resolved value, as well as an error if the secret could not be resolved
+func resolveSecret(value string) (string, error) {
+	if strings.HasPrefix(value, "env:") {
+		// If the value references an environment variable, look it up
+		envName := strings.TrimPrefix(value, "env:")
+		envValue, ok := os.LookupEnv(envName)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", envName)
+		}
+
+		return envValue, nil
+	} else if strings.HasPrefix(value, "file:") {
+		// If the value references a file, read it
+		fileValue, err := ioutil.ReadFile(strings.TrimPrefix(value, "file:"))
 		if err != nil {
-			log.Printf("ERROR: Failed to query database %s: %s", dbConfig.Name, err)
-		} else {
-			defer rows.Close()
+			return "", err
+		}
 
-			for rows.Next() {
-				// Go through each row retrieved
-				var (
-					tableName  string
-					tableCount int
-				)
+		return strings.TrimRight(string(fileValue), "\r\n"), nil
+	}
 
-				// Assign the values to vars
-				err := rows.Scan(&tableName, &tableCount)
-				if err != nil {
-					log.Printf("ERROR: Failed to obtain values in database %s for table %s: %s", dbConfig.Name, tableName, err)
-				} else {
-					// Set the count for the table key in the Row map
-					countCollection.Row[tableName] = tableCount
+	// Otherwise, the value is not a secret reference, so return it as-is
+	return value, nil
+}
 
-					log.Printf("INFO: Obtained value in database %s for table %s with count %d", dbConfig.Name, tableName, tableCount)
-				}
+// querySizes runs the size query for a list of tables, and sets the size of each table returned in collection's Sizes
+// Sizes are only used for forecasting, so tables without a size are logged rather than recorded as missing
+func querySizes(db *sql.DB, dbConfig databaseConfig, dialect dialect, dbSchema string, tables []string, collection *countCollection) {
+	collection.Sizes = make(map[string]int64)
 
-				// If there were any errors, output
-				err = rows.Err()
-				if err != nil {
-					log.Printf("ERROR: Row failures for database %s: %s", dbConfig.Name, err)
-				}
-			}
+	query, args, err := buildDialectQuery(dialect, dialect.sizeQuery(db, dbSchema), tables)
+	if err != nil {
+		slog.Error("Failed to assemble size query interface", "database", dbConfig.Name, "error", err)
+		return
+	}
+
+	// Record the query, so it can be printed by --dry-run and its latency published
+	queryStart := time.Now()
+	collection.Queries = append(collection.Queries, executedQuery{Kind: "size", SQL: query, Args: args})
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		slog.Warn("Failed to query table sizes", "database", dbConfig.Name, "duration", time.Since(queryStart), "error", err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		// Go through each row retrieved, skipping any without a size
+		var (
+			tableName string
+			tableSize sql.NullInt64
+		)
+		if err := rows.Scan(&tableName, &tableSize); err != nil || !tableSize.Valid {
+			continue
 		}
+
+		slog.Debug("Obtained size", "database", dbConfig.Name, "table", tableName, "bytes", tableSize.Int64)
+		collection.Sizes[tableName] = tableSize.Int64
 	}
 
-	// Assuming no fatal errors, return nil
-	return countCollection, nil
+	collection.Queries[len(collection.Queries)-1].Duration = time.Since(queryStart)
 }
 
 // getCountCollectionDifference takes two countCollections, subtracts the counts, returns the difference
@@ -455,6 +732,8 @@ func getCountCollectionDifference(minuend countCollection, subtrahend countColle
 	// Initialize both Increment and Row maps
 	difference.Increment = make(map[string]int)
 	difference.Row = make(map[string]int)
+	// The missing tables are those of the current session
+	difference.Missing = minuend.Missing
 
 	for minCountName, minCount := range minuend.Increment {
 		// Go through each count in the minuend Increment
@@ -502,47 +781,3 @@ func loadApplicationConfig(fileName string) (applicationConfig, error) {
 	// Assuming no errors, return the applicationConfig and nil
 	return config, nil
 }
-
-// loadCountCollections loads a map of countCollections from a YAML file
-// It returns a map composed of each database and it's associated countCollection, as well as an error
-func loadCountCollections(fileName string) (map[string]countCollection, error) {
-	var countCollections map[string]countCollection
-
-	// Load the last countCollections YAML file
-	countCollectionsSource, err := ioutil.ReadFile(fileName)
-	if err != nil {
-		return countCollections, err
-	}
-
-	// Map the YAML file to the map of countCollections
-	err = yaml.Unmarshal(countCollectionsSource, &countCollections)
-	if err != nil {
-		return countCollections, err
-	}
-
-	// Assuming no errors, return the countCollections and nil
-	return countCollections, nil
-}
-
-// writeCountCollections writes a map of countCollections to an exported YAML file
-// It returns an error if any issues were encountered
-func writeCountCollections(fileName string, countCollections map[string]countCollection) error {
-	// Take the countCollections and export it into a YAML file
-	countCollectionsYaml, err := yaml.Marshal(&countCollections)
-	if err != nil {
-		return err
-	}
-
-	// Create and open the counts YAML file
-	countCollectionsFile, err := os.Create(fileName)
-	if err != nil {
-		return err
-	}
-	defer countCollectionsFile.Close()
-
-	// Output the generated YAML into the file
-	fmt.Fprintf(countCollectionsFile, string(countCollectionsYaml))
-
-	// Assuming no errors, return nil
-	return nil
-}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultRatePeriod is the period a channel's rate limit applies to when no period is configured
+const defaultRatePeriod = "1h"
+
+// notificationTimeout is how long a channel is given to accept a single event
+const notificationTimeout = 10 * time.Second
+
+// notifier is a channel that alert events are sent to, so that a human finds out about them
+type notifier interface {
+	// name returns the name of the channel, as used in logs
+	name() string
+
+	// notify sends a single alert event to the channel
+	// It returns an error if the event could not be sent
+	notify(event alertEvent) error
+}
+
+// notificationConfig is the configuration of a single notification channel
+// Type is one of "slack", "webhook", "smtp" or "pagerduty", and decides which of the other values are used
+// RateLimit is the most events the channel is sent within each RatePeriod, further events are dropped, or 0 for no limit
+type notificationConfig struct {
+	Name       string
+	Type       string
+	URL        string `yaml:"url"`
+	Headers    map[string]string
+	Template   string
+	Host       string
+	Username   string
+	Password   string
+	From       string
+	To         []string
+	RoutingKey string `yaml:"routingKey"`
+	Severity   string
+	RateLimit  int    `yaml:"rateLimit"`
+	RatePeriod string `yaml:"ratePeriod"`
+}
+
+// notificationChannel is a notifier, along with the rate limit it is sent events under
+type notificationChannel struct {
+	notifier
+	RateLimit  int
+	RatePeriod time.Duration
+}
+
+// notificationState is what is remembered about notifications between runs, in the notification state file
+// Sent is the times events were sent to each channel, within its rate period
+// RunFailing is whether the last run failed, so that the next successful run can resolve it
+type notificationState struct {
+	Sent       map[string][]time.Time `yaml:"sent"`
+	RunFailing bool                   `yaml:"runFailing"`
+}
+
+// notifiers is the registry of every notification channel type, and the function that creates it from its configuration
+var notifiers = map[string]func(config notificationConfig) (notifier, error){
+	"slack":     newSlackNotifier,
+	"webhook":   newWebhookNotifier,
+	"smtp":      newSMTPNotifier,
+	"pagerduty": newPagerDutyNotifier,
+}
+
+// getNotificationChannels takes an applicationConfig and creates every channel alert events should be sent to
+// The log channel is always included, so that alerts are recorded even without any other channel configured
+// It returns the channels, as well as an error for any channel that could not be created, which is left out
+func getNotificationChannels(config applicationConfig) ([]notificationChannel, error) {
+	channels := []notificationChannel{{notifier: logNotifier{}}}
+	var problems []string
+
+	for _, channelConfig := range config.Notifications {
+		channel, err := newNotificationChannel(channelConfig)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("notification channel %q: %s", channelConfig.Name, err))
+			continue
+		}
+
+		channels = append(channels, channel)
+	}
+
+	if len(problems) > 0 {
+		return channels, fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+
+	return channels, nil
+}
+
+// newNotificationChannel takes the configuration of a single channel and creates it
+// It returns the channel, as well as an error if the type is unknown or the configuration is incomplete
+func newNotificationChannel(config notificationConfig) (notificationChannel, error) {
+	newNotifier, ok := notifiers[config.Type]
+	if !ok {
+		return notificationChannel{}, fmt.Errorf("unknown type %q, must be one of slack, webhook, smtp or pagerduty", config.Type)
+	}
+
+	ratePeriod := config.RatePeriod
+	if ratePeriod == "" {
+		ratePeriod = defaultRatePeriod
+	}
+	period, err := parseLongDuration(ratePeriod)
+	if err != nil || period <= 0 {
+		return notificationChannel{}, fmt.Errorf("invalid ratePeriod %q", ratePeriod)
+	}
+
+	notifier, err := newNotifier(config)
+	if err != nil {
+		return notificationChannel{}, err
+	}
+
+	return notificationChannel{notifier: notifier, RateLimit: config.RateLimit, RatePeriod: period}, nil
+}
+
+// sendAlertEvents sends each event to each notification channel, logging any that could not be sent
+// Channels over their rate limit are skipped, with the times events were sent kept in the notification state file
+// Resolved events are always sent, and don't count towards the limit, as the alert has already moved on and would otherwise never be resolved
+// It returns the number of events that could not be sent, counting each channel separately
+func sendAlertEvents(config applicationConfig, events []alertEvent) int {
+	if len(events) == 0 {
+		return 0
+	}
+
+	channels, err := getNotificationChannels(config)
+	if err != nil {
+		slog.Error("Failed to create notification channels", "error", err)
+	}
+
+	statePath := getNotificationStatePath(config.CountPath)
+	state, err := loadNotificationState(statePath)
+	if err != nil {
+		slog.Warn("Failed to load notification state, rate limits start over", "path", statePath, "error", err)
+	}
+
+	failures := 0
+	now := time.Now()
+	for _, event := range events {
+		for _, channel := range channels {
+			if event.Status != alertResolved && !state.allow(channel, now) {
+				slog.Warn("Alert not sent, channel is over its rate limit", "channel", channel.name(), "rule", event.Rule, "status", event.Status, "limit", channel.RateLimit, "period", channel.RatePeriod)
+				continue
+			}
+
+			err := channel.notify(event)
+			if err != nil {
+				failures++
+				slog.Error("Failed to send alert", "channel", channel.name(), "rule", event.Rule, "database", event.Database, "table", event.Table, "status", event.Status, "error", err)
+			}
+		}
+	}
+
+	err = writeNotificationState(statePath, state)
+	if err != nil {
+		slog.Error("Failed to write notification state", "path", statePath, "error", err)
+	}
+
+	return failures
+}
+
+// notifyRunStatus sends an event when a run fails, and another when a run succeeds after a failure
+// failure describes why the run failed, or is empty if it succeeded
+// Only the first failure of a series is sent, so a run failing every few minutes doesn't flood the channels
+// stateLocation is where the runs keep their state, as described by the state store, which the failure is deduplicated by
+func notifyRunStatus(config applicationConfig, stateLocation string, failure string) {
+	state, _ := loadNotificationState(getNotificationStatePath(config.CountPath))
+	if state.RunFailing == (failure != "") {
+		return
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	event := alertEvent{
+		Rule:     "run",
+		DedupKey: getRunDedupKey(config, stateLocation, host),
+		Time:     time.Now(),
+	}
+	if failure != "" {
+		event.Status = alertFiring
+		event.Message = fmt.Sprintf("rowmetrics run on %s failed: %s", host, failure)
+	} else {
+		event.Status = alertResolved
+		event.Message = fmt.Sprintf("rowmetrics runs keeping state in %s are succeeding again", stateLocation)
+	}
+
+	sendAlertEvents(config, []alertEvent{event})
+
+	// Record the change, reloading the state as sending the event updated it
+	statePath := getNotificationStatePath(config.CountPath)
+	state, _ = loadNotificationState(statePath)
+	state.RunFailing = failure != ""
+	err = writeNotificationState(statePath, state)
+	if err != nil {
+		slog.Error("Failed to write notification state", "path", statePath, "error", err)
+	}
+}
+
+// getRunDedupKey returns the dedup key of run failures, which is the same for every run sharing the state, such as "rowmetrics/run/s3://bucket/rowmetrics/counts.yml"
+// A counts YAML file is only shared by runs on the same host, so its key includes the host and the absolute path
+// S3 and DynamoDB state are shared wherever the runs are, such as Lambda, whose host changes between cold starts
+func getRunDedupKey(config applicationConfig, stateLocation string, host string) string {
+	if config.State.Type != "" && config.State.Type != "file" {
+		return "rowmetrics/run/" + stateLocation
+	}
+
+	path, err := filepath.Abs(stateLocation)
+	if err != nil {
+		path = stateLocation
+	}
+
+	return "rowmetrics/run/" + host + ":" + filepath.ToSlash(path)
+}
+
+// allow checks whether a channel may be sent another event, and records it as sent if so
+func (state *notificationState) allow(channel notificationChannel, now time.Time) bool {
+	if channel.RateLimit <= 0 {
+		return true
+	}
+
+	// Forget the events sent before the current period
+	var sent []time.Time
+	for _, sentAt := range state.Sent[channel.name()] {
+		if now.Sub(sentAt) < channel.RatePeriod {
+			sent = append(sent, sentAt)
+		}
+	}
+
+	allowed := len(sent) < channel.RateLimit
+	if allowed {
+		sent = append(sent, now.UTC())
+	}
+	state.Sent[channel.name()] = sent
+
+	return allowed
+}
+
+// getNotificationStatePath returns the path of the notification state file, which is kept next to the counts YAML
+func getNotificationStatePath(countPath string) string {
+	return countPath + ".notifications"
+}
+
+// loadNotificationState loads the notification state file, or an empty state if there isn't one yet
+// It returns the state, as well as an error if the file could not be read, in which case the state is empty
+func loadNotificationState(fileName string) (notificationState, error) {
+	state := notificationState{Sent: make(map[string][]time.Time)}
+
+	stateSource, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+
+	err = yaml.Unmarshal(stateSource, &state)
+	if state.Sent == nil {
+		state.Sent = make(map[string][]time.Time)
+	}
+
+	return state, err
+}
+
+// writeNotificationState writes the notification state file, replacing it atomically
+func writeNotificationState(fileName string, state notificationState) error {
+	stateYaml, err := marshalYAML(&state)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(fileName, stateYaml, false)
+}
+
+// postNotification sends a request body to a URL, as used by the HTTP based channels
+// It returns an error if the request could not be sent, or was not answered with a 2xx status
+func postNotification(url string, contentType string, headers map[string]string, body []byte) error {
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", contentType)
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+
+	client := http.Client{Timeout: notificationTimeout}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		// Include the start of the response, which usually says what was wrong with the request
+		responseBody, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("%s responded with %s: %s", request.URL.Host, response.Status, strings.TrimSpace(string(responseBody)))
+	}
+
+	return nil
+}
+
+// logNotifier sends alert events to the log, as a warning when they fire
+type logNotifier struct{}
+
+func (n logNotifier) name() string {
+	return "log"
+}
+
+func (n logNotifier) notify(event alertEvent) error {
+	level := slog.LevelInfo
+	if event.Status == alertFiring {
+		level = slog.LevelWarn
+	}
+
+	slog.Log(context.Background(), level, "Alert "+event.Status, "rule", event.Rule, "database", event.Database, "table", event.Table, "kind", event.Kind, "value", event.Value, "message", event.Message)
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// defaultPagerDutyURL is the PagerDuty Events API v2 endpoint events are sent to when no URL is configured
+const defaultPagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+
+// pagerDutyNotifier sends alert events to PagerDuty through the Events API v2
+// Firing events trigger an incident and resolved events resolve it, matched up by the event's dedup key
+type pagerDutyNotifier struct {
+	channelName string
+	url         string
+	routingKey  string
+	severity    string
+}
+
+// newPagerDutyNotifier takes the configuration of a channel and creates a pagerDutyNotifier
+// Unless specified, events are sent with the severity "error"
+// The routing key may reference a secret, see resolveSecret
+func newPagerDutyNotifier(config notificationConfig) (notifier, error) {
+	routingKey, err := resolveSecret(config.RoutingKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve routingKey: %s", err)
+	}
+	if routingKey == "" {
+		return nil, fmt.Errorf("pagerduty channels need a routingKey")
+	}
+
+	url := config.URL
+	if url == "" {
+		url = defaultPagerDutyURL
+	}
+
+	severity := config.Severity
+	if severity == "" {
+		severity = "error"
+	}
+	switch severity {
+	case "critical", "error", "warning", "info":
+	default:
+		return nil, fmt.Errorf("invalid severity %q, must be one of critical, error, warning or info", severity)
+	}
+
+	return &pagerDutyNotifier{channelName: config.Name, url: url, routingKey: routingKey, severity: severity}, nil
+}
+
+func (n *pagerDutyNotifier) name() string {
+	return n.channelName
+}
+
+func (n *pagerDutyNotifier) notify(event alertEvent) error {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "rowmetrics"
+	}
+
+	pagerDutyEvent := map[string]interface{}{
+		"routing_key":  n.routingKey,
+		"event_action": "trigger",
+		"dedup_key":    event.DedupKey,
+	}
+	if event.Status == alertResolved {
+		// Resolving only needs the dedup key of the incident
+		pagerDutyEvent["event_action"] = "resolve"
+	} else {
+		pagerDutyEvent["payload"] = map[string]interface{}{
+			"summary":   event.Message,
+			"source":    host,
+			"severity":  n.severity,
+			"timestamp": event.Time.UTC(),
+			"component": event.Database,
+			"group":     event.Table,
+			"class":     event.Rule,
+			"custom_details": map[string]interface{}{
+				"kind":  event.Kind,
+				"value": event.Value,
+			},
+		}
+	}
+
+	body, err := json.Marshal(pagerDutyEvent)
+	if err != nil {
+		return err
+	}
+
+	return postNotification(n.url, "application/json", nil, body)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// slackNotifier sends alert events to a Slack channel through an incoming webhook
+type slackNotifier struct {
+	channelName string
+	url         string
+}
+
+// newSlackNotifier takes the configuration of a channel and creates a slackNotifier
+// The webhook URL may reference a secret, see resolveSecret
+func newSlackNotifier(config notificationConfig) (notifier, error) {
+	url, err := resolveSecret(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve url: %s", err)
+	}
+	if url == "" {
+		return nil, fmt.Errorf("slack channels need a url")
+	}
+
+	return &slackNotifier{channelName: config.Name, url: url}, nil
+}
+
+func (n *slackNotifier) name() string {
+	return n.channelName
+}
+
+// notify posts the event as a message, marked as firing or resolved
+// Slack has no notion of dedup keys, so the key is included in the message to match up firing and resolved messages
+func (n *slackNotifier) notify(event alertEvent) error {
+	icon := ":red_circle:"
+	if event.Status == alertResolved {
+		icon = ":large_green_circle:"
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"text": fmt.Sprintf("%s *[%s]* %s\n`%s`", icon, event.Status, event.Message, event.DedupKey),
+	})
+	if err != nil {
+		return err
+	}
+
+	return postNotification(n.url, "application/json", nil, body)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// smtpNotifier sends alert events as emails through an SMTP server
+type smtpNotifier struct {
+	channelName string
+	host        string
+	auth        smtp.Auth
+	from        string
+	to          []string
+}
+
+// newSMTPNotifier takes the configuration of a channel and creates an smtpNotifier
+// Host is the "host:port" of the server, authenticated against with PLAIN if a username is configured
+// The password may reference a secret, see resolveSecret
+func newSMTPNotifier(config notificationConfig) (notifier, error) {
+	if config.Host == "" || config.From == "" || len(config.To) == 0 {
+		return nil, fmt.Errorf("smtp channels need a host, from and to")
+	}
+
+	hostName, _, err := net.SplitHostPort(config.Host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid host %q, must be host:port", config.Host)
+	}
+
+	var auth smtp.Auth
+	if config.Username != "" {
+		password, err := resolveSecret(config.Password)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve password: %s", err)
+		}
+		auth = smtp.PlainAuth("", config.Username, password, hostName)
+	}
+
+	return &smtpNotifier{channelName: config.Name, host: config.Host, auth: auth, from: config.From, to: config.To}, nil
+}
+
+func (n *smtpNotifier) name() string {
+	return n.channelName
+}
+
+// notify sends the event as a plain text email
+// The dedup key is sent as a header, and the firing and resolved emails of an alert share a subject so that mail clients thread them
+func (n *smtpNotifier) notify(event alertEvent) error {
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", n.from)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(n.to, ", "))
+	fmt.Fprintf(&message, "Subject: [rowmetrics] %s\r\n", getAlertSubject(event))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "X-Rowmetrics-Dedup-Key: %s\r\n", event.DedupKey)
+	fmt.Fprintf(&message, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&message, "Status: %s\r\n\r\n%s\r\n", event.Status, event.Message)
+
+	return smtp.SendMail(n.host, n.auth, n.from, n.to, message.Bytes())
+}
+
+// getAlertSubject returns a short description of the alert an event belongs to, the same for its firing and resolved events
+func getAlertSubject(event alertEvent) string {
+	if event.Table == "" {
+		return event.Rule
+	}
+
+	return fmt.Sprintf("%s: %s in %s", event.Rule, event.Table, event.Database)
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordedRequest is a request received by a notificationServer
+type recordedRequest struct {
+	header http.Header
+	body   string
+}
+
+// notificationServer is an HTTP server that records every request it receives, standing in for Slack, PagerDuty or a webhook
+type notificationServer struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	requests []recordedRequest
+}
+
+// newNotificationServer starts a notificationServer, which is closed when the test ends
+func newNotificationServer(t *testing.T) *notificationServer {
+	server := &notificationServer{}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		server.mutex.Lock()
+		server.requests = append(server.requests, recordedRequest{header: r.Header, body: string(body)})
+		server.mutex.Unlock()
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// received returns the requests received so far
+func (s *notificationServer) received() []recordedRequest {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]recordedRequest{}, s.requests...)
+}
+
+// testAlertEvent returns a firing alert event, as evaluateAlerts would create
+func testAlertEvent() alertEvent {
+	return alertEvent{
+		Rule:     "stalled",
+		Database: "edge",
+		Table:    "Sale",
+		Kind:     "increment",
+		Status:   alertFiring,
+		Value:    0,
+		Message:  "stalled: Sale in database edge has a delta of 0, below 1",
+		DedupKey: "rowmetrics/stalled/edge/increment/Sale",
+		Time:     time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+}
+
+func TestSlackNotifier(t *testing.T) {
+	server := newNotificationServer(t)
+	notifier, err := newSlackNotifier(notificationConfig{Name: "slack", URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := testAlertEvent()
+	if err := notifier.notify(event); err != nil {
+		t.Fatalf("notify returned an error: %s", err)
+	}
+
+	requests := server.received()
+	if len(requests) != 1 {
+		t.Fatalf("received %d requests, expected 1", len(requests))
+	}
+	var message map[string]string
+	if err := json.Unmarshal([]byte(requests[0].body), &message); err != nil {
+		t.Fatalf("body %q isn't JSON: %s", requests[0].body, err)
+	}
+	if !strings.Contains(message["text"], event.Message) || !strings.Contains(message["text"], event.DedupKey) || !strings.Contains(message["text"], "[firing]") {
+		t.Errorf("text is %q, expected the status, message and dedup key", message["text"])
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	server := newNotificationServer(t)
+	t.Setenv("ROWMETRICS_TEST_TOKEN", "secret-token")
+	notifier, err := newWebhookNotifier(notificationConfig{
+		Name:     "hook",
+		URL:      server.URL,
+		Headers:  map[string]string{"Authorization": "env:ROWMETRICS_TEST_TOKEN"},
+		Template: `{"text": {{json .Message}}, "key": {{json .DedupKey}}, "kind": {{json .Kind}}}`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := testAlertEvent()
+	if err := notifier.notify(event); err != nil {
+		t.Fatalf("notify returned an error: %s", err)
+	}
+
+	requests := server.received()
+	if len(requests) != 1 {
+		t.Fatalf("received %d requests, expected 1", len(requests))
+	}
+	if authorization := requests[0].header.Get("Authorization"); authorization != "secret-token" {
+		t.Errorf("Authorization header is %q, expected the resolved secret", authorization)
+	}
+	if contentType := requests[0].header.Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Content-Type header is %q, expected application/json", contentType)
+	}
+	var body map[string]string
+	if err := json.Unmarshal([]byte(requests[0].body), &body); err != nil {
+		t.Fatalf("body %q isn't JSON: %s", requests[0].body, err)
+	}
+	if body["text"] != event.Message || body["key"] != event.DedupKey || body["kind"] != "increment" {
+		t.Errorf("body is %v, expected the templated event", body)
+	}
+}
+
+func TestPagerDutyNotifier(t *testing.T) {
+	server := newNotificationServer(t)
+	notifier, err := newPagerDutyNotifier(notificationConfig{Name: "pagerduty", URL: server.URL, RoutingKey: "routing-key", Severity: "warning"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := testAlertEvent()
+	if err := notifier.notify(event); err != nil {
+		t.Fatalf("notify returned an error: %s", err)
+	}
+	event.Status = alertResolved
+	if err := notifier.notify(event); err != nil {
+		t.Fatalf("notify returned an error: %s", err)
+	}
+
+	requests := server.received()
+	if len(requests) != 2 {
+		t.Fatalf("received %d requests, expected 2", len(requests))
+	}
+
+	var trigger, resolve struct {
+		RoutingKey  string `json:"routing_key"`
+		EventAction string `json:"event_action"`
+		DedupKey    string `json:"dedup_key"`
+		Payload     *struct {
+			Summary  string `json:"summary"`
+			Severity string `json:"severity"`
+			Class    string `json:"class"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal([]byte(requests[0].body), &trigger); err != nil {
+		t.Fatalf("body %q isn't JSON: %s", requests[0].body, err)
+	}
+	if err := json.Unmarshal([]byte(requests[1].body), &resolve); err != nil {
+		t.Fatalf("body %q isn't JSON: %s", requests[1].body, err)
+	}
+
+	if trigger.RoutingKey != "routing-key" || trigger.EventAction != "trigger" || trigger.DedupKey != event.DedupKey {
+		t.Errorf("trigger is %+v, expected the routing key, trigger action and dedup key", trigger)
+	}
+	if trigger.Payload == nil || trigger.Payload.Summary != event.Message || trigger.Payload.Severity != "warning" || trigger.Payload.Class != "stalled" {
+		t.Errorf("trigger payload is %+v, expected the message, severity and rule", trigger.Payload)
+	}
+	if resolve.EventAction != "resolve" || resolve.DedupKey != event.DedupKey || resolve.Payload != nil {
+		t.Errorf("resolve is %+v, expected only the resolve action and the same dedup key", resolve)
+	}
+}
+
+// serveSMTP accepts a single SMTP session on listener, as a server that only accepts mail, and sends each message it receives on messages
+func serveSMTP(listener net.Listener, messages chan<- string) {
+	connection, err := listener.Accept()
+	if err != nil {
+		close(messages)
+		return
+	}
+	defer connection.Close()
+
+	reader := bufio.NewReader(connection)
+	reply := func(line string) {
+		connection.Write([]byte(line + "\r\n"))
+	}
+
+	reply("220 localhost ESMTP")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			close(messages)
+			return
+		}
+
+		command := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(command, "DATA"):
+			reply("354 end data with <CR><LF>.<CR><LF>")
+			var message strings.Builder
+			for {
+				dataLine, err := reader.ReadString('\n')
+				if err != nil || dataLine == ".\r\n" {
+					break
+				}
+				message.WriteString(dataLine)
+			}
+			messages <- message.String()
+			reply("250 queued")
+		case strings.HasPrefix(command, "QUIT"):
+			reply("221 bye")
+			close(messages)
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	messages := make(chan string, 1)
+	go serveSMTP(listener, messages)
+
+	notifier, err := newSMTPNotifier(notificationConfig{Name: "email", Host: listener.Addr().String(), From: "rowmetrics@example.com", To: []string{"oncall@example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := testAlertEvent()
+	if err := notifier.notify(event); err != nil {
+		t.Fatalf("notify returned an error: %s", err)
+	}
+
+	message := <-messages
+	for _, expected := range []string{
+		"To: oncall@example.com\r\n",
+		"Subject: [rowmetrics] stalled: Sale in edge\r\n",
+		"X-Rowmetrics-Dedup-Key: rowmetrics/stalled/edge/increment/Sale\r\n",
+		"Status: firing\r\n\r\n" + event.Message,
+	} {
+		if !strings.Contains(message, expected) {
+			t.Errorf("message %q doesn't contain %q", message, expected)
+		}
+	}
+}
+
+func TestSendAlertEventsRateLimit(t *testing.T) {
+	server := newNotificationServer(t)
+	config := applicationConfig{
+		CountPath:     filepath.Join(t.TempDir(), "counts.yml"),
+		Notifications: []notificationConfig{{Name: "hook", Type: "webhook", URL: server.URL, RateLimit: 2}},
+	}
+
+	events := []alertEvent{testAlertEvent(), testAlertEvent(), testAlertEvent()}
+	if failures := sendAlertEvents(config, events); failures != 0 {
+		t.Fatalf("sendAlertEvents had %d failures, expected none", failures)
+	}
+	if received := len(server.received()); received != 2 {
+		t.Errorf("received %d requests, expected the rate limit of 2", received)
+	}
+
+	// The events already sent are remembered in the notification state, so the next run is still limited
+	if failures := sendAlertEvents(config, events[:1]); failures != 0 {
+		t.Fatalf("sendAlertEvents had %d failures, expected none", failures)
+	}
+	if received := len(server.received()); received != 2 {
+		t.Errorf("received %d requests, expected none more within the rate period", received)
+	}
+
+	state, err := loadNotificationState(getNotificationStatePath(config.CountPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Sent["hook"]) != 2 {
+		t.Errorf("notification state has %v sent, expected 2", state.Sent["hook"])
+	}
+}
+
+func TestSendAlertEventsRateLimitResolved(t *testing.T) {
+	server := newNotificationServer(t)
+	config := applicationConfig{
+		CountPath:     filepath.Join(t.TempDir(), "counts.yml"),
+		Notifications: []notificationConfig{{Name: "hook", Type: "webhook", URL: server.URL, RateLimit: 1}},
+	}
+
+	firing := testAlertEvent()
+	resolved := testAlertEvent()
+	resolved.Status = alertResolved
+
+	// The resolved event is sent though the channel is already at its limit, and doesn't count towards it
+	if failures := sendAlertEvents(config, []alertEvent{firing, resolved, resolved}); failures != 0 {
+		t.Fatalf("sendAlertEvents had %d failures, expected none", failures)
+	}
+	if received := len(server.received()); received != 3 {
+		t.Errorf("received %d requests, expected the firing event and both resolved events", received)
+	}
+
+	state, err := loadNotificationState(getNotificationStatePath(config.CountPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Sent["hook"]) != 1 {
+		t.Errorf("notification state has %v sent, expected only the firing event", state.Sent["hook"])
+	}
+}
+
+func TestNotifyRunStatusDedupKey(t *testing.T) {
+	server := newNotificationServer(t)
+	config := applicationConfig{
+		CountPath:     filepath.Join(t.TempDir(), "counts.yml"),
+		State:         stateConfig{Type: "s3", Bucket: "rowmetrics-state"},
+		Notifications: []notificationConfig{{Name: "hook", Type: "webhook", URL: server.URL, Template: `{"key": {{json .DedupKey}}, "status": {{json .Status}}}`}},
+	}
+
+	notifyRunStatus(config, "s3://rowmetrics-state/rowmetrics/counts.yml", "failed to get counts")
+	// A repeated failure isn't sent again
+	notifyRunStatus(config, "s3://rowmetrics-state/rowmetrics/counts.yml", "failed to get counts")
+	notifyRunStatus(config, "s3://rowmetrics-state/rowmetrics/counts.yml", "")
+
+	requests := server.received()
+	if len(requests) != 2 {
+		t.Fatalf("received %d requests, expected the failure and its resolution", len(requests))
+	}
+	for i, expectedStatus := range []string{"firing", "resolved"} {
+		var body map[string]string
+		if err := json.Unmarshal([]byte(requests[i].body), &body); err != nil {
+			t.Fatalf("body %q isn't JSON: %s", requests[i].body, err)
+		}
+		if body["key"] != "rowmetrics/run/s3://rowmetrics-state/rowmetrics/counts.yml" || body["status"] != expectedStatus {
+			t.Errorf("event is %v, expected the state location as the dedup key of the %s event", body, expectedStatus)
+		}
+	}
+
+	// A counts YAML file is only shared on the same host
+	fileConfig := applicationConfig{CountPath: config.CountPath}
+	if key := getRunDedupKey(fileConfig, config.CountPath, "db-tools-1"); key != "rowmetrics/run/db-tools-1:"+filepath.ToSlash(config.CountPath) {
+		t.Errorf("dedup key of file state is %q, expected the host and path", key)
+	}
+}
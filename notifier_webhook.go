@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"text/template"
+)
+
+// defaultWebhookTemplate is the body sent to a webhook when no template is configured, the event as JSON
+const defaultWebhookTemplate = `{"status":{{json .Status}},"rule":{{json .Rule}},"database":{{json .Database}},"table":{{json .Table}},"kind":{{json .Kind}},"value":{{json .Value}},"message":{{json .Message}},"dedupKey":{{json .DedupKey}},"time":{{json .Time}}}`
+
+// webhookNotifier sends alert events to any HTTP endpoint, with a body generated from a template
+type webhookNotifier struct {
+	channelName string
+	url         string
+	headers     map[string]string
+	template    *template.Template
+}
+
+// newWebhookNotifier takes the configuration of a channel and creates a webhookNotifier
+// The template is a text/template executed with the alertEvent, with a json function to quote values
+// The URL and header values may reference secrets, see resolveSecret
+func newWebhookNotifier(config notificationConfig) (notifier, error) {
+	url, err := resolveSecret(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve url: %s", err)
+	}
+	if url == "" {
+		return nil, fmt.Errorf("webhook channels need a url")
+	}
+
+	headers := make(map[string]string)
+	for name, value := range config.Headers {
+		headers[name], err = resolveSecret(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve header %s: %s", name, err)
+		}
+	}
+	if headers["Content-Type"] == "" {
+		headers["Content-Type"] = "application/json"
+	}
+
+	body := config.Template
+	if body == "" {
+		body = defaultWebhookTemplate
+	}
+	bodyTemplate, err := template.New(config.Name).Funcs(template.FuncMap{"json": toJSON}).Parse(body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %s", err)
+	}
+
+	return &webhookNotifier{channelName: config.Name, url: url, headers: headers, template: bodyTemplate}, nil
+}
+
+func (n *webhookNotifier) name() string {
+	return n.channelName
+}
+
+func (n *webhookNotifier) notify(event alertEvent) error {
+	var body bytes.Buffer
+	err := n.template.Execute(&body, event)
+	if err != nil {
+		return err
+	}
+
+	return postNotification(n.url, n.headers["Content-Type"], n.headers, body.Bytes())
+}
+
+// toJSON encodes a value as JSON, for use in templates
+func toJSON(value interface{}) (string, error) {
+	encoded, err := json.Marshal(value)
+	return string(encoded), err
+}
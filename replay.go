@@ -0,0 +1,287 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// snapshot is the counts of every database collected by a single run
+type snapshot struct {
+	CollectedAt      time.Time
+	CountCollections map[string]countCollection
+}
+
+// runReplayCommand runs the replay subcommand, republishing the differences between past snapshots with their original timestamps
+// It returns the exit code, 0 if every difference was published
+func runReplayCommand(args []string) int {
+	var (
+		configPath string
+		from       string
+		to         string
+		sinkNames  string
+		directory  string
+		dryRun     bool
+	)
+
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	flags.StringVar(&configPath, "config", "config.yml", "path to the application config YAML file")
+	flags.StringVar(&from, "from", "", "replay snapshots collected since this duration ago, such as 7d, or since an RFC 3339 timestamp")
+	flags.StringVar(&to, "to", "", "replay snapshots collected until this duration ago, or until an RFC 3339 timestamp, defaults to now")
+	flags.StringVar(&sinkNames, "sink", "", "comma separated names of the sinks to publish to, defaults to every sink")
+	flags.StringVar(&directory, "dir", "", "read snapshots from a directory of archived counts YAML files, instead of the history file")
+	flags.BoolVar(&dryRun, "dry-run", false, "print the metrics that would be published without publishing them")
+	flags.Parse(args)
+
+	runID := newRunID()
+	logger, _ := newLogger(os.Stderr, "info", "text", runID)
+	slog.SetDefault(logger)
+
+	if from == "" {
+		fmt.Fprintln(os.Stderr, "rowmetrics: -from is required")
+		return 2
+	}
+
+	now := time.Now()
+	fromTime, err := parseSince(from, now)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rowmetrics: invalid -from: %s\n", err)
+		return 2
+	}
+	toTime := now
+	if to != "" {
+		toTime, err = parseSince(to, now)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "rowmetrics: invalid -to: %s\n", err)
+			return 2
+		}
+	}
+
+	config, err := loadApplicationConfig(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rowmetrics: failed to load application config YAML: %s\n", err)
+		return 1
+	}
+
+	sinks, err := getSinks(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rowmetrics: %s\n", err)
+		return 1
+	}
+	sinks, err = getSinksByName(sinks, sinkNames)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rowmetrics: %s\n", err)
+		return 2
+	}
+	sinks, err = getBackfillSinks(sinks, sinkNames != "")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rowmetrics: %s\n", err)
+		return 2
+	}
+
+	// Load every snapshot up to the end of the range, including those before it starts, which the first differences are taken from
+	var snapshots []snapshot
+	if directory != "" {
+		snapshots, err = loadStateSnapshots(directory)
+	} else if config.History.Path != "" {
+		snapshots, err = loadHistorySnapshots(config.History.Path)
+	} else {
+		err = fmt.Errorf("%s has no history.path configured, use -dir to replay archived counts YAML files instead", configPath)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rowmetrics: %s\n", err)
+		return 1
+	}
+
+	published, failures := replaySnapshots(snapshots, sinks, fromTime, toTime, now, runID, dryRun)
+	if !dryRun {
+		slog.Info("Replayed snapshots", "snapshots", published, "from", fromTime, "to", toTime, "failures", failures)
+	}
+
+	if failures > 0 {
+		return 1
+	}
+	return 0
+}
+
+// replaySnapshots publishes the differences between each pair of consecutive snapshots that ends within a range to each sink, stamped with the time they were collected
+// Pairs too old for a sink are skipped for that sink, see sink.maxBackfillAge, and if dryRun is set, the metrics are printed instead of published
+// It returns the number of pairs at least one sink published, and the number of times a sink failed to publish a pair
+func replaySnapshots(snapshots []snapshot, sinks []sink, fromTime time.Time, toTime time.Time, now time.Time, runID string, dryRun bool) (int, int) {
+	failures, published := 0, 0
+	// Snapshots too old for a sink to accept are skipped, counted by sink name
+	tooOld := make(map[string]int)
+	for i := 1; i < len(snapshots); i++ {
+		// Go through each pair of consecutive snapshots that ends within the range
+		last, cur := snapshots[i-1], snapshots[i]
+		if cur.CollectedAt.Before(fromTime) || cur.CollectedAt.After(toTime) {
+			continue
+		}
+
+		// Recompute the differences, only for databases counted in both snapshots, as a normal run would
+		diffCountCollections := make(map[string]countCollection)
+		for countCollectionName, curCountCollection := range cur.CountCollections {
+			if lastCountCollection, ok := last.CountCollections[countCollectionName]; ok {
+				diffCountCollections[countCollectionName] = getCountCollectionDifference(curCountCollection, lastCountCollection)
+			}
+		}
+
+		publishedBy := 0
+		for _, sink := range sinks {
+			// Publish the differences to each sink, stamped with the time they were collected
+			if now.Sub(cur.CollectedAt) > sink.maxBackfillAge() {
+				tooOld[sink.name()]++
+				continue
+			}
+
+			report := runReport{
+				RunID:       runID,
+				CollectedAt: cur.CollectedAt,
+				Interval:    cur.CollectedAt.Sub(last.CollectedAt),
+				Current:     cur.CountCollections,
+				Differences: diffCountCollections,
+			}
+			datums := sink.metrics(report)
+			for j := range datums {
+				datums[j].Timestamp = cur.CollectedAt
+			}
+
+			if dryRun {
+				fmt.Printf("Metrics that would be published to %s:\n", sink.name())
+				for _, datum := range datums {
+					fmt.Printf("  %s\n", datum)
+				}
+				fmt.Println()
+				continue
+			}
+
+			err := publishReport(sink, report, datums)
+			if err != nil {
+				failures++
+				slog.Error("Failed to replay metrics", "sink", sink.name(), "collected_at", cur.CollectedAt, "error", err)
+				continue
+			}
+			publishedBy++
+		}
+		if publishedBy > 0 {
+			published++
+		}
+	}
+
+	for _, sink := range sinks {
+		if tooOld[sink.name()] > 0 {
+			slog.Warn("Skipped snapshots older than the sink accepts", "sink", sink.name(), "snapshots", tooOld[sink.name()], "max_age", sink.maxBackfillAge())
+		}
+	}
+
+	return published, failures
+}
+
+// getBackfillSinks removes the sinks that can't publish datums as of a time in the past, such as statsd, see sink.maxBackfillAge
+// Replaying to them would publish every difference in the range as if it had just been collected
+// It returns the sinks that can be backfilled, as well as an error if there are none, or if named is true and any can't, as they were asked for by name
+func getBackfillSinks(sinks []sink, named bool) ([]sink, error) {
+	var backfillSinks []sink
+
+	for _, sink := range sinks {
+		if sink.maxBackfillAge() != noBackfill {
+			backfillSinks = append(backfillSinks, sink)
+			continue
+		}
+
+		if named {
+			return nil, fmt.Errorf("sink %s can't be replayed to, as it publishes every metric as of now", sink.name())
+		}
+		slog.Warn("Not replaying to a sink that publishes every metric as of now", "sink", sink.name())
+	}
+
+	if len(backfillSinks) == 0 {
+		return nil, fmt.Errorf("none of the configured sinks can be replayed to, as they publish every metric as of now")
+	}
+
+	return backfillSinks, nil
+}
+
+// loadHistorySnapshots reads every record in the history file and groups them back into snapshots, one per run
+// It returns the snapshots in the order they were collected, as well as an error if the file could not be read
+func loadHistorySnapshots(fileName string) ([]snapshot, error) {
+	records, err := readHistory(fileName, func(historyRecord) bool { return true })
+	if err != nil {
+		return nil, err
+	}
+
+	snapshotsByTime := make(map[time.Time]snapshot)
+	for _, record := range records {
+		// Every record of a run shares the time it was collected at
+		collectedAt := record.Time.UTC()
+		snapshot, ok := snapshotsByTime[collectedAt]
+		if !ok {
+			snapshot.CollectedAt = collectedAt
+			snapshot.CountCollections = make(map[string]countCollection)
+		}
+
+		countCollection, ok := snapshot.CountCollections[record.Database]
+		if !ok {
+			countCollection.Increment = make(map[string]int)
+			countCollection.Row = make(map[string]int)
+		}
+		if record.Kind == "row" {
+			countCollection.Row[record.Table] = record.Value
+		} else {
+			countCollection.Increment[record.Table] = record.Value
+		}
+
+		snapshot.CountCollections[record.Database] = countCollection
+		snapshotsByTime[collectedAt] = snapshot
+	}
+
+	return getSortedSnapshots(snapshotsByTime), nil
+}
+
+// loadStateSnapshots reads every counts YAML file in a directory as a snapshot, such as copies archived after each run
+// Files that aren't counts YAML files, such as lock files, are skipped, as is any backup identical in time to another file
+// It returns the snapshots in the order they were collected, as well as an error if the directory could not be read
+func loadStateSnapshots(directory string) ([]snapshot, error) {
+	files, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshotsByTime := make(map[time.Time]snapshot)
+	for _, file := range files {
+		if file.IsDir() || strings.HasSuffix(file.Name(), ".lock") {
+			continue
+		}
+
+		fileName := filepath.Join(directory, file.Name())
+		state, err := readCountState(fileName)
+		if err != nil {
+			slog.Warn("Skipping file that isn't a usable counts YAML", "path", fileName, "error", err)
+			continue
+		}
+
+		collectedAt := state.CollectedAt.UTC()
+		snapshotsByTime[collectedAt] = snapshot{CollectedAt: collectedAt, CountCollections: state.getCountCollections()}
+	}
+
+	return getSortedSnapshots(snapshotsByTime), nil
+}
+
+// getSortedSnapshots returns the snapshots in a map, sorted by the time they were collected
+func getSortedSnapshots(snapshotsByTime map[time.Time]snapshot) []snapshot {
+	var snapshots []snapshot
+	for _, snapshot := range snapshotsByTime {
+		snapshots = append(snapshots, snapshot)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].CollectedAt.Before(snapshots[j].CollectedAt)
+	})
+
+	return snapshots
+}
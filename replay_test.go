@@ -0,0 +1,99 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// limitedSink is a recordingSink that only accepts datums up to a maximum age, as CloudWatch or Azure Monitor do
+type limitedSink struct {
+	*recordingSink
+	maxAge time.Duration
+}
+
+func (s limitedSink) name() string {
+	return "limited"
+}
+
+func (s limitedSink) maxBackfillAge() time.Duration {
+	return s.maxAge
+}
+
+// writeTestHistory appends a run to a history file for each of the values of Sale, an hour apart and ending an hour ago
+// It returns the snapshots loaded back from the file
+func writeTestHistory(t *testing.T, now time.Time, values ...int) []snapshot {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	for i, value := range values {
+		collectedAt := now.Add(-time.Duration(len(values)-i) * time.Hour)
+		cur := map[string]countCollection{"shop": {Increment: map[string]int{"Sale": value}, Row: map[string]int{}}}
+		if err := appendHistory(historyConfig{Path: path}, getHistoryRecords(collectedAt, cur, nil, 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snapshots, err := loadHistorySnapshots(path)
+	if err != nil {
+		t.Fatalf("loadHistorySnapshots returned an error: %s", err)
+	}
+	if len(snapshots) != len(values) {
+		t.Fatalf("loaded %d snapshots, expected %d", len(snapshots), len(values))
+	}
+
+	return snapshots
+}
+
+func TestReplaySnapshots(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	snapshots := writeTestHistory(t, now, 100, 130, 190)
+
+	// limited only accepts the last pair, collected an hour ago
+	recorder := &recordingSink{}
+	limited := limitedSink{recordingSink: &recordingSink{}, maxAge: 90 * time.Minute}
+
+	published, failures := replaySnapshots(snapshots, []sink{recorder, limited}, now.Add(-24*time.Hour), now, now, "replay", false)
+	if published != 2 || failures != 0 {
+		t.Errorf("replayed %d pairs with %d failures, expected both pairs", published, failures)
+	}
+
+	if len(recorder.reports) != 2 || len(recorder.published) != 2 {
+		t.Fatalf("recorder was given %d reports and %d publishes, expected both pairs", len(recorder.reports), len(recorder.published))
+	}
+	for i, expected := range []int{30, 60} {
+		report := recorder.reports[i]
+		if delta := report.Differences["shop"].Increment["Sale"]; delta != expected || report.Interval != time.Hour || report.RunID != "replay" {
+			t.Errorf("report %d is %+v, expected a delta of %d over an hour", i, report, expected)
+		}
+	}
+	if len(limited.published) != 1 || !limited.reports[0].CollectedAt.Equal(now.Add(-time.Hour)) {
+		t.Errorf("limited was given %+v, expected only the pair collected an hour ago", limited.reports)
+	}
+}
+
+func TestReplaySnapshotsNothingPublished(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	snapshots := writeTestHistory(t, now, 100, 130, 190)
+
+	// Every pair is older than the sink accepts
+	limited := limitedSink{recordingSink: &recordingSink{}, maxAge: 30 * time.Minute}
+	if published, _ := replaySnapshots(snapshots, []sink{limited}, now.Add(-24*time.Hour), now, now, "replay", false); published != 0 {
+		t.Errorf("replayed %d pairs, expected none as every pair is too old", published)
+	}
+
+	// A dry run prints what would be published, without publishing it
+	recorder := &recordingSink{}
+	if published, _ := replaySnapshots(snapshots, []sink{recorder}, now.Add(-24*time.Hour), now, now, "replay", true); published != 0 {
+		t.Errorf("replayed %d pairs, expected none in a dry run", published)
+	}
+	if len(recorder.reports) != 2 || len(recorder.published) != 0 {
+		t.Errorf("recorder was given %d reports and %d publishes, expected only the reports", len(recorder.reports), len(recorder.published))
+	}
+
+	// Only pairs ending within the range are replayed
+	recorder = &recordingSink{}
+	if published, _ := replaySnapshots(snapshots, []sink{recorder}, now.Add(-90*time.Minute), now, now, "replay", false); published != 1 {
+		t.Errorf("replayed %d pairs, expected only the last pair", published)
+	}
+}
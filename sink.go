@@ -0,0 +1,429 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaults for the retry configuration of sinks
+const (
+	defaultRetryAttempts = 3
+	defaultRetryBackoff  = "1s"
+)
+
+// metricDatum is a single metric value, as it would be published to a sink
+// Dimensions are the name and value pairs the metric is broken down by, such as the database
+// Timestamp is when the value was collected, or zero if it is being published as it is collected
+// Type is how the value accumulates, one of metricGauge, metricDelta or metricCumulative, for sinks that distinguish them
+// Interval is the time a delta accumulated over, ending at Timestamp, or 0 if it is unknown
+type metricDatum struct {
+	Name       string
+	Dimensions []metricDimension
+	Value      float64
+	Unit       string
+	Timestamp  time.Time
+	Type       string
+	Interval   time.Duration
+}
+
+// metric types, see metricDatum
+// An empty Type is a gauge, so run metrics and the like don't need to set it
+const (
+	// metricGauge is a value at a point in time, such as a row count
+	metricGauge = ""
+	// metricDelta is the change in a value since the last run, such as a table's difference
+	metricDelta = "delta"
+	// metricCumulative is a total that only ever increases, such as an auto increment value
+	metricCumulative = "cumulative"
+)
+
+// runReport is everything collected by a run that sinks convert into metrics
+// Differences is nil, or lacks a database, if there was no previous run to compare with
+// Interval is the time since the previous run, or 0 if there was none
+// RunID is the ID the run's log lines are tagged with, or that of the replay which is publishing it
+type runReport struct {
+	RunID       string
+	CollectedAt time.Time
+	Interval    time.Duration
+	Current     map[string]countCollection
+	Differences map[string]countCollection
+}
+
+// metricDimension is a single name and value pair a metricDatum is broken down by
+type metricDimension struct {
+	Name  string
+	Value string
+}
+
+// sink is a destination that RowMetrics are published to
+type sink interface {
+	// name returns the name of the sink, as used in logs
+	name() string
+
+	// metrics converts what a run collected, such as the differences between two sessions' counts, into the datums the sink publishes
+	metrics(report runReport) []metricDatum
+
+	// publish sends datums to the sink
+	// It returns an error if any of the datums could not be published
+	publish(datums []metricDatum) error
+
+	// maxBackfillAge returns how far in the past the timestamp of a datum may be, for the sink to publish it as of that time
+	// It is noBackfill for sinks without timestamps, and unlimitedBackfill for those that accept any
+	maxBackfillAge() time.Duration
+}
+
+// reportSink is a sink that publishes what a run collected as it is, rather than as the datums it converts it into, such as the webhook sink
+// Its metrics are still what --dry-run prints
+type reportSink interface {
+	sink
+
+	// publishReport sends the differences and counts collected by a run to the sink
+	// It returns an error if they could not be published
+	publishReport(report runReport) error
+
+	// publishRunMetrics sends the operational metrics of the run the report is from to the sink
+	// It returns an error if any of the datums could not be published
+	publishRunMetrics(report runReport, datums []metricDatum) error
+}
+
+// limits of how far in the past a sink accepts datums, see sink.maxBackfillAge
+const (
+	// noBackfill is for sinks that publish every datum as of now, such as statsd, so can't be backfilled
+	noBackfill time.Duration = 0
+	// unlimitedBackfill is for sinks that accept datums from any time, such as InfluxDB
+	unlimitedBackfill time.Duration = math.MaxInt64
+)
+
+// retryConfig is the configuration of how a sink retries a failed publish
+// Attempts is the most times a publish is tried, including the first, defaulting to defaultRetryAttempts
+// Backoff is the wait before the first retry, doubling before each one after, defaulting to defaultRetryBackoff
+type retryConfig struct {
+	Attempts int
+	Backoff  string
+}
+
+// permanentError is an error that retrying won't fix, such as a rejected request, so it is returned without retrying
+type permanentError struct {
+	error
+}
+
+// getSinks takes an applicationConfig and creates every sink metrics should be published to
+// CloudWatch is always published to unless aws.enabled is false, as it was before there were other sinks
+// It returns the sinks, as well as an error if any configured sink is invalid
+func getSinks(config applicationConfig) ([]sink, error) {
+	var sinks []sink
+
+	if config.Statsd != nil {
+		statsdSink, err := newStatsdSink(*config.Statsd)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, statsdSink)
+	}
+
+	if config.Influx != nil {
+		influxSink, err := newInfluxSink(*config.Influx)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, influxSink)
+	}
+
+	if config.Graphite != nil {
+		graphiteSink, err := newGraphiteSink(*config.Graphite)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, graphiteSink)
+	}
+
+	if config.OTLP != nil {
+		otlpSink, err := newOTLPSink(*config.OTLP)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, otlpSink)
+	}
+
+	if config.Textfile != nil {
+		textfileSink, err := newTextfileSink(*config.Textfile)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, textfileSink)
+	}
+
+	if config.EMF != nil {
+		emfSink, err := newEMFSink(*config.EMF, config.AwsConfig)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, emfSink)
+	}
+
+	if config.GCP != nil {
+		gcpSink, err := newGCPSink(*config.GCP)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, gcpSink)
+	}
+
+	if config.Azure != nil {
+		azureSink, err := newAzureSink(*config.Azure)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, azureSink)
+	}
+
+	if config.Webhook != nil {
+		webhookSink, err := newWebhookSink(*config.Webhook)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, webhookSink)
+	}
+
+	// CloudWatch was the only sink before the others were added, so it stays on alongside them unless it is disabled
+	cloudWatchEnabled, err := isCloudWatchEnabled(config.AwsConfig)
+	if err != nil {
+		return nil, err
+	}
+	if cloudWatchEnabled {
+		sinks = append([]sink{newCloudWatchSink(config.AwsConfig)}, sinks...)
+	}
+
+	return sinks, nil
+}
+
+// publishReport publishes what a run collected to a sink, as the datums the sink converted the report into, or as the report itself to a reportSink
+// It returns an error if the sink failed to publish it
+func publishReport(sink sink, report runReport, datums []metricDatum) error {
+	if reportSink, ok := sink.(reportSink); ok {
+		return reportSink.publishReport(report)
+	}
+
+	return sink.publish(datums)
+}
+
+// publishRunMetrics publishes the operational metrics of the run a report is from to a sink
+// It returns an error if the sink failed to publish any of them
+func publishRunMetrics(sink sink, report runReport, datums []metricDatum) error {
+	if reportSink, ok := sink.(reportSink); ok {
+		return reportSink.publishRunMetrics(report, datums)
+	}
+
+	return sink.publish(datums)
+}
+
+// publishWithRetry calls publish until it succeeds, it returns a permanentError, or the configured attempts run out
+// The wait between attempts starts at the configured backoff and doubles after each one
+// It returns the last error, or nil if publish succeeded
+func publishWithRetry(config retryConfig, sinkName string, publish func() error) error {
+	attempts, backoff, err := getRetryParameters(config)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = publish()
+		if err == nil {
+			return nil
+		}
+		if permanent, ok := err.(permanentError); ok {
+			return permanent.error
+		}
+		if attempt >= attempts {
+			return err
+		}
+
+		slog.Warn("Failed to publish metrics, retrying", "sink", sinkName, "attempt", attempt, "attempts", attempts, "backoff", backoff, "error", err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// getRetryParameters parses a retryConfig, filling in the defaults
+// It returns the number of attempts and the first backoff, as well as an error if either is invalid
+func getRetryParameters(config retryConfig) (int, time.Duration, error) {
+	attempts := config.Attempts
+	if attempts < 0 {
+		return 0, 0, fmt.Errorf("invalid retry attempts %d, must be positive", attempts)
+	}
+	if attempts == 0 {
+		attempts = defaultRetryAttempts
+	}
+
+	backoff := config.Backoff
+	if backoff == "" {
+		backoff = defaultRetryBackoff
+	}
+	duration, err := time.ParseDuration(backoff)
+	if err != nil || duration < 0 {
+		return 0, 0, fmt.Errorf("invalid retry backoff %q", backoff)
+	}
+
+	return attempts, duration, nil
+}
+
+// sendDatagrams sends lines over a datagram connection, joined by newlines into as few packets as fit within mtu bytes
+// A line longer than mtu on its own is still sent, in a packet of its own
+// It returns the number of packets sent, and how many of those failed
+func sendDatagrams(conn net.Conn, lines []string, mtu int) (int, int) {
+	var (
+		packet   []byte
+		packets  int
+		failures int
+	)
+	send := func() {
+		// Send the packet built up so far, if any, and start a new one
+		if len(packet) == 0 {
+			return
+		}
+		if _, err := conn.Write(packet); err != nil {
+			failures++
+			slog.Error("Failed to send packet", "address", conn.RemoteAddr().String(), "bytes", len(packet), "error", err)
+		}
+		packets++
+		packet = packet[:0]
+	}
+
+	for _, line := range lines {
+		// Start a new packet if this line would take the current one over the MTU
+		if len(packet) > 0 && len(packet)+1+len(line) > mtu {
+			send()
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	send()
+
+	return packets, failures
+}
+
+// String formats a metricDatum as "name{dimension=value,...} value unit", as printed by --dry-run
+// Datums with a timestamp have it appended, as "@ 2006-01-02T15:04:05Z"
+func (datum metricDatum) String() string {
+	var dimensions []string
+	for _, dimension := range datum.Dimensions {
+		dimensions = append(dimensions, dimension.Name+"="+dimension.Value)
+	}
+
+	formatted := fmt.Sprintf("%s{%s} %g %s", datum.Name, strings.Join(dimensions, ","), datum.Value, datum.Unit)
+	if !datum.Timestamp.IsZero() {
+		formatted += " @ " + datum.Timestamp.UTC().Format(time.RFC3339)
+	}
+
+	return formatted
+}
+
+// getSinksByName takes a comma separated list of sink names, and selects those sinks from a list
+// An empty list selects every sink
+// It returns the selected sinks, as well as an error if a name doesn't match any sink
+func getSinksByName(sinks []sink, names string) ([]sink, error) {
+	if names == "" {
+		return sinks, nil
+	}
+
+	var selected []sink
+	for _, name := range strings.Split(names, ",") {
+		found := false
+		for _, sink := range sinks {
+			if sink.name() == strings.TrimSpace(name) {
+				selected = append(selected, sink)
+				found = true
+			}
+		}
+
+		if !found {
+			var sinkNames []string
+			for _, sink := range sinks {
+				sinkNames = append(sinkNames, sink.name())
+			}
+			return nil, fmt.Errorf("unknown sink %q, must be one of %s", name, strings.Join(sinkNames, ", "))
+		}
+	}
+
+	return selected, nil
+}
+
+// getSortedKeys returns the keys of a map, such as the names of its countCollections or counts, sorted so that output is stable between runs
+func getSortedKeys[V any](values map[string]V) []string {
+	var keys []string
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// tableDelta is a single table's difference since the last run, along with what was collected about it this run
+// Count and Size are only set if HasCount and HasSize are, as a table's size isn't always collected
+type tableDelta struct {
+	Database string
+	Dialect  string
+	Kind     string
+	Table    string
+	Delta    int
+	Count    int
+	HasCount bool
+	Size     int64
+	HasSize  bool
+}
+
+// getTableDeltas flattens the differences of every database in a runReport into a tableDelta for each table
+// They are in a stable order: by database, then increment tables before row tables, then by table
+func getTableDeltas(report runReport) []tableDelta {
+	var deltas []tableDelta
+
+	for _, countCollectionName := range getSortedKeys(report.Differences) {
+		// Go through each countCollection, and each of its counts in a stable order
+		diffCountCollection := report.Differences[countCollectionName]
+		curCountCollection := report.Current[countCollectionName]
+
+		for _, kind := range []string{"increment", "row"} {
+			diffs, counts := diffCountCollection.Increment, curCountCollection.Increment
+			if kind == "row" {
+				diffs, counts = diffCountCollection.Row, curCountCollection.Row
+			}
+
+			for _, table := range getSortedKeys(diffs) {
+				delta := tableDelta{Database: countCollectionName, Dialect: curCountCollection.Dialect, Kind: kind, Table: table, Delta: diffs[table]}
+				delta.Count, delta.HasCount = counts[table]
+				delta.Size, delta.HasSize = curCountCollection.Sizes[table]
+				deltas = append(deltas, delta)
+			}
+		}
+	}
+
+	return deltas
+}
+
+// dimensions returns the database, kind and table of a tableDelta, which most sinks break table metrics down by
+func (delta tableDelta) dimensions() []metricDimension {
+	return []metricDimension{
+		{Name: "database", Value: delta.Database},
+		{Name: "kind", Value: delta.Kind},
+		{Name: "table", Value: delta.Table},
+	}
+}
+
+// getTableDeltaDatums converts each table's difference in a runReport into a TableDelta datum, with the database, kind and table as dimensions
+// Each datum is stamped with the time it was collected, and the interval since the last run it accumulated over
+func getTableDeltaDatums(report runReport) []metricDatum {
+	var datums []metricDatum
+	for _, delta := range getTableDeltas(report) {
+		datums = append(datums, metricDatum{Name: "TableDelta", Dimensions: delta.dimensions(), Value: float64(delta.Delta), Unit: "Count", Timestamp: report.CollectedAt, Type: metricDelta, Interval: report.Interval})
+	}
+
+	return datums
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// defaults for the Azure Monitor configuration
+const (
+	defaultAzureNamespace        = "RowMetrics"
+	defaultAzureAuthorityHost    = "https://login.microsoftonline.com"
+	defaultAzureIdentityEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+	// azureMonitorResource is the resource tokens are requested for, to publish custom metrics
+	azureMonitorResource = "https://monitoring.azure.com/"
+	// azureTokenMargin is how long before a token expires that a new one is requested
+	azureTokenMargin = 5 * time.Minute
+	// azureTimeout is how long a single request to Azure may take
+	azureTimeout = 10 * time.Second
+)
+
+// azureConfig is the configuration of the Azure Monitor sink
+// ResourceID is the resource the metrics are published against, such as "/subscriptions/.../flexibleServers/shop"
+// Region is the region of the resource, which the regional ingestion endpoint is named after
+// Namespace is the metric namespace the metrics are put in, defaulting to defaultAzureNamespace
+// Endpoint is the base URL metrics are posted to, defaulting to https://<region>.monitoring.azure.com, and can be pointed at a local stub
+// TenantID, ClientID and ClientSecret authenticate as a service principal, and ClientSecret may reference a secret
+// Without a ClientSecret, the managed identity is used instead, with ClientID selecting a user assigned identity
+// AuthorityHost and IdentityEndpoint are where tokens are requested for each, defaulting to Azure's public cloud and instance metadata service
+type azureConfig struct {
+	ResourceID       string `yaml:"resourceId"`
+	Region           string
+	Namespace        string
+	Endpoint         string
+	TenantID         string `yaml:"tenantId"`
+	ClientID         string `yaml:"clientId"`
+	ClientSecret     string `yaml:"clientSecret"`
+	AuthorityHost    string `yaml:"authorityHost"`
+	IdentityEndpoint string `yaml:"identityEndpoint"`
+	Retry            retryConfig
+}
+
+// azureSink publishes RowMetrics as custom metrics on Azure Monitor, with the regional ingestion API
+// Each table's difference is a value of the TableDelta metric, with its database, kind and table as dimensions
+type azureSink struct {
+	config azureConfig
+
+	// token is the last access token requested, which is reused until it is about to expire
+	token       string
+	tokenExpiry time.Time
+}
+
+// newAzureSink takes the Azure Monitor configuration and creates an azureSink, filling in the defaults
+// It returns the sink, as well as an error if the resource, endpoints, credentials or retry configuration are invalid
+func newAzureSink(config azureConfig) (*azureSink, error) {
+	if config.Namespace == "" {
+		config.Namespace = defaultAzureNamespace
+	}
+	if config.AuthorityHost == "" {
+		config.AuthorityHost = defaultAzureAuthorityHost
+	}
+	if config.Endpoint == "" {
+		if config.Region == "" {
+			return nil, fmt.Errorf("azure region must be configured, unless the endpoint is")
+		}
+		config.Endpoint = "https://" + strings.ToLower(strings.Replace(config.Region, " ", "", -1)) + ".monitoring.azure.com"
+	}
+
+	if !strings.HasPrefix(config.ResourceID, "/subscriptions/") {
+		return nil, fmt.Errorf("invalid azure resourceId %q, must be the full ID of a resource, starting /subscriptions/", config.ResourceID)
+	}
+	for _, endpoint := range []string{config.Endpoint, config.AuthorityHost, config.IdentityEndpoint} {
+		if endpoint == "" {
+			continue
+		}
+		if parsed, err := url.Parse(endpoint); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, fmt.Errorf("invalid azure endpoint %q, must be an http:// or https:// URL", endpoint)
+		}
+	}
+	if config.ClientSecret != "" && (config.TenantID == "" || config.ClientID == "") {
+		return nil, fmt.Errorf("azure tenantId and clientId are needed to authenticate with a clientSecret")
+	}
+	if _, _, err := getRetryParameters(config.Retry); err != nil {
+		return nil, fmt.Errorf("azure %s", err)
+	}
+
+	return &azureSink{config: config}, nil
+}
+
+func (s *azureSink) name() string {
+	return "azure"
+}
+
+// maxBackfillAge is 20 minutes, the oldest metric Azure Monitor accepts
+func (s *azureSink) maxBackfillAge() time.Duration {
+	return 20 * time.Minute
+}
+
+// metrics converts each table's difference into a TableDelta datum, with the database, kind and table as dimensions
+// Each datum is stamped with the time it was collected
+func (s *azureSink) metrics(report runReport) []metricDatum {
+	return getTableDeltaDatums(report)
+}
+
+// publish posts the datums to the ingestion API, one request for each metric, set of dimension names and timestamp, retrying each as configured
+// Every request is attempted, and the first error is returned after the rest have been posted
+func (s *azureSink) publish(datums []metricDatum) error {
+	documents := s.getDocuments(datums, time.Now())
+
+	// Get the token up front, so that failing to get one fails the publish once, rather than for every document
+	err := publishWithRetry(s.config.Retry, s.name(), func() error {
+		_, err := s.getToken()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	failures := 0
+	for _, document := range documents {
+		err := publishWithRetry(s.config.Retry, s.name(), func() error {
+			return s.postMetrics(document)
+		})
+		if err != nil {
+			failures++
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	slog.Info("Posted Azure Monitor metrics", "resource", s.config.ResourceID, "namespace", s.config.Namespace, "requests", len(documents)-failures, "failures", failures, "count", len(datums))
+
+	if failures > 0 {
+		return fmt.Errorf("%d of %d azure requests failed: %s", failures, len(documents), firstErr)
+	}
+
+	return nil
+}
+
+// postMetrics posts a single custom metrics document to the resource's metrics endpoint
+// Rejected requests, other than being rate limited or an expired token, are returned as a permanentError since retrying them won't help
+func (s *azureSink) postMetrics(document []byte) error {
+	token, err := s.getToken()
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(s.config.Endpoint, "/")+s.config.ResourceID+"/metrics", bytes.NewReader(document))
+	if err != nil {
+		return permanentError{err}
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", "Bearer "+token)
+
+	client := http.Client{Timeout: azureTimeout}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		// Include the start of the response, which usually says why the metrics were rejected
+		responseBody, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+		err = fmt.Errorf("azure monitor responded with %s: %s", response.Status, strings.TrimSpace(string(responseBody)))
+		if response.StatusCode == http.StatusUnauthorized {
+			// Request a new token on the next attempt, in case this one was revoked
+			s.token = ""
+			return err
+		}
+		if response.StatusCode < 500 && response.StatusCode != http.StatusTooManyRequests {
+			return permanentError{err}
+		}
+		return err
+	}
+
+	return nil
+}
+
+// getToken returns an access token for Azure Monitor, requesting a new one if there is none or it is about to expire
+// With a client secret it is requested from the authority as the service principal, otherwise from the managed identity endpoint
+// App Service, Functions and Container Apps provide their own managed identity endpoint, in IDENTITY_ENDPOINT, which is used if none is configured
+// It returns the token, as well as an error if one could not be obtained
+func (s *azureSink) getToken() (string, error) {
+	if s.token != "" && time.Until(s.tokenExpiry) > azureTokenMargin {
+		return s.token, nil
+	}
+
+	var (
+		request *http.Request
+		err     error
+	)
+
+	if s.config.ClientSecret != "" {
+		clientSecret, err := resolveSecret(s.config.ClientSecret)
+		if err != nil {
+			return "", permanentError{fmt.Errorf("failed to resolve azure.clientSecret: %s", err)}
+		}
+
+		form := url.Values{
+			"grant_type":    {"client_credentials"},
+			"client_id":     {s.config.ClientID},
+			"client_secret": {clientSecret},
+			"resource":      {azureMonitorResource},
+		}
+		tokenURL := strings.TrimSuffix(s.config.AuthorityHost, "/") + "/" + url.PathEscape(s.config.TenantID) + "/oauth2/token"
+		request, err = http.NewRequest(http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", permanentError{err}
+		}
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		query := url.Values{"api-version": {"2018-02-01"}, "resource": {azureMonitorResource}}
+		if s.config.ClientID != "" {
+			query.Set("client_id", s.config.ClientID)
+		}
+
+		identityEndpoint, identityHeader := s.config.IdentityEndpoint, ""
+		if identityEndpoint == "" && os.Getenv("IDENTITY_ENDPOINT") != "" {
+			identityEndpoint, identityHeader = os.Getenv("IDENTITY_ENDPOINT"), os.Getenv("IDENTITY_HEADER")
+			query.Set("api-version", "2019-08-01")
+		}
+		if identityEndpoint == "" {
+			identityEndpoint = defaultAzureIdentityEndpoint
+		}
+
+		request, err = http.NewRequest(http.MethodGet, identityEndpoint+"?"+query.Encode(), nil)
+		if err != nil {
+			return "", permanentError{err}
+		}
+		request.Header.Set("Metadata", "true")
+		if identityHeader != "" {
+			request.Header.Set("X-IDENTITY-HEADER", identityHeader)
+		}
+	}
+
+	client := http.Client{Timeout: azureTimeout}
+	response, err := client.Do(request)
+	if err != nil {
+		return "", fmt.Errorf("failed to request azure token: %s", err)
+	}
+	defer response.Body.Close()
+
+	responseBody, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return "", fmt.Errorf("failed to request azure token, %s responded with %s: %s", request.URL.Host, response.Status, strings.TrimSpace(string(responseBody)))
+	}
+
+	// Both token endpoints return expires_in as a string of seconds, although some return it as a number
+	var token struct {
+		AccessToken string      `json:"access_token"`
+		ExpiresIn   json.Number `json:"expires_in"`
+	}
+	err = json.Unmarshal(responseBody, &token)
+	if err != nil || token.AccessToken == "" {
+		return "", fmt.Errorf("failed to parse azure token from %s", request.URL.Host)
+	}
+	expiresIn, err := token.ExpiresIn.Int64()
+	if err != nil {
+		expiresIn = 0
+	}
+
+	s.token = token.AccessToken
+	s.tokenExpiry = time.Now().Add(time.Duration(expiresIn) * time.Second)
+	return s.token, nil
+}
+
+// getDocuments converts datums into custom metrics documents, one for each metric, set of dimension names and timestamp
+// Each series of a document is a set of dimension values, with the min, max, sum and count of the datums that share them
+// Datums without a timestamp, such as run metrics, are stamped with now
+func (s *azureSink) getDocuments(datums []metricDatum, now time.Time) [][]byte {
+	// azureSeries is the aggregate of the datums that share a set of dimension values
+	type azureSeries struct {
+		DimValues []string `json:"dimValues,omitempty"`
+		Min       float64  `json:"min"`
+		Max       float64  `json:"max"`
+		Sum       float64  `json:"sum"`
+		Count     int      `json:"count"`
+	}
+
+	// azureGroup is the series that share a document, in the order they first came in
+	type azureGroup struct {
+		metric    string
+		dimNames  []string
+		timestamp time.Time
+		series    []*azureSeries
+		index     map[string]*azureSeries
+	}
+
+	var groups []*azureGroup
+	groupIndex := make(map[string]*azureGroup)
+
+	for _, datum := range datums {
+		timestamp := datum.Timestamp
+		if timestamp.IsZero() {
+			timestamp = now
+		}
+
+		var dimNames, dimValues []string
+		for _, dimension := range datum.Dimensions {
+			dimNames = append(dimNames, dimension.Name)
+			dimValues = append(dimValues, dimension.Value)
+		}
+
+		groupKey := datum.Name + "\x00" + strings.Join(dimNames, "\x00") + "\x00" + timestamp.String()
+		group, ok := groupIndex[groupKey]
+		if !ok {
+			group = &azureGroup{metric: datum.Name, dimNames: dimNames, timestamp: timestamp, index: make(map[string]*azureSeries)}
+			groupIndex[groupKey] = group
+			groups = append(groups, group)
+		}
+
+		// Aggregate datums with the same dimension values, such as a query run more than once, into a single series
+		seriesKey := strings.Join(dimValues, "\x00")
+		series, ok := group.index[seriesKey]
+		if !ok {
+			series = &azureSeries{DimValues: dimValues, Min: datum.Value, Max: datum.Value}
+			group.index[seriesKey] = series
+			group.series = append(group.series, series)
+		}
+		if datum.Value < series.Min {
+			series.Min = datum.Value
+		}
+		if datum.Value > series.Max {
+			series.Max = datum.Value
+		}
+		series.Sum += datum.Value
+		series.Count++
+	}
+
+	var documents [][]byte
+	for _, group := range groups {
+		baseData := map[string]interface{}{
+			"metric":    group.metric,
+			"namespace": s.config.Namespace,
+			"series":    group.series,
+		}
+		if len(group.dimNames) > 0 {
+			baseData["dimNames"] = group.dimNames
+		}
+
+		document, err := json.Marshal(map[string]interface{}{
+			"time": group.timestamp.UTC().Format(time.RFC3339),
+			"data": map[string]interface{}{"baseData": baseData},
+		})
+		if err != nil {
+			slog.Error("Failed to encode Azure Monitor metrics", "metric", group.metric, "error", err)
+			continue
+		}
+		documents = append(documents, document)
+	}
+
+	return documents
+}
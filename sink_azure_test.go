@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// azureServer is a stub of both the token endpoints and the custom metrics endpoint, recording the requests made to each
+type azureServer struct {
+	*httptest.Server
+
+	mutex   sync.Mutex
+	tokens  []*http.Request
+	forms   []url.Values
+	metrics []recordedRequest
+}
+
+// newAzureServer starts an azureServer, which is closed when the test finishes
+// Tokens are requested as the service principal of tenant "tenant", or from the managed identity at /identity
+func newAzureServer(t *testing.T, resourceID string) *azureServer {
+	server := &azureServer{}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		server.mutex.Lock()
+		defer server.mutex.Unlock()
+
+		switch r.URL.Path {
+		case "/tenant/oauth2/token":
+			r.ParseForm()
+			server.tokens = append(server.tokens, r)
+			server.forms = append(server.forms, r.PostForm)
+			w.Write([]byte(`{"access_token":"principal-token","expires_in":"3600"}`))
+		case "/identity":
+			server.tokens = append(server.tokens, r)
+			w.Write([]byte(`{"access_token":"identity-token","expires_in":3600}`))
+		case resourceID + "/metrics":
+			body, _ := ioutil.ReadAll(r.Body)
+			server.metrics = append(server.metrics, recordedRequest{header: r.Header, body: string(body)})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func TestAzureSinkPublish(t *testing.T) {
+	resourceID := "/subscriptions/0000/resourceGroups/shop/providers/Microsoft.DBforMySQL/flexibleServers/shop"
+	server := newAzureServer(t, resourceID)
+	s, err := newAzureSink(azureConfig{ResourceID: resourceID, Endpoint: server.URL, AuthorityHost: server.URL, TenantID: "tenant", ClientID: "client", ClientSecret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	collectedAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	report := runReport{
+		CollectedAt: collectedAt,
+		Interval:    time.Minute,
+		Current:     map[string]countCollection{"shop": {Increment: map[string]int{"Sale": 120, "Msg": 7}, Row: map[string]int{"Product": 30}}},
+		Differences: map[string]countCollection{"shop": {Increment: map[string]int{"Sale": 60, "Msg": 0}, Row: map[string]int{"Product": -1}}},
+	}
+
+	// Publish twice, reusing the token the second time
+	for i := 0; i < 2; i++ {
+		if err := s.publish(s.metrics(report)); err != nil {
+			t.Fatalf("publish returned an error: %s", err)
+		}
+	}
+
+	if len(server.tokens) != 1 {
+		t.Fatalf("requested %d tokens, expected the first to be reused", len(server.tokens))
+	}
+	form := server.forms[0]
+	if form.Get("grant_type") != "client_credentials" || form.Get("client_id") != "client" || form.Get("client_secret") != "secret" || form.Get("resource") != azureMonitorResource {
+		t.Errorf("token was requested with %v, expected the client credentials for Azure Monitor", form)
+	}
+
+	if len(server.metrics) != 2 {
+		t.Fatalf("received %d metrics requests, expected one for each publish", len(server.metrics))
+	}
+	request := server.metrics[0]
+	if authorization := request.header.Get("Authorization"); authorization != "Bearer principal-token" {
+		t.Errorf("Authorization header is %q, expected the token", authorization)
+	}
+	if contentType := request.header.Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Content-Type header is %q, expected JSON", contentType)
+	}
+
+	var document struct {
+		Time string
+		Data struct {
+			BaseData struct {
+				Metric    string
+				Namespace string
+				DimNames  []string
+				Series    []struct {
+					DimValues []string
+					Min       float64
+					Max       float64
+					Sum       float64
+					Count     int
+				}
+			}
+		}
+	}
+	if err := json.Unmarshal([]byte(request.body), &document); err != nil {
+		t.Fatalf("body %q isn't JSON: %s", request.body, err)
+	}
+
+	baseData := document.Data.BaseData
+	if document.Time != "2026-01-02T03:04:05Z" || baseData.Metric != "TableDelta" || baseData.Namespace != "RowMetrics" {
+		t.Errorf("document is %+v, expected TableDelta in the default namespace as of when it was collected", document)
+	}
+	if len(baseData.DimNames) != 3 || baseData.DimNames[0] != "database" || baseData.DimNames[1] != "kind" || baseData.DimNames[2] != "table" {
+		t.Errorf("dimNames are %v, expected database, kind and table", baseData.DimNames)
+	}
+	if len(baseData.Series) != 3 {
+		t.Fatalf("series are %+v, expected one for each table", baseData.Series)
+	}
+	sale := baseData.Series[1]
+	if len(sale.DimValues) != 3 || sale.DimValues[2] != "Sale" || sale.Min != 60 || sale.Max != 60 || sale.Sum != 60 || sale.Count != 1 {
+		t.Errorf("series of Sale is %+v, expected its delta", sale)
+	}
+}
+
+func TestAzureSinkManagedIdentity(t *testing.T) {
+	resourceID := "/subscriptions/0000/resourceGroups/shop/providers/Microsoft.DBforPostgreSQL/flexibleServers/shop"
+	server := newAzureServer(t, resourceID)
+	t.Setenv("IDENTITY_ENDPOINT", "")
+	s, err := newAzureSink(azureConfig{ResourceID: resourceID, Endpoint: server.URL, ClientID: "user-assigned", IdentityEndpoint: server.URL + "/identity"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := s.getToken()
+	if err != nil {
+		t.Fatalf("getToken returned an error: %s", err)
+	}
+	if token != "identity-token" || time.Until(s.tokenExpiry) < 59*time.Minute {
+		t.Errorf("token is %q expiring at %s, expected the identity's token for an hour", token, s.tokenExpiry)
+	}
+
+	request := server.tokens[0]
+	query := request.URL.Query()
+	if request.Method != http.MethodGet || request.Header.Get("Metadata") != "true" || query.Get("resource") != azureMonitorResource || query.Get("client_id") != "user-assigned" {
+		t.Errorf("token was requested with %s %s, expected the user assigned identity's token for Azure Monitor", request.Method, request.URL)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// defaultCloudWatchNamespace is the namespace metrics are put in when none is configured
+const defaultCloudWatchNamespace = "RowMetrics"
+
+// cloudWatchSink publishes RowMetrics as metrics on AWS CloudWatch
+// Each table's difference is a metric named after the table, with the database as the DBInstanceIdentifier dimension
+type cloudWatchSink struct {
+	awsConfig map[string]string
+	namespace string
+}
+
+// newCloudWatchSink takes the AWS configuration values and creates a cloudWatchSink
+// Unless a namespace is specified, it will put the metrics in the namespace "RowMetrics"
+func newCloudWatchSink(awsConfig map[string]string) *cloudWatchSink {
+	namespace := awsConfig["namespace"]
+	if namespace == "" {
+		// If a namespace is not defined in the config YAML, use the default, "RowMetrics"
+		namespace = defaultCloudWatchNamespace
+	}
+
+	return &cloudWatchSink{awsConfig: awsConfig, namespace: namespace}
+}
+
+// isCloudWatchEnabled checks whether metrics are put on CloudWatch, which they are unless aws.enabled is false
+// It returns whether CloudWatch is enabled, as well as an error if aws.enabled isn't a boolean
+func isCloudWatchEnabled(awsConfig map[string]string) (bool, error) {
+	if awsConfig["enabled"] == "" {
+		return true, nil
+	}
+
+	enabled, err := strconv.ParseBool(awsConfig["enabled"])
+	if err != nil {
+		return false, fmt.Errorf("invalid aws.enabled %q, must be true or false", awsConfig["enabled"])
+	}
+
+	return enabled, nil
+}
+
+func (s *cloudWatchSink) name() string {
+	return "cloudwatch"
+}
+
+// maxBackfillAge is two weeks, the oldest timestamp PutMetricData accepts
+func (s *cloudWatchSink) maxBackfillAge() time.Duration {
+	return 14 * 24 * time.Hour
+}
+
+func (s *cloudWatchSink) metrics(report runReport) []metricDatum {
+	var datums []metricDatum
+
+	for _, countCollectionName := range getSortedKeys(report.Differences) {
+		// Go through each countCollection and convert its counts into datums
+		countCollection := report.Differences[countCollectionName]
+		dimensions := []metricDimension{{Name: "DBInstanceIdentifier", Value: countCollectionName}}
+
+		for _, counts := range []map[string]int{countCollection.Increment, countCollection.Row} {
+			// Go through each count in the Increment and Row maps, with the name of the table as the metric name
+			for _, countName := range getSortedKeys(counts) {
+				datums = append(datums, metricDatum{Name: countName, Dimensions: dimensions, Value: float64(counts[countName]), Unit: cloudwatch.StandardUnitCount})
+			}
+		}
+	}
+
+	return datums
+}
+
+// publish puts each datum as a metric on AWS CloudWatch
+// Unless an explicit set of AWS configuration values is specified, it will use the normal avenues for obtaining credentials
+// That is, Environment Variables -> Shared Credentials File -> EC2 IAM Role
+func (s *cloudWatchSink) publish(datums []metricDatum) error {
+	awsSession, err := newAWSSession(s.awsConfig, "")
+	if err != nil {
+		return err
+	}
+
+	// Create a Cloudwatch service instance using the AWS session
+	cwService := cloudwatch.New(awsSession)
+
+	failures := 0
+	for _, datum := range datums {
+		// Go through each datum, and put the cloudwatch metric
+		var dimensions []*cloudwatch.Dimension
+		for _, dimension := range datum.Dimensions {
+			dimensions = append(dimensions, &cloudwatch.Dimension{
+				Name:  aws.String(dimension.Name),
+				Value: aws.String(dimension.Value),
+			})
+		}
+
+		cwDatum := &cloudwatch.MetricDatum{
+			MetricName: aws.String(datum.Name),   // Name of the table, or of the run metric, as MetricName
+			Unit:       aws.String(datum.Unit),   // Unit of the datum, such as Count, as the CW metric Unit
+			Value:      aws.Float64(datum.Value), // Float64 value of the datum as the Metric Value
+			Dimensions: dimensions,               // Dimensions of the datum, such as DBInstanceIdentifier
+		}
+		if !datum.Timestamp.IsZero() {
+			// Datums being replayed keep the time they were collected, rather than the time they are received
+			cwDatum.Timestamp = aws.Time(datum.Timestamp)
+		}
+
+		_, err := cwService.PutMetricData(&cloudwatch.PutMetricDataInput{
+			MetricData: []*cloudwatch.MetricDatum{cwDatum},
+			Namespace:  aws.String(s.namespace), // Put the metrics in the namespace specified
+		})
+
+		// If there is a failure in the PUT, just log it and carry on with the rest
+		if err != nil {
+			failures++
+			slog.Error("Failed to push Cloudwatch metric", "metric", datum.String(), "error", err)
+		} else {
+			slog.Debug("Pushed Cloudwatch metric", "metric", datum.String())
+		}
+	}
+
+	slog.Info("Pushed Cloudwatch metrics", "namespace", s.namespace, "count", len(datums)-failures, "failures", failures)
+
+	if failures > 0 {
+		return fmt.Errorf("%d of %d metrics failed to push", failures, len(datums))
+	}
+
+	// Assuming no errors, return nil
+	return nil
+}
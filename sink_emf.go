@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// emfMaxMetrics is the most metrics CloudWatch accepts in a single EMF document, and the most values for a single metric
+const emfMaxMetrics = 100
+
+// emfConfig is the configuration of the CloudWatch Embedded Metric Format sink
+// Path is the file documents are appended to, or stdout if it is empty or "-", as Lambda and most container log drivers ship
+// Namespace is the namespace the metrics are put in, defaulting to aws.namespace, and then "RowMetrics", as for PutMetricData
+type emfConfig struct {
+	Path      string
+	Namespace string
+}
+
+// emfSink publishes RowMetrics as CloudWatch Embedded Metric Format documents, which CloudWatch Logs extracts metrics from
+// The metrics are the same as the cloudWatchSink publishes, without needing permission to call PutMetricData
+type emfSink struct {
+	config     emfConfig
+	cloudWatch *cloudWatchSink
+	output     io.Writer
+}
+
+// newEMFSink takes the EMF configuration and the AWS configuration values, and creates an emfSink
+// Without a namespace of its own, it uses the same namespace as PutMetricData, even if aws.enabled is false
+// It returns the sink, as well as an error if the namespace is one CloudWatch wouldn't accept
+func newEMFSink(config emfConfig, awsConfig map[string]string) (*emfSink, error) {
+	if config.Namespace == "" {
+		config.Namespace = awsConfig["namespace"]
+	}
+	if config.Namespace == "" {
+		config.Namespace = defaultCloudWatchNamespace
+	}
+	if len(config.Namespace) > 255 || strings.HasPrefix(config.Namespace, "AWS/") {
+		return nil, fmt.Errorf("invalid emf namespace %q, must be at most 255 characters and not start with AWS/", config.Namespace)
+	}
+
+	return &emfSink{config: config, cloudWatch: newCloudWatchSink(nil), output: os.Stdout}, nil
+}
+
+func (s *emfSink) name() string {
+	return "emf"
+}
+
+// maxBackfillAge is two weeks, the oldest log event CloudWatch Logs accepts, and so the oldest metric it extracts
+func (s *emfSink) maxBackfillAge() time.Duration {
+	return 14 * 24 * time.Hour
+}
+
+// metrics converts the differences into the same datums as the cloudWatchSink, stamped with the time they were collected
+func (s *emfSink) metrics(report runReport) []metricDatum {
+	datums := s.cloudWatch.metrics(report)
+	for i := range datums {
+		datums[i].Timestamp = report.CollectedAt
+	}
+
+	return datums
+}
+
+// publish writes the datums as EMF documents, one per line, to stdout or appended to the configured file
+// Datums without a timestamp, such as run metrics, are stamped with the time they are published
+func (s *emfSink) publish(datums []metricDatum) error {
+	documents, err := s.getDocuments(datums, time.Now())
+	if err != nil {
+		return err
+	}
+
+	var buffer bytes.Buffer
+	for _, document := range documents {
+		buffer.Write(document)
+		buffer.WriteByte('\n')
+	}
+
+	output := s.output
+	if s.config.Path != "" && s.config.Path != "-" {
+		file, err := os.OpenFile(s.config.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		output = file
+	}
+
+	// Write every document at once, so that they aren't interleaved with anything else writing to the same output
+	_, err = output.Write(buffer.Bytes())
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Wrote EMF documents", "namespace", s.config.Namespace, "documents", len(documents), "count", len(datums))
+	return nil
+}
+
+// getDocuments converts datums into EMF documents, one for each set of dimensions and timestamp
+// A metric with several datums in the same document, such as a query run more than once, has an array of values
+// Documents are split so that none has more than emfMaxMetrics metrics, or values of a single metric
+func (s *emfSink) getDocuments(datums []metricDatum, now time.Time) ([][]byte, error) {
+	// emfGroup is the datums that share a document, in the order their metrics first came in
+	type emfGroup struct {
+		dimensions []metricDimension
+		timestamp  time.Time
+		names      []string
+		units      map[string]string
+		values     map[string][]float64
+	}
+
+	var (
+		groups []*emfGroup
+		latest = make(map[string]*emfGroup)
+	)
+
+	for _, datum := range datums {
+		timestamp := datum.Timestamp
+		if timestamp.IsZero() {
+			timestamp = now
+		}
+
+		var key strings.Builder
+		for _, dimension := range datum.Dimensions {
+			key.WriteString(dimension.Name + "=" + dimension.Value + "\x00")
+		}
+		key.WriteString(timestamp.String())
+
+		// Start a new document when this one is full
+		group, ok := latest[key.String()]
+		if ok {
+			_, hasMetric := group.values[datum.Name]
+			if (!hasMetric && len(group.names) >= emfMaxMetrics) || len(group.values[datum.Name]) >= emfMaxMetrics {
+				ok = false
+			}
+		}
+		if !ok {
+			group = &emfGroup{dimensions: datum.Dimensions, timestamp: timestamp, units: make(map[string]string), values: make(map[string][]float64)}
+			latest[key.String()] = group
+			groups = append(groups, group)
+		}
+
+		if _, hasMetric := group.values[datum.Name]; !hasMetric {
+			group.names = append(group.names, datum.Name)
+			group.units[datum.Name] = datum.Unit
+		}
+		group.values[datum.Name] = append(group.values[datum.Name], datum.Value)
+	}
+
+	var documents [][]byte
+	for _, group := range groups {
+		// The dimension and metric values are top level members of the document, which the metadata refers to by name
+		document := make(map[string]interface{})
+
+		dimensionNames := []string{}
+		for _, dimension := range group.dimensions {
+			dimensionNames = append(dimensionNames, dimension.Name)
+			document[dimension.Name] = dimension.Value
+		}
+
+		var metrics []map[string]string
+		for _, name := range group.names {
+			metric := map[string]string{"Name": name}
+			if unit := group.units[name]; unit != "" {
+				metric["Unit"] = unit
+			}
+			metrics = append(metrics, metric)
+
+			if values := group.values[name]; len(values) == 1 {
+				document[name] = values[0]
+			} else {
+				document[name] = values
+			}
+		}
+
+		document["_aws"] = map[string]interface{}{
+			"Timestamp": group.timestamp.UnixNano() / int64(time.Millisecond),
+			"CloudWatchMetrics": []map[string]interface{}{{
+				"Namespace":  s.config.Namespace,
+				"Dimensions": [][]string{dimensionNames},
+				"Metrics":    metrics,
+			}},
+		}
+
+		encoded, err := json.Marshal(document)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode EMF document: %s", err)
+		}
+		documents = append(documents, encoded)
+	}
+
+	return documents, nil
+}
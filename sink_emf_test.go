@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewEMFSinkNamespace(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    emfConfig
+		awsConfig map[string]string
+		expected  string
+	}{
+		{name: "default", expected: "RowMetrics"},
+		{name: "aws namespace", awsConfig: map[string]string{"namespace": "Shop"}, expected: "Shop"},
+		{name: "aws namespace with cloudwatch disabled", awsConfig: map[string]string{"namespace": "Shop", "enabled": "false"}, expected: "Shop"},
+		{name: "emf namespace", config: emfConfig{Namespace: "ShopEMF"}, awsConfig: map[string]string{"namespace": "Shop"}, expected: "ShopEMF"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := newEMFSink(test.config, test.awsConfig)
+			if err != nil {
+				t.Fatalf("newEMFSink returned an error: %s", err)
+			}
+			if s.config.Namespace != test.expected {
+				t.Errorf("namespace is %q, expected %q", s.config.Namespace, test.expected)
+			}
+		})
+	}
+
+	for _, namespace := range []string{"AWS/RDS", strings.Repeat("a", 256)} {
+		if _, err := newEMFSink(emfConfig{}, map[string]string{"namespace": namespace}); err == nil {
+			t.Errorf("newEMFSink accepted the namespace %q", namespace)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// defaults for the Google Cloud Monitoring configuration
+const (
+	defaultGCPEndpoint     = "https://monitoring.googleapis.com"
+	defaultGCPMetricPrefix = "custom.googleapis.com/rowmetrics/"
+	defaultGCPResourceType = "global"
+	// gcpMonitoringScope is the OAuth scope needed to write time series
+	gcpMonitoringScope = "https://www.googleapis.com/auth/monitoring.write"
+	// gcpMaxTimeSeries is the most time series Cloud Monitoring accepts in a single request
+	gcpMaxTimeSeries = 200
+	// gcpTimeout is how long a single request to Cloud Monitoring may take
+	gcpTimeout = 10 * time.Second
+)
+
+// gcpConfig is the configuration of the Google Cloud Monitoring sink
+// Project is the project the time series are written to, defaulting to the project of the credentials
+// Credentials is a service account key, usually referenced as a secret such as "file:/path/to/key.json"
+// Without one, the application default credentials are used, such as the service account of the VM or Cloud Run service
+// Endpoint is the base URL of the Cloud Monitoring API, defaulting to defaultGCPEndpoint, and can be pointed at a local stub
+// Resource is the monitored resource every time series is written against, defaulting to "global"
+// Labels are added to the metric labels of every time series, along with the datum's dimensions
+type gcpConfig struct {
+	Project     string
+	Credentials string
+	Endpoint    string
+	Resource    gcpResourceConfig
+	Labels      map[string]string
+	Retry       retryConfig
+}
+
+// gcpResourceConfig is a monitored resource, such as "generic_node" with its "location", "namespace" and "node_id" labels
+// The project_id label is filled in from the project if it isn't configured
+type gcpResourceConfig struct {
+	Type   string
+	Labels map[string]string
+}
+
+// gcpSink publishes RowMetrics as custom metrics on Google Cloud Monitoring
+// Each table's difference is a point of the custom.googleapis.com/rowmetrics/table_delta gauge, labelled with its database, kind and table
+type gcpSink struct {
+	config gcpConfig
+
+	// client and project are set from the credentials by authenticate, when metrics are first published
+	client  *http.Client
+	project string
+}
+
+// newGCPSink takes the Google Cloud Monitoring configuration and creates a gcpSink, filling in the defaults
+// The credentials aren't loaded until metrics are published, so that the configuration can be checked without them
+// It returns the sink, as well as an error if the endpoint or retry configuration is invalid
+func newGCPSink(config gcpConfig) (*gcpSink, error) {
+	if config.Endpoint == "" {
+		config.Endpoint = defaultGCPEndpoint
+	}
+	if config.Resource.Type == "" {
+		config.Resource.Type = defaultGCPResourceType
+	}
+
+	endpoint, err := url.Parse(config.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid gcp endpoint %q, must be an http:// or https:// URL", config.Endpoint)
+	}
+	if _, _, err := getRetryParameters(config.Retry); err != nil {
+		return nil, fmt.Errorf("gcp %s", err)
+	}
+
+	return &gcpSink{config: config}, nil
+}
+
+func (s *gcpSink) name() string {
+	return "gcp"
+}
+
+// maxBackfillAge is 25 hours, the oldest point Cloud Monitoring accepts
+func (s *gcpSink) maxBackfillAge() time.Duration {
+	return 25 * time.Hour
+}
+
+// metrics converts each table's difference into a TableDelta datum, with the database, kind and table as dimensions
+// Each datum is stamped with the time it was collected
+func (s *gcpSink) metrics(report runReport) []metricDatum {
+	return getTableDeltaDatums(report)
+}
+
+// publish writes the datums as time series, in batches of up to gcpMaxTimeSeries, retrying each batch as configured
+func (s *gcpSink) publish(datums []metricDatum) error {
+	if s.client == nil {
+		err := s.authenticate()
+		if err != nil {
+			return err
+		}
+	}
+
+	series := s.getTimeSeries(datums, time.Now())
+
+	for start := 0; start < len(series); start += gcpMaxTimeSeries {
+		end := start + gcpMaxTimeSeries
+		if end > len(series) {
+			end = len(series)
+		}
+
+		err := publishWithRetry(s.config.Retry, s.name(), func() error {
+			return s.createTimeSeries(series[start:end])
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	slog.Info("Wrote Google Cloud Monitoring time series", "project", s.project, "series", len(series), "count", len(datums))
+	return nil
+}
+
+// authenticate loads the service account key, or the application default credentials, and creates the client requests are made with
+// It returns an error if there are no usable credentials, or no project to write to
+func (s *gcpSink) authenticate() error {
+	var (
+		credentials *google.Credentials
+		err         error
+	)
+
+	if s.config.Credentials != "" {
+		var key string
+		key, err = resolveSecret(s.config.Credentials)
+		if err != nil {
+			return fmt.Errorf("failed to resolve gcp.credentials: %s", err)
+		}
+		credentials, err = google.CredentialsFromJSONWithType(context.Background(), []byte(key), google.ServiceAccount, gcpMonitoringScope)
+	} else {
+		credentials, err = google.FindDefaultCredentials(context.Background(), gcpMonitoringScope)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load gcp credentials: %s", err)
+	}
+
+	s.project = s.config.Project
+	if s.project == "" {
+		s.project = credentials.ProjectID
+	}
+	if s.project == "" {
+		return fmt.Errorf("gcp.project must be configured, as the credentials don't have a project")
+	}
+
+	// The token source caches the access token, refreshing it as it expires
+	s.client = &http.Client{
+		Timeout:   gcpTimeout,
+		Transport: &oauth2.Transport{Source: credentials.TokenSource, Base: http.DefaultTransport},
+	}
+
+	return nil
+}
+
+// createTimeSeries sends a single timeSeries.create request
+// Rejected requests, other than being rate limited, are returned as a permanentError since retrying them won't help
+func (s *gcpSink) createTimeSeries(series []map[string]interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{"timeSeries": series})
+	if err != nil {
+		return permanentError{err}
+	}
+
+	createURL := strings.TrimSuffix(s.config.Endpoint, "/") + "/v3/projects/" + url.PathEscape(s.project) + "/timeSeries"
+	response, err := s.client.Post(createURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		// Include the start of the response, which says which time series was rejected and why
+		responseBody, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+		err = fmt.Errorf("cloud monitoring responded with %s: %s", response.Status, strings.TrimSpace(string(responseBody)))
+		if response.StatusCode < 500 && response.StatusCode != http.StatusTooManyRequests {
+			return permanentError{err}
+		}
+		return err
+	}
+
+	return nil
+}
+
+// getTimeSeries converts datums into gauge time series of a single point, with the metric type custom.googleapis.com/rowmetrics/<snake case name>
+// Dimensions become metric labels, named in snake case, such as db_instance_identifier
+// Cloud Monitoring only accepts one point of a time series in a request, so the values of datums of the same time series are summed into one
+// Datums without a timestamp, such as run metrics, are stamped with now
+func (s *gcpSink) getTimeSeries(datums []metricDatum, now time.Time) []map[string]interface{} {
+	resourceLabels := map[string]string{"project_id": s.project}
+	for name, value := range s.config.Resource.Labels {
+		resourceLabels[name] = value
+	}
+	resource := map[string]interface{}{"type": s.config.Resource.Type, "labels": resourceLabels}
+
+	var series []map[string]interface{}
+	// The value of each time series already converted, by metric type and labels, for repeated datums to be added to
+	values := make(map[string]map[string]float64)
+
+	for _, datum := range datums {
+		metricType := defaultGCPMetricPrefix + getPrometheusName(datum.Name)
+
+		labels := make(map[string]string)
+		for name, value := range s.config.Labels {
+			labels[name] = value
+		}
+		for _, dimension := range datum.Dimensions {
+			labels[getPrometheusName(dimension.Name)] = dimension.Value
+		}
+
+		key := metricType
+		for _, name := range getSortedKeys(labels) {
+			key += "," + name + "=" + labels[name]
+		}
+		if value, ok := values[key]; ok {
+			value["doubleValue"] += datum.Value
+			continue
+		}
+		values[key] = map[string]float64{"doubleValue": datum.Value}
+
+		timestamp := datum.Timestamp
+		if timestamp.IsZero() {
+			timestamp = now
+		}
+
+		series = append(series, map[string]interface{}{
+			"metric":     map[string]interface{}{"type": metricType, "labels": labels},
+			"resource":   resource,
+			"metricKind": "GAUGE",
+			"valueType":  "DOUBLE",
+			"points": []map[string]interface{}{{
+				"interval": map[string]string{"endTime": timestamp.UTC().Format(time.RFC3339Nano)},
+				"value":    values[key],
+			}},
+		})
+	}
+
+	return series
+}
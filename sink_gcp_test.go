@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGCPTimeSeriesRepeated(t *testing.T) {
+	s := &gcpSink{config: gcpConfig{Resource: gcpResourceConfig{Type: "global"}}, project: "rowmetrics-test"}
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	// Two fallback queries of the same kind are timed separately, as a run of the mysql dialect would
+	dimensions := []metricDimension{{Name: "database", Value: "shop"}, {Name: "query", Value: "fallback"}}
+	datums := []metricDatum{
+		{Name: "QueryLatency", Dimensions: dimensions, Value: 12, Unit: "Milliseconds"},
+		{Name: "Heartbeat", Value: 1, Unit: "Count"},
+		{Name: "QueryLatency", Dimensions: dimensions, Value: 30, Unit: "Milliseconds"},
+	}
+
+	series := s.getTimeSeries(datums, now)
+	if len(series) != 2 {
+		t.Fatalf("got %d time series, expected the repeated one to be written once", len(series))
+	}
+
+	metric := series[0]["metric"].(map[string]interface{})
+	if metric["type"] != "custom.googleapis.com/rowmetrics/query_latency" {
+		t.Errorf("first time series is %v, expected query_latency", metric["type"])
+	}
+	point := series[0]["points"].([]map[string]interface{})[0]
+	if value := point["value"].(map[string]float64)["doubleValue"]; value != 42 {
+		t.Errorf("query_latency is %g, expected the sum of both datums", value)
+	}
+	if endTime := point["interval"].(map[string]string)["endTime"]; endTime != "2026-01-02T03:04:05Z" {
+		t.Errorf("query_latency ends at %s, expected now", endTime)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaults for the Graphite configuration
+const (
+	defaultGraphiteAddress  = "127.0.0.1:2003"
+	defaultGraphiteProtocol = "tcp"
+	defaultGraphitePrefix   = "rowmetrics"
+	// defaultGraphiteUDPMTU keeps each packet within a single Ethernet frame, after the IP and UDP headers
+	defaultGraphiteUDPMTU = 1432
+	// graphiteTimeout is how long connecting to Carbon, and then writing every line, may each take
+	graphiteTimeout = 10 * time.Second
+)
+
+// graphiteConfig is the configuration of the Graphite sink
+// Address is the HOST:PORT of the Carbon plaintext listener, defaulting to defaultGraphiteAddress
+// Protocol is either "tcp" or "udp", defaulting to defaultGraphiteProtocol
+// Prefix is the first level of every metric path, defaulting to defaultGraphitePrefix
+// Tagged writes the dimensions as Graphite tags instead of as levels of the path
+type graphiteConfig struct {
+	Address  string
+	Protocol string
+	Prefix   string
+	Tagged   bool
+	Retry    retryConfig
+}
+
+// graphiteSink publishes RowMetrics to Graphite, using the Carbon plaintext protocol
+// Each table's difference is written to the path prefix.<database>.<kind>.<table>
+type graphiteSink struct {
+	config graphiteConfig
+}
+
+// newGraphiteSink takes the Graphite configuration and creates a graphiteSink, filling in the defaults
+// It returns the sink, as well as an error if the address, protocol or retry configuration is invalid
+func newGraphiteSink(config graphiteConfig) (*graphiteSink, error) {
+	if config.Address == "" {
+		config.Address = defaultGraphiteAddress
+	}
+	if config.Protocol == "" {
+		config.Protocol = defaultGraphiteProtocol
+	}
+	if config.Prefix == "" {
+		config.Prefix = defaultGraphitePrefix
+	}
+
+	if _, _, err := net.SplitHostPort(config.Address); err != nil {
+		return nil, fmt.Errorf("invalid graphite address %q, must be HOST:PORT", config.Address)
+	}
+	if config.Protocol != "tcp" && config.Protocol != "udp" {
+		return nil, fmt.Errorf("invalid graphite protocol %q, must be tcp or udp", config.Protocol)
+	}
+	if _, _, err := getRetryParameters(config.Retry); err != nil {
+		return nil, fmt.Errorf("graphite %s", err)
+	}
+
+	return &graphiteSink{config: config}, nil
+}
+
+func (s *graphiteSink) name() string {
+	return "graphite"
+}
+
+// maxBackfillAge is unlimitedBackfill, as carbon stores points at any time its retention covers
+func (s *graphiteSink) maxBackfillAge() time.Duration {
+	return unlimitedBackfill
+}
+
+// metrics converts each table's difference into a datum named after the table, with the database and kind as dimensions
+// Each datum is stamped with the time it was collected
+func (s *graphiteSink) metrics(report runReport) []metricDatum {
+	var datums []metricDatum
+	for _, delta := range getTableDeltas(report) {
+		dimensions := []metricDimension{
+			{Name: "database", Value: delta.Database},
+			{Name: "kind", Value: delta.Kind},
+		}
+		datums = append(datums, metricDatum{Name: delta.Table, Dimensions: dimensions, Value: float64(delta.Delta), Unit: "Count", Timestamp: report.CollectedAt, Type: metricDelta})
+	}
+
+	return datums
+}
+
+// publish writes each datum as a plaintext line to Carbon, reconnecting and retrying as configured if a write fails
+// Datums without a timestamp, such as run metrics, are stamped with the time they are published
+func (s *graphiteSink) publish(datums []metricDatum) error {
+	now := time.Now()
+
+	var lines []string
+	for _, datum := range datums {
+		lines = append(lines, s.formatLine(datum, now))
+	}
+
+	err := publishWithRetry(s.config.Retry, s.name(), func() error {
+		// Connect afresh on every attempt, as a failed write usually means Carbon dropped the connection
+		conn, err := net.DialTimeout(s.config.Protocol, s.config.Address, graphiteTimeout)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		if s.config.Protocol == "udp" {
+			packets, failures := sendDatagrams(conn, lines, defaultGraphiteUDPMTU)
+			if failures > 0 {
+				return fmt.Errorf("%d of %d graphite packets failed to send", failures, packets)
+			}
+			return nil
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(graphiteTimeout))
+		_, err = conn.Write([]byte(strings.Join(lines, "\n") + "\n"))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Wrote Graphite metrics", "address", s.config.Address, "protocol", s.config.Protocol, "count", len(datums))
+	return nil
+}
+
+// formatLine formats a datum as a plaintext line, such as "rowmetrics.shop.increment.orders 5 1700000000"
+// Each dimension value becomes a level of the path, between the prefix and the datum's name
+// When tagged, the dimensions are written as tags instead, such as "rowmetrics.orders;database=shop;kind=increment 5 1700000000"
+func (s *graphiteSink) formatLine(datum metricDatum, now time.Time) string {
+	timestamp := datum.Timestamp
+	if timestamp.IsZero() {
+		timestamp = now
+	}
+
+	// The prefix may have levels of its own, so only the levels within it are sanitized
+	var levels []string
+	for _, level := range strings.Split(s.config.Prefix, ".") {
+		levels = append(levels, sanitizeGraphiteLevel(level))
+	}
+
+	path := ""
+	if s.config.Tagged {
+		path = strings.Join(append(levels, sanitizeGraphiteLevel(datum.Name)), ".")
+		for _, dimension := range datum.Dimensions {
+			path += ";" + sanitizeGraphiteLevel(dimension.Name) + "=" + sanitizeGraphiteTag(dimension.Value)
+		}
+	} else {
+		for _, dimension := range datum.Dimensions {
+			levels = append(levels, sanitizeGraphiteLevel(dimension.Value))
+		}
+		path = strings.Join(append(levels, sanitizeGraphiteLevel(datum.Name)), ".")
+	}
+
+	return path + " " + strconv.FormatFloat(datum.Value, 'f', -1, 64) + " " + strconv.FormatInt(timestamp.Unix(), 10)
+}
+
+// sanitizeGraphiteLevel replaces anything in a single level of a path that Graphite would misread with an underscore
+// Dots and spaces in particular would otherwise add levels to the path, or end it early
+func sanitizeGraphiteLevel(level string) string {
+	if level == "" {
+		return "_"
+	}
+
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, level)
+}
+
+// sanitizeGraphiteTag replaces the characters Graphite doesn't allow in a tag value with an underscore
+func sanitizeGraphiteTag(value string) string {
+	if value == "" {
+		return "_"
+	}
+
+	return strings.Map(func(r rune) rune {
+		if r == ';' || r == '~' || r == ' ' || r == '\n' || r == '\t' {
+			return '_'
+		}
+		return r
+	}, value)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGraphiteSinkFormatLine(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	collectedAt := now.Add(-time.Minute)
+	dimensions := []metricDimension{{Name: "database", Value: "shop.eu"}, {Name: "kind", Value: "increment"}, {Name: "table", Value: "Order Items"}}
+
+	tests := []struct {
+		name     string
+		config   graphiteConfig
+		datum    metricDatum
+		expected string
+	}{
+		{
+			name:     "plain",
+			config:   graphiteConfig{},
+			datum:    metricDatum{Name: "delta", Dimensions: dimensions, Value: 5, Timestamp: collectedAt},
+			expected: "rowmetrics.shop_eu.increment.Order_Items.delta 5 1767322985",
+		},
+		{
+			name:     "prefix with levels",
+			config:   graphiteConfig{Prefix: "prod.row metrics"},
+			datum:    metricDatum{Name: "delta", Dimensions: []metricDimension{{Name: "table", Value: ""}}, Value: -1.5, Timestamp: collectedAt},
+			expected: "prod.row_metrics._.delta -1.5 1767322985",
+		},
+		{
+			name:     "tagged",
+			config:   graphiteConfig{Tagged: true},
+			datum:    metricDatum{Name: "delta", Dimensions: dimensions, Value: 5, Timestamp: collectedAt},
+			expected: "rowmetrics.delta;database=shop.eu;kind=increment;table=Order_Items 5 1767322985",
+		},
+		{
+			name:     "tagged without a timestamp",
+			config:   graphiteConfig{Tagged: true},
+			datum:    metricDatum{Name: "run.time", Dimensions: []metricDimension{{Name: "query", Value: "a;b~c"}}, Value: 12},
+			expected: "rowmetrics.run_time;query=a_b_c 12 1767323045",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := newGraphiteSink(test.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line := s.formatLine(test.datum, now); line != test.expected {
+				t.Errorf("line is %q, expected %q", line, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaults for the InfluxDB configuration
+const (
+	defaultInfluxMeasurement = "rowmetrics"
+	// defaultInfluxUDPMTU keeps each packet within a single Ethernet frame, after the IP and UDP headers
+	defaultInfluxUDPMTU = 1432
+	// influxTimeout is how long a single write to the HTTP API may take
+	influxTimeout = 10 * time.Second
+)
+
+// influxConfig is the configuration of the InfluxDB sink
+// URL is either the http:// or https:// address of the v2 API, or udp://HOST:PORT for the UDP listener
+// Token, Org and Bucket are only used by the v2 API, and Token may reference a secret
+// Measurement is the measurement every point is written to, defaulting to defaultInfluxMeasurement
+// Tags are added to every point, along with the point's own tags
+type influxConfig struct {
+	URL         string `yaml:"url"`
+	Token       string
+	Org         string
+	Bucket      string
+	Measurement string
+	Tags        map[string]string
+	Retry       retryConfig
+}
+
+// influxSink publishes RowMetrics as InfluxDB line protocol points
+// Each table is a point with the database, kind and table as tags, and its difference, value, rate and size as fields
+type influxSink struct {
+	config influxConfig
+	url    *url.URL
+}
+
+// newInfluxSink takes the InfluxDB configuration and creates an influxSink, filling in the defaults
+// It returns the sink, as well as an error if the URL or retry configuration is invalid
+func newInfluxSink(config influxConfig) (*influxSink, error) {
+	if config.Measurement == "" {
+		config.Measurement = defaultInfluxMeasurement
+	}
+
+	influxURL, err := url.Parse(config.URL)
+	if err != nil || influxURL.Host == "" {
+		return nil, fmt.Errorf("invalid influx url %q, must be http://HOST:PORT, https://HOST:PORT or udp://HOST:PORT", config.URL)
+	}
+
+	switch influxURL.Scheme {
+	case "http", "https":
+		if config.Org == "" || config.Bucket == "" {
+			return nil, fmt.Errorf("influx org and bucket are needed to write to %s", config.URL)
+		}
+	case "udp":
+	default:
+		return nil, fmt.Errorf("invalid influx url %q, must be http://HOST:PORT, https://HOST:PORT or udp://HOST:PORT", config.URL)
+	}
+
+	if _, _, err := getRetryParameters(config.Retry); err != nil {
+		return nil, fmt.Errorf("influx %s", err)
+	}
+
+	return &influxSink{config: config, url: influxURL}, nil
+}
+
+func (s *influxSink) name() string {
+	return "influx"
+}
+
+// maxBackfillAge is unlimitedBackfill, as points can be written at any time the bucket retains
+func (s *influxSink) maxBackfillAge() time.Duration {
+	return unlimitedBackfill
+}
+
+// metrics converts each table into a "delta", "value", "rate" and "bytes" field, which are written as a single point
+// rate is the difference per second since the last run, and bytes is only included if the table's size was collected
+func (s *influxSink) metrics(report runReport) []metricDatum {
+	var datums []metricDatum
+	for _, delta := range getTableDeltas(report) {
+		dimensions := delta.dimensions()
+		field := func(name string, value float64, unit string, metricType string) {
+			datums = append(datums, metricDatum{Name: name, Dimensions: dimensions, Value: value, Unit: unit, Timestamp: report.CollectedAt, Type: metricType})
+		}
+
+		field("delta", float64(delta.Delta), "Count", metricDelta)
+		if delta.HasCount {
+			field("value", float64(delta.Count), "Count", metricGauge)
+		}
+		if report.Interval > 0 {
+			field("rate", float64(delta.Delta)/report.Interval.Seconds(), "Count/Second", metricGauge)
+		}
+		if delta.HasSize {
+			field("bytes", float64(delta.Size), "Bytes", metricGauge)
+		}
+	}
+
+	return datums
+}
+
+// publish writes the datums as line protocol, to the v2 API or the UDP listener, retrying as configured
+func (s *influxSink) publish(datums []metricDatum) error {
+	lines := s.formatLines(datums)
+
+	err := publishWithRetry(s.config.Retry, s.name(), func() error {
+		if s.url.Scheme == "udp" {
+			return s.writeUDP(lines)
+		}
+		return s.writeHTTP(lines)
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Wrote InfluxDB points", "url", s.config.URL, "points", len(lines), "count", len(datums))
+	return nil
+}
+
+// writeHTTP writes lines to the v2 API's write endpoint, gzipped, with nanosecond timestamps
+// Rejected requests, other than being rate limited, are returned as a permanentError since retrying them won't help
+func (s *influxSink) writeHTTP(lines []string) error {
+	token, err := resolveSecret(s.config.Token)
+	if err != nil {
+		return permanentError{fmt.Errorf("failed to resolve influx.token: %s", err)}
+	}
+
+	var body bytes.Buffer
+	writer := gzip.NewWriter(&body)
+	writer.Write([]byte(strings.Join(lines, "\n")))
+	writer.Close()
+
+	writeURL := *s.url
+	writeURL.Path = strings.TrimSuffix(writeURL.Path, "/") + "/api/v2/write"
+	writeURL.RawQuery = url.Values{"org": {s.config.Org}, "bucket": {s.config.Bucket}, "precision": {"ns"}}.Encode()
+
+	request, err := http.NewRequest(http.MethodPost, writeURL.String(), &body)
+	if err != nil {
+		return permanentError{err}
+	}
+	request.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	request.Header.Set("Content-Encoding", "gzip")
+	if token != "" {
+		request.Header.Set("Authorization", "Token "+token)
+	}
+
+	client := http.Client{Timeout: influxTimeout}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		// Include the start of the response, which usually says which line was rejected and why
+		responseBody, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+		err = fmt.Errorf("%s responded with %s: %s", s.url.Host, response.Status, strings.TrimSpace(string(responseBody)))
+		if response.StatusCode < 500 && response.StatusCode != http.StatusTooManyRequests {
+			return permanentError{err}
+		}
+		return err
+	}
+
+	return nil
+}
+
+// writeUDP sends lines to the UDP listener, batched into packets that fit within a single Ethernet frame
+func (s *influxSink) writeUDP(lines []string) error {
+	conn, err := net.Dial("udp", s.url.Host)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	packets, failures := sendDatagrams(conn, lines, defaultInfluxUDPMTU)
+	if failures > 0 {
+		return fmt.Errorf("%d of %d influx packets failed to send", failures, packets)
+	}
+
+	return nil
+}
+
+// formatLines formats datums as line protocol, such as "rowmetrics,database=shop,kind=increment,table=orders delta=5,value=1200 1700000000000000000"
+// Datums with the same dimensions and timestamp become the fields of a single point, named after each datum, unless the name is repeated
+// Every field is written as a float, so that a field's type never changes between writes
+// Datums without a timestamp, such as run metrics, are written without one, and InfluxDB stamps them as they arrive
+func (s *influxSink) formatLines(datums []metricDatum) []string {
+	// influxPoint is a single line being built, from the datums that share its series and timestamp
+	type influxPoint struct {
+		series    string
+		timestamp string
+		fields    []string
+		names     map[string]bool
+	}
+
+	var points []*influxPoint
+	latest := make(map[string]*influxPoint)
+
+	for _, datum := range datums {
+		// Build the series key from the measurement and tags, adding the configured tags that the datum doesn't already have
+		tags := make(map[string]string)
+		for key, value := range s.config.Tags {
+			tags[key] = value
+		}
+		for _, dimension := range datum.Dimensions {
+			tags[dimension.Name] = dimension.Value
+		}
+
+		series := escapeInfluxName(s.config.Measurement, ", ")
+		for _, tagName := range getSortedKeys(tags) {
+			// InfluxDB expects tags sorted by key, and rejects empty tag values
+			if tags[tagName] != "" {
+				series += "," + escapeInfluxName(tagName, ",= ") + "=" + escapeInfluxName(tags[tagName], ",= ")
+			}
+		}
+
+		timestamp := ""
+		if !datum.Timestamp.IsZero() {
+			timestamp = strconv.FormatInt(datum.Timestamp.UnixNano(), 10)
+		}
+
+		// Add the datum to the latest point for its series, unless that point already has a field of the same name
+		point, ok := latest[series+" "+timestamp]
+		if !ok || point.names[datum.Name] {
+			point = &influxPoint{series: series, timestamp: timestamp, names: make(map[string]bool)}
+			latest[series+" "+timestamp] = point
+			points = append(points, point)
+		}
+		point.names[datum.Name] = true
+		point.fields = append(point.fields, escapeInfluxName(datum.Name, ",= ")+"="+strconv.FormatFloat(datum.Value, 'f', -1, 64))
+	}
+
+	var lines []string
+	for _, point := range points {
+		// Go through each point in the order its first datum came in
+		line := point.series + " " + strings.Join(point.fields, ",")
+		if point.timestamp != "" {
+			line += " " + point.timestamp
+		}
+		lines = append(lines, line)
+	}
+
+	return lines
+}
+
+// escapeInfluxName escapes the characters that have meaning in line protocol, and newlines, which can't be escaped and are replaced
+func escapeInfluxName(name string, special string) string {
+	var escaped strings.Builder
+	for _, r := range strings.ReplaceAll(name, "\n", " ") {
+		if strings.ContainsRune(special, r) {
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(r)
+	}
+
+	return escaped.String()
+}
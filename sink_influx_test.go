@@ -0,0 +1,52 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestInfluxSinkFormatLines(t *testing.T) {
+	s, err := newInfluxSink(influxConfig{URL: "udp://127.0.0.1:8089", Measurement: "row metrics,v2", Tags: map[string]string{"host": "db 1", "database": "overridden", "empty": ""}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	collectedAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	dimensions := []metricDimension{{Name: "database", Value: "shop"}, {Name: "kind", Value: "row"}, {Name: "table", Value: "Order Items,2026=1"}}
+	datums := []metricDatum{
+		{Name: "delta", Dimensions: dimensions, Value: 5, Timestamp: collectedAt},
+		{Name: "value", Dimensions: dimensions, Value: 1.5, Timestamp: collectedAt},
+		// A second datum of the same name can't share the point, so starts another
+		{Name: "delta", Dimensions: dimensions, Value: 6, Timestamp: collectedAt},
+		{Name: "run time", Value: 12},
+	}
+
+	expected := []string{
+		`row\ metrics\,v2,database=shop,host=db\ 1,kind=row,table=Order\ Items\,2026\=1 delta=5,value=1.5 1767323045000000000`,
+		`row\ metrics\,v2,database=shop,host=db\ 1,kind=row,table=Order\ Items\,2026\=1 delta=6 1767323045000000000`,
+		`row\ metrics\,v2,database=overridden,host=db\ 1 run\ time=12`,
+	}
+	if lines := s.formatLines(datums); !reflect.DeepEqual(lines, expected) {
+		t.Errorf("lines are\n%s\nexpected\n%s", lines, expected)
+	}
+}
+
+func TestEscapeInfluxName(t *testing.T) {
+	tests := []struct {
+		name     string
+		special  string
+		expected string
+	}{
+		{name: "Sale", special: ",= ", expected: "Sale"},
+		{name: "a b,c=d", special: ",= ", expected: `a\ b\,c\=d`},
+		{name: "a b,c=d", special: ", ", expected: `a\ b\,c=d`},
+		{name: "two\nlines", special: ",= ", expected: `two\ lines`},
+	}
+
+	for _, test := range tests {
+		if escaped := escapeInfluxName(test.name, test.special); escaped != test.expected {
+			t.Errorf("%q is escaped as %q, expected %q", test.name, escaped, test.expected)
+		}
+	}
+}
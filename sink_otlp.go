@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// defaults for the OTLP configuration
+const (
+	defaultOTLPProtocol     = "grpc"
+	defaultOTLPGRPCEndpoint = "localhost:4317"
+	defaultOTLPHTTPEndpoint = "http://localhost:4318/v1/metrics"
+	// otlpTimeout is how long a single export may take
+	otlpTimeout = 10 * time.Second
+)
+
+// otlpResourceDimensions are the dimensions that describe the database a datum is about, rather than the datum itself
+// They become attributes of the resource the datum is exported under, named after the OpenTelemetry semantic conventions where there is one
+var otlpResourceDimensions = map[string]string{
+	"database": "rowmetrics.database",
+	"dialect":  "db.system",
+}
+
+// otlpDBSystems are the db.system values of each database type, see databaseConfig
+var otlpDBSystems = map[string]string{
+	"mysql":     "mysql",
+	"postgres":  "postgresql",
+	"sqlite":    "sqlite",
+	"sqlserver": "mssql",
+}
+
+// otlpConfig is the configuration of the OTLP sink
+// Protocol is either "grpc" or "http", for HTTP with protobuf bodies, defaulting to defaultOTLPProtocol
+// Endpoint is HOST:PORT for gRPC, or the full URL of the metrics endpoint for HTTP, defaulting to the Collector's default of each
+// Insecure connects over gRPC without TLS, HTTP uses TLS whenever the endpoint is https://
+// Headers are sent with every export, such as an API key, and may reference secrets
+// Resource attributes are added to the resource of every datum, along with service.name and service.instance.id
+type otlpConfig struct {
+	Protocol string
+	Endpoint string
+	Insecure bool
+	Headers  map[string]string
+	Resource map[string]string
+	Retry    retryConfig
+}
+
+// otlpSink exports RowMetrics as OpenTelemetry metrics, to an OpenTelemetry Collector or any other OTLP receiver
+// Each database is its own resource, and each table's counts are data points with the table and kind as attributes
+// started is when the sink was created, which cumulative Sums are exported as having accumulated since
+// startTimes are the start times already exported for each cumulative series, so every point of a series has the same one
+type otlpSink struct {
+	config     otlpConfig
+	instance   string
+	started    time.Time
+	startTimes map[string]time.Time
+}
+
+// newOTLPSink takes the OTLP configuration and creates an otlpSink, filling in the defaults
+// It returns the sink, as well as an error if the protocol or retry configuration is invalid
+func newOTLPSink(config otlpConfig) (*otlpSink, error) {
+	if config.Protocol == "" {
+		config.Protocol = defaultOTLPProtocol
+	}
+
+	switch config.Protocol {
+	case "grpc":
+		if config.Endpoint == "" {
+			config.Endpoint = defaultOTLPGRPCEndpoint
+		}
+	case "http":
+		if config.Endpoint == "" {
+			config.Endpoint = defaultOTLPHTTPEndpoint
+		}
+		if !strings.HasPrefix(config.Endpoint, "http://") && !strings.HasPrefix(config.Endpoint, "https://") {
+			return nil, fmt.Errorf("invalid otlp endpoint %q, must be an http:// or https:// URL when the protocol is http", config.Endpoint)
+		}
+	default:
+		return nil, fmt.Errorf("invalid otlp protocol %q, must be grpc or http", config.Protocol)
+	}
+
+	if _, _, err := getRetryParameters(config.Retry); err != nil {
+		return nil, fmt.Errorf("otlp %s", err)
+	}
+
+	// Identify this host as the instance exporting, as there may be several running rowmetrics
+	instance, _ := os.Hostname()
+
+	return &otlpSink{config: config, instance: instance, started: time.Now(), startTimes: make(map[string]time.Time)}, nil
+}
+
+func (s *otlpSink) name() string {
+	return "otlp"
+}
+
+// maxBackfillAge is unlimitedBackfill, as OTLP points carry their own timestamps, and how far back they are kept is up to the collector
+func (s *otlpSink) maxBackfillAge() time.Duration {
+	return unlimitedBackfill
+}
+
+// metrics converts each table's counts into datums, exported as:
+// rowmetrics.table.delta, a delta Sum of the difference since the last run
+// rowmetrics.table.increment, a cumulative monotonic Sum of the current auto increment value
+// rowmetrics.table.rows, a Gauge of the current row estimate
+// rowmetrics.table.size, a Gauge of the size of the table, if it was collected
+// Each has the database and its dialect as dimensions, which become resource attributes, and the kind and table
+func (s *otlpSink) metrics(report runReport) []metricDatum {
+	var datums []metricDatum
+	for _, delta := range getTableDeltas(report) {
+		dimensions := []metricDimension{
+			{Name: "database", Value: delta.Database},
+			{Name: "dialect", Value: delta.Dialect},
+			{Name: "kind", Value: delta.Kind},
+			{Name: "table", Value: delta.Table},
+		}
+		datums = append(datums, metricDatum{Name: "rowmetrics.table.delta", Dimensions: dimensions, Value: float64(delta.Delta), Unit: "Count", Timestamp: report.CollectedAt, Type: metricDelta, Interval: report.Interval})
+
+		if delta.HasCount {
+			if delta.Kind == "increment" {
+				datums = append(datums, metricDatum{Name: "rowmetrics.table.increment", Dimensions: dimensions, Value: float64(delta.Count), Unit: "Count", Timestamp: report.CollectedAt, Type: metricCumulative})
+			} else {
+				datums = append(datums, metricDatum{Name: "rowmetrics.table.rows", Dimensions: dimensions, Value: float64(delta.Count), Unit: "Count", Timestamp: report.CollectedAt})
+			}
+		}
+		if delta.HasSize {
+			datums = append(datums, metricDatum{Name: "rowmetrics.table.size", Dimensions: dimensions, Value: float64(delta.Size), Unit: "Bytes", Timestamp: report.CollectedAt})
+		}
+	}
+
+	return datums
+}
+
+// publish exports the datums in a single request, over gRPC or HTTP, retrying as configured
+func (s *otlpSink) publish(datums []metricDatum) error {
+	request := s.getExportRequest(datums, time.Now())
+
+	headers := make(map[string]string)
+	for name, value := range s.config.Headers {
+		resolved, err := resolveSecret(value)
+		if err != nil {
+			return fmt.Errorf("failed to resolve otlp.headers.%s: %s", name, err)
+		}
+		headers[name] = resolved
+	}
+
+	err := publishWithRetry(s.config.Retry, s.name(), func() error {
+		if s.config.Protocol == "http" {
+			return s.exportHTTP(request, headers)
+		}
+		return s.exportGRPC(request, headers)
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Exported OTLP metrics", "endpoint", s.config.Endpoint, "protocol", s.config.Protocol, "count", len(datums))
+	return nil
+}
+
+// exportGRPC exports a request to the gRPC metrics service
+// Errors that the OTLP specification doesn't consider retryable are returned as a permanentError
+func (s *otlpSink) exportGRPC(request *colmetricspb.ExportMetricsServiceRequest, headers map[string]string) error {
+	transport := credentials.NewTLS(&tls.Config{})
+	if s.config.Insecure {
+		transport = insecure.NewCredentials()
+	}
+
+	conn, err := grpc.NewClient(s.config.Endpoint, grpc.WithTransportCredentials(transport))
+	if err != nil {
+		return permanentError{err}
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), otlpTimeout)
+	defer cancel()
+	ctx = metadata.NewOutgoingContext(ctx, metadata.New(headers))
+
+	response, err := colmetricspb.NewMetricsServiceClient(conn).Export(ctx, request)
+	if err != nil {
+		switch status.Code(err) {
+		case codes.Canceled, codes.DeadlineExceeded, codes.Aborted, codes.OutOfRange, codes.Unavailable, codes.DataLoss, codes.ResourceExhausted:
+			return err
+		}
+		return permanentError{err}
+	}
+
+	if rejected := response.GetPartialSuccess().GetRejectedDataPoints(); rejected > 0 {
+		// Retrying would only duplicate the data points that were accepted
+		slog.Warn("OTLP receiver rejected some data points", "endpoint", s.config.Endpoint, "rejected", rejected, "message", response.GetPartialSuccess().GetErrorMessage())
+	}
+
+	return nil
+}
+
+// exportHTTP exports a request to the HTTP metrics endpoint, as a protobuf body
+// Responses that the OTLP specification doesn't consider retryable are returned as a permanentError
+func (s *otlpSink) exportHTTP(request *colmetricspb.ExportMetricsServiceRequest, headers map[string]string) error {
+	body, err := proto.Marshal(request)
+	if err != nil {
+		return permanentError{err}
+	}
+
+	httpRequest, err := http.NewRequest(http.MethodPost, s.config.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	httpRequest.Header.Set("Content-Type", "application/x-protobuf")
+	for name, value := range headers {
+		httpRequest.Header.Set(name, value)
+	}
+
+	client := http.Client{Timeout: otlpTimeout}
+	response, err := client.Do(httpRequest)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		responseBody, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+		err = fmt.Errorf("%s responded with %s: %s", httpRequest.URL.Host, response.Status, strings.TrimSpace(string(responseBody)))
+		switch response.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return err
+		}
+		return permanentError{err}
+	}
+
+	return nil
+}
+
+// getExportRequest converts datums into an export request, grouping them by resource and then by metric
+// The resource of a datum is the configured attributes, along with its database and dialect dimensions, see otlpResourceDimensions
+// Datums without a timestamp, such as run metrics, are stamped with now
+// Cumulative Sums start when the sink was created, or at the first point exported of the series if that was earlier, as when replaying
+func (s *otlpSink) getExportRequest(datums []metricDatum, now time.Time) *colmetricspb.ExportMetricsServiceRequest {
+	var (
+		resourceKeys []string
+		resources    = make(map[string]*metricspb.ResourceMetrics)
+		metrics      = make(map[string]*metricspb.Metric)
+	)
+
+	for _, datum := range datums {
+		// Split the dimensions into those of the resource and those of the data point
+		resourceAttributes := map[string]string{"service.name": "rowmetrics", "service.instance.id": s.instance}
+		for name, value := range s.config.Resource {
+			resourceAttributes[name] = value
+		}
+
+		var pointAttributes []*commonpb.KeyValue
+		for _, dimension := range datum.Dimensions {
+			if attribute, ok := otlpResourceDimensions[dimension.Name]; ok {
+				if dimension.Name == "dialect" {
+					dimension.Value = otlpDBSystems[dimension.Value]
+				}
+				if dimension.Value != "" {
+					resourceAttributes[attribute] = dimension.Value
+				}
+				continue
+			}
+			pointAttributes = append(pointAttributes, getOTLPAttribute(dimension.Name, dimension.Value))
+		}
+
+		var attributes []*commonpb.KeyValue
+		for _, name := range getSortedKeys(resourceAttributes) {
+			attributes = append(attributes, getOTLPAttribute(name, resourceAttributes[name]))
+		}
+
+		resourceKey := fmt.Sprint(attributes)
+		resourceMetrics, ok := resources[resourceKey]
+		if !ok {
+			resourceMetrics = &metricspb.ResourceMetrics{
+				Resource:     &resourcepb.Resource{Attributes: attributes},
+				ScopeMetrics: []*metricspb.ScopeMetrics{{Scope: &commonpb.InstrumentationScope{Name: "rowmetrics"}}},
+			}
+			resources[resourceKey] = resourceMetrics
+			resourceKeys = append(resourceKeys, resourceKey)
+		}
+
+		// Add the data point to its metric within the resource, creating the metric if this is its first data point
+		timestamp := datum.Timestamp
+		if timestamp.IsZero() {
+			timestamp = now
+		}
+		point := &metricspb.NumberDataPoint{
+			Attributes:   pointAttributes,
+			TimeUnixNano: uint64(timestamp.UnixNano()),
+			Value:        &metricspb.NumberDataPoint_AsDouble{AsDouble: datum.Value},
+		}
+		metricKey := resourceKey + "\x00" + datum.Name
+		switch {
+		case datum.Type == metricCumulative:
+			seriesKey := metricKey + "\x00" + fmt.Sprint(pointAttributes)
+			start, ok := s.startTimes[seriesKey]
+			if !ok {
+				start = s.started
+				if timestamp.Before(start) {
+					start = timestamp
+				}
+				s.startTimes[seriesKey] = start
+			}
+			point.StartTimeUnixNano = uint64(start.UnixNano())
+		case datum.Interval > 0:
+			point.StartTimeUnixNano = uint64(timestamp.Add(-datum.Interval).UnixNano())
+		}
+
+		metric, ok := metrics[metricKey]
+		if !ok {
+			metric = &metricspb.Metric{Name: datum.Name, Unit: getOTLPUnit(datum.Unit)}
+			switch datum.Type {
+			case metricDelta:
+				metric.Data = &metricspb.Metric_Sum{Sum: &metricspb.Sum{AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA}}
+			case metricCumulative:
+				metric.Data = &metricspb.Metric_Sum{Sum: &metricspb.Sum{AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE, IsMonotonic: true}}
+			default:
+				metric.Data = &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{}}
+			}
+			metrics[metricKey] = metric
+			resourceMetrics.ScopeMetrics[0].Metrics = append(resourceMetrics.ScopeMetrics[0].Metrics, metric)
+		}
+
+		if sum := metric.GetSum(); sum != nil {
+			sum.DataPoints = append(sum.DataPoints, point)
+		} else {
+			metric.GetGauge().DataPoints = append(metric.GetGauge().DataPoints, point)
+		}
+	}
+
+	// Keep the resources in the order their first datum came in, so requests are stable between runs
+	request := &colmetricspb.ExportMetricsServiceRequest{}
+	for _, resourceKey := range resourceKeys {
+		request.ResourceMetrics = append(request.ResourceMetrics, resources[resourceKey])
+	}
+
+	return request
+}
+
+// getOTLPAttribute creates a string attribute
+func getOTLPAttribute(name string, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: name, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
+
+// getOTLPUnit converts the unit of a datum, as CloudWatch names it, into the UCUM unit OpenTelemetry expects
+func getOTLPUnit(unit string) string {
+	switch unit {
+	case "Seconds":
+		return "s"
+	case "Milliseconds":
+		return "ms"
+	case "Bytes":
+		return "By"
+	case "Count/Second":
+		return "1/s"
+	case "Days":
+		return "d"
+	default:
+		return "1"
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// getOTLPMetrics decodes an export request posted to the HTTP endpoint, and returns its metrics by name
+func getOTLPMetrics(t *testing.T, body string) map[string]*metricspb.Metric {
+	t.Helper()
+
+	var request colmetricspb.ExportMetricsServiceRequest
+	if err := proto.Unmarshal([]byte(body), &request); err != nil {
+		t.Fatalf("body isn't an export request: %s", err)
+	}
+
+	metrics := make(map[string]*metricspb.Metric)
+	for _, resourceMetrics := range request.ResourceMetrics {
+		for _, scopeMetrics := range resourceMetrics.ScopeMetrics {
+			for _, metric := range scopeMetrics.Metrics {
+				metrics[metric.Name] = metric
+			}
+		}
+	}
+
+	return metrics
+}
+
+func TestOTLPSinkExportHTTP(t *testing.T) {
+	server := newNotificationServer(t)
+	s, err := newOTLPSink(otlpConfig{Protocol: "http", Endpoint: server.URL + "/v1/metrics"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	collectedAt := s.started.Add(time.Second)
+	report := runReport{
+		CollectedAt: collectedAt,
+		Interval:    time.Minute,
+		Current: map[string]countCollection{
+			"shop": {Increment: map[string]int{"Sale": 120}, Row: map[string]int{"Product": 30}, Dialect: "mysql", Sizes: map[string]int64{"Sale": 4096}},
+		},
+		Differences: map[string]countCollection{
+			"shop": {Increment: map[string]int{"Sale": 60}, Row: map[string]int{"Product": 2}},
+		},
+	}
+
+	// Publish two runs, the second a minute after the first
+	if err := s.publish(s.metrics(report)); err != nil {
+		t.Fatalf("publish returned an error: %s", err)
+	}
+	report.CollectedAt = collectedAt.Add(time.Minute)
+	report.Current["shop"].Increment["Sale"] = 150
+	if err := s.publish(s.metrics(report)); err != nil {
+		t.Fatalf("publish returned an error: %s", err)
+	}
+
+	requests := server.received()
+	if len(requests) != 2 {
+		t.Fatalf("received %d requests, expected 2", len(requests))
+	}
+	if contentType := requests[0].header.Get("Content-Type"); contentType != "application/x-protobuf" {
+		t.Errorf("Content-Type header is %q, expected protobuf", contentType)
+	}
+
+	first, second := getOTLPMetrics(t, requests[0].body), getOTLPMetrics(t, requests[1].body)
+
+	delta := first["rowmetrics.table.delta"].GetSum()
+	if delta == nil || delta.AggregationTemporality != metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA || delta.IsMonotonic {
+		t.Fatalf("rowmetrics.table.delta is %v, expected a delta Sum", first["rowmetrics.table.delta"])
+	}
+	if point := delta.DataPoints[0]; point.StartTimeUnixNano != uint64(collectedAt.Add(-time.Minute).UnixNano()) || point.TimeUnixNano != uint64(collectedAt.UnixNano()) {
+		t.Errorf("rowmetrics.table.delta point is %v, expected it to span the interval", point)
+	}
+
+	for _, metrics := range []map[string]*metricspb.Metric{first, second} {
+		increment := metrics["rowmetrics.table.increment"].GetSum()
+		if increment == nil || increment.AggregationTemporality != metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE || !increment.IsMonotonic {
+			t.Fatalf("rowmetrics.table.increment is %v, expected a cumulative monotonic Sum", metrics["rowmetrics.table.increment"])
+		}
+		if start := increment.DataPoints[0].StartTimeUnixNano; start != uint64(s.started.UnixNano()) {
+			t.Errorf("rowmetrics.table.increment starts at %d, expected the sink's start time in every request", start)
+		}
+	}
+	if value := second["rowmetrics.table.increment"].GetSum().DataPoints[0].GetAsDouble(); value != 150 {
+		t.Errorf("rowmetrics.table.increment is %g, expected the second run's value", value)
+	}
+
+	for _, name := range []string{"rowmetrics.table.rows", "rowmetrics.table.size"} {
+		if first[name].GetGauge() == nil {
+			t.Errorf("%s is %v, expected a Gauge", name, first[name])
+		}
+	}
+}
+
+func TestOTLPSinkCumulativeStartReplay(t *testing.T) {
+	s, err := newOTLPSink(otlpConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replayed points are older than the sink, so the series starts at the first of them instead
+	collectedAt := s.started.Add(-48 * time.Hour)
+	datums := []metricDatum{
+		{Name: "rowmetrics.table.increment", Dimensions: []metricDimension{{Name: "table", Value: "Sale"}}, Value: 100, Timestamp: collectedAt, Type: metricCumulative},
+	}
+	later := []metricDatum{datums[0]}
+	later[0].Timestamp = collectedAt.Add(time.Hour)
+	later[0].Value = 110
+
+	for _, batch := range [][]metricDatum{datums, later} {
+		request := s.getExportRequest(batch, time.Now())
+		point := request.ResourceMetrics[0].ScopeMetrics[0].Metrics[0].GetSum().DataPoints[0]
+		if point.StartTimeUnixNano != uint64(collectedAt.UnixNano()) {
+			t.Errorf("point %v starts at %d, expected the first replayed point's time", point, point.StartTimeUnixNano)
+		}
+	}
+}
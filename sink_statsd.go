@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaults for the statsd configuration
+const (
+	defaultStatsdAddress = "127.0.0.1:8125"
+	defaultStatsdPrefix  = "rowmetrics"
+	// defaultStatsdUDPMTU keeps each packet within a single Ethernet frame, after the IP and UDP headers
+	defaultStatsdUDPMTU = 1432
+	// defaultStatsdUnixMTU is the largest datagram the DogStatsD agent reads from its Unix socket by default
+	defaultStatsdUnixMTU = 8192
+)
+
+// statsdConfig is the configuration of the statsd sink
+// Address is either HOST:PORT for UDP, or unix:///path/to/socket for a Unix datagram socket, defaulting to defaultStatsdAddress
+// Prefix is prepended to every metric name, defaulting to defaultStatsdPrefix
+// DogStatsD sends dimensions as tags, along with Tags, instead of as part of the metric name
+// MTU is the largest packet sent, metrics are batched into as few packets as fit
+type statsdConfig struct {
+	Address   string
+	Prefix    string
+	Tags      map[string]string
+	DogStatsD bool `yaml:"dogstatsd"`
+	MTU       int  `yaml:"mtu"`
+}
+
+// statsdSink publishes RowMetrics to a statsd server, or a DogStatsD agent
+// Each table's difference is a counter, and its current value a gauge
+type statsdSink struct {
+	config  statsdConfig
+	network string
+	address string
+	mtu     int
+}
+
+// newStatsdSink takes the statsd configuration and creates a statsdSink, filling in the defaults
+// It returns the sink, as well as an error if the address or MTU is invalid
+func newStatsdSink(config statsdConfig) (*statsdSink, error) {
+	if config.Address == "" {
+		config.Address = defaultStatsdAddress
+	}
+	if config.Prefix == "" {
+		config.Prefix = defaultStatsdPrefix
+	}
+
+	network, address, mtu := "udp", config.Address, defaultStatsdUDPMTU
+	for _, scheme := range []string{"unix://", "unixgram://"} {
+		if path := strings.TrimPrefix(config.Address, scheme); path != config.Address {
+			network, address, mtu = "unixgram", path, defaultStatsdUnixMTU
+		}
+	}
+
+	if network == "udp" {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return nil, fmt.Errorf("invalid statsd address %q, must be HOST:PORT or unix:///path/to/socket", config.Address)
+		}
+	}
+
+	if config.MTU < 0 {
+		return nil, fmt.Errorf("invalid statsd mtu %d, must be positive", config.MTU)
+	}
+	if config.MTU > 0 {
+		mtu = config.MTU
+	}
+
+	return &statsdSink{config: config, network: network, address: address, mtu: mtu}, nil
+}
+
+func (s *statsdSink) name() string {
+	return "statsd"
+}
+
+// maxBackfillAge is noBackfill, as statsd has no notion of timestamps
+func (s *statsdSink) maxBackfillAge() time.Duration {
+	return noBackfill
+}
+
+// metrics converts each table into a "table.delta" counter of its difference, and a "table.value" gauge of its current value
+// Both have the database, kind and table as dimensions
+func (s *statsdSink) metrics(report runReport) []metricDatum {
+	var datums []metricDatum
+	for _, delta := range getTableDeltas(report) {
+		dimensions := delta.dimensions()
+		datums = append(datums, metricDatum{Name: "table.delta", Dimensions: dimensions, Value: float64(delta.Delta), Unit: "Count", Type: metricDelta})
+		if delta.HasCount {
+			datums = append(datums, metricDatum{Name: "table.value", Dimensions: dimensions, Value: float64(delta.Count), Unit: "Count"})
+		}
+	}
+
+	return datums
+}
+
+// publish sends each datum to the statsd server, batched into packets no larger than the MTU
+// Deltas are sent as counters and everything else as gauges, without timestamps, which statsd has no notion of
+func (s *statsdSink) publish(datums []metricDatum) error {
+	conn, err := net.Dial(s.network, s.address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var lines []string
+	for _, datum := range datums {
+		lines = append(lines, s.formatLines(datum)...)
+	}
+	packets, failures := sendDatagrams(conn, lines, s.mtu)
+
+	slog.Info("Sent statsd metrics", "address", s.config.Address, "count", len(datums), "packets", packets, "failures", failures)
+
+	if failures > 0 {
+		return fmt.Errorf("%d of %d statsd packets failed to send", failures, packets)
+	}
+
+	return nil
+}
+
+// formatLines formats a datum as the statsd lines to send, such as "rowmetrics.table.delta:5|c|#database:shop"
+// Without DogStatsD, the dimension values become part of the name instead, such as "rowmetrics.shop.increment.orders.table.delta:5|c"
+// A negative gauge is sent as two lines, resetting it to 0 first, since plain statsd reads a leading sign as a change to the gauge
+func (s *statsdSink) formatLines(datum metricDatum) []string {
+	metricType := "g"
+	if datum.Type == metricDelta {
+		metricType = "c"
+	}
+	value := strconv.FormatFloat(datum.Value, 'f', -1, 64)
+
+	if s.config.DogStatsD {
+		var tags []string
+		for _, dimension := range datum.Dimensions {
+			tags = append(tags, sanitizeStatsdTag(dimension.Name)+":"+sanitizeStatsdTag(dimension.Value))
+		}
+		for _, key := range getSortedKeys(s.config.Tags) {
+			tags = append(tags, sanitizeStatsdTag(key)+":"+sanitizeStatsdTag(s.config.Tags[key]))
+		}
+
+		line := sanitizeStatsdName(s.config.Prefix+"."+datum.Name) + ":" + value + "|" + metricType
+		if len(tags) > 0 {
+			line += "|#" + strings.Join(tags, ",")
+		}
+		return []string{line}
+	}
+
+	// Each dimension value is a single level of the name, so dots within it are replaced
+	parts := []string{s.config.Prefix}
+	for _, dimension := range datum.Dimensions {
+		parts = append(parts, strings.ReplaceAll(dimension.Value, ".", "_"))
+	}
+	name := sanitizeStatsdName(strings.Join(append(parts, datum.Name), "."))
+
+	if metricType == "g" && datum.Value < 0 {
+		return []string{name + ":0|g", name + ":" + value + "|g"}
+	}
+	return []string{name + ":" + value + "|" + metricType}
+}
+
+// sanitizeStatsdName replaces any character in a metric name that statsd servers don't accept with an underscore
+func sanitizeStatsdName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// sanitizeStatsdTag replaces the characters that separate DogStatsD tags and fields in a tag key or value with an underscore
+func sanitizeStatsdTag(tag string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ',' || r == '|' || r == '#' || r == '\n' || r == ' ' {
+			return '_'
+		}
+		return r
+	}, tag)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStatsdSinkFormatLines(t *testing.T) {
+	dimensions := []metricDimension{{Name: "database", Value: "shop.eu"}, {Name: "kind", Value: "increment"}, {Name: "table", Value: "Sale,Items|#1"}}
+
+	tests := []struct {
+		name     string
+		config   statsdConfig
+		datum    metricDatum
+		expected []string
+	}{
+		{
+			name:     "dogstatsd counter",
+			config:   statsdConfig{DogStatsD: true},
+			datum:    metricDatum{Name: "table.delta", Dimensions: dimensions, Value: 5, Type: metricDelta},
+			expected: []string{"rowmetrics.table.delta:5|c|#database:shop.eu,kind:increment,table:Sale_Items__1"},
+		},
+		{
+			name:     "dogstatsd tags",
+			config:   statsdConfig{DogStatsD: true, Prefix: "shop", Tags: map[string]string{"region": "eu west", "env": "prod"}},
+			datum:    metricDatum{Name: "table.value", Dimensions: dimensions[:1], Value: -2},
+			expected: []string{"shop.table.value:-2|g|#database:shop.eu,env:prod,region:eu_west"},
+		},
+		{
+			name:     "dogstatsd without tags",
+			config:   statsdConfig{DogStatsD: true},
+			datum:    metricDatum{Name: "Heartbeat", Value: 1},
+			expected: []string{"rowmetrics.Heartbeat:1|g"},
+		},
+		{
+			name:     "plain",
+			config:   statsdConfig{},
+			datum:    metricDatum{Name: "table.delta", Dimensions: dimensions, Value: 5, Type: metricDelta},
+			expected: []string{"rowmetrics.shop_eu.increment.Sale_Items__1.table.delta:5|c"},
+		},
+		{
+			name:     "plain negative gauge",
+			config:   statsdConfig{},
+			datum:    metricDatum{Name: "table.value", Dimensions: dimensions[:1], Value: -2},
+			expected: []string{"rowmetrics.shop_eu.table.value:0|g", "rowmetrics.shop_eu.table.value:-2|g"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := newStatsdSink(test.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if lines := s.formatLines(test.datum); !reflect.DeepEqual(lines, test.expected) {
+				t.Errorf("lines are %q, expected %q", lines, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestGetSinksCloudWatch(t *testing.T) {
+	textfile := &textfileConfig{Path: filepath.Join(t.TempDir(), "rowmetrics.prom")}
+
+	tests := []struct {
+		name     string
+		config   applicationConfig
+		expected []string
+	}{
+		{name: "no sinks", config: applicationConfig{}, expected: []string{"cloudwatch"}},
+		{name: "another sink", config: applicationConfig{Textfile: textfile}, expected: []string{"cloudwatch", "textfile"}},
+		{name: "aws section", config: applicationConfig{AwsConfig: map[string]string{"region": "us-east-1"}, Textfile: textfile}, expected: []string{"cloudwatch", "textfile"}},
+		{name: "disabled", config: applicationConfig{AwsConfig: map[string]string{"enabled": "false"}, Textfile: textfile}, expected: []string{"textfile"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sinks, err := getSinks(test.config)
+			if err != nil {
+				t.Fatalf("getSinks returned an error: %s", err)
+			}
+
+			var names []string
+			for _, sink := range sinks {
+				names = append(names, sink.name())
+			}
+			if !reflect.DeepEqual(names, test.expected) {
+				t.Errorf("sinks are %v, expected %v", names, test.expected)
+			}
+		})
+	}
+
+	if _, err := getSinks(applicationConfig{AwsConfig: map[string]string{"enabled": "sometimes"}}); err == nil {
+		t.Errorf("getSinks accepted an invalid aws.enabled")
+	}
+}
+
+func TestGetTableDeltas(t *testing.T) {
+	report := runReport{
+		Current: map[string]countCollection{
+			"shop": {Increment: map[string]int{"Sale": 9}, Row: map[string]int{}, Dialect: "mysql", Sizes: map[string]int64{"Sale": 4096}},
+			"edge": {Increment: map[string]int{}, Row: map[string]int{"Product": 3}, Dialect: "sqlite"},
+		},
+		Differences: map[string]countCollection{
+			"shop": {Increment: map[string]int{"Sale": 2, "Msg": 1}, Row: map[string]int{"Sale": 0}},
+			"edge": {Increment: map[string]int{}, Row: map[string]int{"Product": -1}},
+		},
+	}
+
+	// Msg and the row count of Sale weren't collected this run, so only have a delta
+	expected := []tableDelta{
+		{Database: "edge", Dialect: "sqlite", Kind: "row", Table: "Product", Delta: -1, Count: 3, HasCount: true},
+		{Database: "shop", Dialect: "mysql", Kind: "increment", Table: "Msg", Delta: 1},
+		{Database: "shop", Dialect: "mysql", Kind: "increment", Table: "Sale", Delta: 2, Count: 9, HasCount: true, Size: 4096, HasSize: true},
+		{Database: "shop", Dialect: "mysql", Kind: "row", Table: "Sale", Delta: 0, Size: 4096, HasSize: true},
+	}
+
+	deltas := getTableDeltas(report)
+	if !reflect.DeepEqual(deltas, expected) {
+		t.Errorf("deltas are %+v, expected %+v", deltas, expected)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// defaultTextfilePrefix is prepended to every metric name when no prefix is configured
+const defaultTextfilePrefix = "rowmetrics"
+
+// textfileConfig is the configuration of the node_exporter textfile sink
+// Path is the file to write, which must end in .prom and be in node_exporter's --collector.textfile.directory
+// Prefix is prepended to every metric name, defaulting to defaultTextfilePrefix
+type textfileConfig struct {
+	Path   string
+	Prefix string
+}
+
+// textfileSink writes RowMetrics in the Prometheus text format, for node_exporter's textfile collector to expose
+// The file is rewritten with everything published during the run each time publish is called, so the run metrics don't replace the table metrics
+type textfileSink struct {
+	config textfileConfig
+	series map[string]textfileSample
+	order  []string
+}
+
+// textfileSample is a single sample in the file, and the time the value it came from was collected
+type textfileSample struct {
+	name      string
+	labels    string
+	value     float64
+	timestamp time.Time
+}
+
+// newTextfileSink takes the textfile configuration and creates a textfileSink, filling in the defaults
+// It returns the sink, as well as an error if the path isn't a .prom file
+func newTextfileSink(config textfileConfig) (*textfileSink, error) {
+	if !strings.HasSuffix(config.Path, ".prom") {
+		return nil, fmt.Errorf("invalid textfile path %q, node_exporter only reads files ending in .prom", config.Path)
+	}
+	if config.Prefix == "" {
+		config.Prefix = defaultTextfilePrefix
+	}
+
+	return &textfileSink{config: config, series: make(map[string]textfileSample)}, nil
+}
+
+func (s *textfileSink) name() string {
+	return "textfile"
+}
+
+// maxBackfillAge is noBackfill, as the textfile collector rejects samples with timestamps
+func (s *textfileSink) maxBackfillAge() time.Duration {
+	return noBackfill
+}
+
+// metrics converts each table into a "table_delta" sample of its difference, a "table_value" sample of its current value,
+// and a "table_size_bytes" sample of its size, if it was collected, all with the database, kind and table as labels
+func (s *textfileSink) metrics(report runReport) []metricDatum {
+	var datums []metricDatum
+	for _, delta := range getTableDeltas(report) {
+		dimensions := delta.dimensions()
+		datums = append(datums, metricDatum{Name: "TableDelta", Dimensions: dimensions, Value: float64(delta.Delta), Unit: "Count", Timestamp: report.CollectedAt, Type: metricDelta})
+		if delta.HasCount {
+			datums = append(datums, metricDatum{Name: "TableValue", Dimensions: dimensions, Value: float64(delta.Count), Unit: "Count", Timestamp: report.CollectedAt})
+		}
+		if delta.HasSize {
+			datums = append(datums, metricDatum{Name: "TableSize", Dimensions: dimensions, Value: float64(delta.Size), Unit: "Bytes", Timestamp: report.CollectedAt})
+		}
+	}
+
+	return datums
+}
+
+// publish adds the datums to those already published this run, and atomically rewrites the file with all of them
+// A datum with the same name and dimensions as an earlier one replaces it
+func (s *textfileSink) publish(datums []metricDatum) error {
+	for _, datum := range datums {
+		sample := s.getSample(datum)
+		key := sample.name + sample.labels
+		if _, ok := s.series[key]; !ok {
+			s.order = append(s.order, key)
+		}
+		s.series[key] = sample
+	}
+
+	err := writeFileAtomic(s.config.Path, []byte(s.format(time.Now())), false)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Wrote node_exporter textfile", "path", s.config.Path, "count", len(datums), "series", len(s.series))
+	return nil
+}
+
+// format formats every sample as the Prometheus text format, grouped by metric name with a TYPE line for each
+// Samples have no timestamps, which the textfile collector rejects, so the latest collection time is a sample of its own,
+// as is the time the file was written, as last_success_timestamp_seconds
+func (s *textfileSink) format(now time.Time) string {
+	var (
+		names     []string
+		byName    = make(map[string][]textfileSample)
+		collected time.Time
+	)
+	for _, key := range s.order {
+		sample := s.series[key]
+		if _, ok := byName[sample.name]; !ok {
+			names = append(names, sample.name)
+		}
+		byName[sample.name] = append(byName[sample.name], sample)
+
+		if sample.timestamp.After(collected) {
+			collected = sample.timestamp
+		}
+	}
+	sort.Strings(names)
+
+	var builder strings.Builder
+	writeSample := func(name string, labels string, value float64) {
+		builder.WriteString(name + labels + " " + formatPrometheusValue(value) + "\n")
+	}
+
+	for _, name := range names {
+		fmt.Fprintf(&builder, "# TYPE %s gauge\n", name)
+		for _, sample := range byName[name] {
+			writeSample(sample.name, sample.labels, sample.value)
+		}
+	}
+
+	if !collected.IsZero() {
+		name := getPrometheusName(s.config.Prefix) + "_collected_timestamp_seconds"
+		fmt.Fprintf(&builder, "# HELP %s When the counts in this file were collected.\n# TYPE %s gauge\n", name, name)
+		writeSample(name, "", float64(collected.UnixNano())/1e9)
+	}
+
+	name := getPrometheusName(s.config.Prefix) + "_last_success_timestamp_seconds"
+	fmt.Fprintf(&builder, "# HELP %s When rowmetrics last wrote this file.\n# TYPE %s gauge\n", name, name)
+	writeSample(name, "", float64(now.UnixNano())/1e9)
+
+	return builder.String()
+}
+
+// getSample converts a datum into a sample, named after the prefix, the datum's name and its unit
+// Milliseconds are converted into seconds, as Prometheus expects base units
+func (s *textfileSink) getSample(datum metricDatum) textfileSample {
+	name := getPrometheusName(s.config.Prefix) + "_" + getPrometheusName(datum.Name)
+	value := datum.Value
+
+	switch datum.Unit {
+	case "Milliseconds":
+		name += "_seconds"
+		value /= 1000
+	case "Seconds":
+		// Names such as SecondsSinceLastRun already say their unit
+		if !strings.Contains(name, "_seconds") {
+			name += "_seconds"
+		}
+	case "Bytes":
+		name += "_bytes"
+	}
+
+	var labels []string
+	for _, dimension := range datum.Dimensions {
+		labels = append(labels, getPrometheusName(dimension.Name)+"=\""+escapePrometheusLabel(dimension.Value)+"\"")
+	}
+
+	formattedLabels := ""
+	if len(labels) > 0 {
+		formattedLabels = "{" + strings.Join(labels, ",") + "}"
+	}
+
+	return textfileSample{name: name, labels: formattedLabels, value: value, timestamp: datum.Timestamp}
+}
+
+// getPrometheusName converts a name, such as "SecondsSinceLastRun" or "DBInstanceIdentifier", into a snake case Prometheus name
+// such as "seconds_since_last_run" or "db_instance_identifier", replacing any character Prometheus doesn't allow with an underscore
+func getPrometheusName(name string) string {
+	runes := []rune(name)
+
+	var builder strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) && i > 0 {
+			// Start a new word at a capital after a lowercase letter, or at the last capital of an acronym
+			previousLower := unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1])
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if previousLower || (unicode.IsUpper(runes[i-1]) && nextLower) {
+				builder.WriteRune('_')
+			}
+		}
+
+		r = unicode.ToLower(r)
+		if r >= 'a' && r <= 'z' || r == '_' || r == ':' || (r >= '0' && r <= '9' && i > 0) {
+			builder.WriteRune(r)
+		} else {
+			builder.WriteRune('_')
+		}
+	}
+
+	return builder.String()
+}
+
+// escapePrometheusLabel escapes a label value for the Prometheus text format
+func escapePrometheusLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// formatPrometheusValue formats a sample value, including the special values Prometheus spells differently to Go
+func formatPrometheusValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
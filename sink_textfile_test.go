@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTextfileSinkPublish(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rowmetrics.prom")
+	s, err := newTextfileSink(textfileConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	collectedAt := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	report := runReport{
+		CollectedAt: collectedAt,
+		Interval:    time.Minute,
+		Current:     map[string]countCollection{"shop": {Increment: map[string]int{"Sale": 120}, Row: map[string]int{}, Sizes: map[string]int64{"Sale": 4096}}},
+		Differences: map[string]countCollection{"shop": {Increment: map[string]int{"Sale": 60}, Row: map[string]int{}}},
+	}
+
+	// The run metrics are published after the table metrics, and must not replace them
+	if err := s.publish(s.metrics(report)); err != nil {
+		t.Fatalf("publish returned an error: %s", err)
+	}
+	runMetrics := []metricDatum{{Name: "QueryLatency", Dimensions: []metricDimension{{Name: "database", Value: "shop"}, {Name: "query", Value: `say "hi"`}}, Value: 250, Unit: "Milliseconds"}}
+	if err := s.publish(runMetrics); err != nil {
+		t.Fatalf("publish returned an error: %s", err)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "rowmetrics.prom" {
+		t.Errorf("directory has %d files, expected only the renamed file", len(files))
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+
+	expected := []string{
+		`# TYPE rowmetrics_query_latency_seconds gauge`,
+		`rowmetrics_query_latency_seconds{database="shop",query="say \"hi\""} 0.25`,
+		`# TYPE rowmetrics_table_delta gauge`,
+		`rowmetrics_table_delta{database="shop",kind="increment",table="Sale"} 60`,
+		`# TYPE rowmetrics_table_size_bytes gauge`,
+		`rowmetrics_table_size_bytes{database="shop",kind="increment",table="Sale"} 4096`,
+		`# TYPE rowmetrics_table_value gauge`,
+		`rowmetrics_table_value{database="shop",kind="increment",table="Sale"} 120`,
+		`# HELP rowmetrics_collected_timestamp_seconds When the counts in this file were collected.`,
+		`# TYPE rowmetrics_collected_timestamp_seconds gauge`,
+		`rowmetrics_collected_timestamp_seconds 1767323045`,
+		`# HELP rowmetrics_last_success_timestamp_seconds When rowmetrics last wrote this file.`,
+		`# TYPE rowmetrics_last_success_timestamp_seconds gauge`,
+	}
+	if len(lines) != len(expected)+1 {
+		t.Fatalf("file is\n%s\nexpected %d lines", content, len(expected)+1)
+	}
+	for i, line := range expected {
+		if lines[i] != line {
+			t.Errorf("line %d is %q, expected %q", i+1, lines[i], line)
+		}
+	}
+	if last := lines[len(lines)-1]; !strings.HasPrefix(last, "rowmetrics_last_success_timestamp_seconds ") {
+		t.Errorf("last line is %q, expected when the file was written", last)
+	}
+}
+
+func TestGetPrometheusName(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{name: "SecondsSinceLastRun", expected: "seconds_since_last_run"},
+		{name: "DBInstanceIdentifier", expected: "db_instance_identifier"},
+		{name: "row metrics.v2", expected: "row_metrics_v2"},
+		{name: "2xx", expected: "_xx"},
+	}
+
+	for _, test := range tests {
+		if name := getPrometheusName(test.name); name != test.expected {
+			t.Errorf("%q is converted to %q, expected %q", test.name, name, test.expected)
+		}
+	}
+}
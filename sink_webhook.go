@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// defaults for the webhook sink configuration
+const (
+	// defaultWebhookSinkTemplate is the body posted when no template is configured, the whole payload as JSON
+	defaultWebhookSinkTemplate    = `{{json .}}`
+	defaultWebhookSignatureHeader = "X-Rowmetrics-Signature"
+	// webhookTimestampHeader is the header the time a request was signed is sent in, as Unix seconds
+	webhookTimestampHeader = "X-Rowmetrics-Timestamp"
+	// webhookSinkTimeout is how long a single post may take
+	webhookSinkTimeout = 10 * time.Second
+)
+
+// webhookSinkConfig is the configuration of the webhook sink
+// URL is where each run's results are posted, and may reference a secret
+// Headers are sent with every post, defaulting to a Content-Type of "application/json", and their values may reference secrets
+// Template is a text/template the body is rendered from, executed with a webhookPayload, defaulting to the payload as JSON
+// Secret signs every post with an HMAC-SHA256 in SignatureHeader, and may reference a secret
+// BatchSize is the most tables posted in a single request, or 0 to post every table at once
+// RunMetrics also posts the run metrics, which are otherwise left out, in a post of their own after the tables
+type webhookSinkConfig struct {
+	URL             string `yaml:"url"`
+	Headers         map[string]string
+	Template        string
+	Secret          string
+	SignatureHeader string `yaml:"signatureHeader"`
+	BatchSize       int    `yaml:"batchSize"`
+	RunMetrics      bool   `yaml:"runMetrics"`
+	Retry           retryConfig
+}
+
+// webhookPayload is what the body of each post is rendered from
+// RunID is the ID of the run the post is from, as its log lines are tagged with
+// Batch is the number of this post among the Batches the run's tables were split into, starting at 1
+// IntervalSeconds is the time since the last run the differences accumulated over, or 0 in a post of run metrics
+type webhookPayload struct {
+	Host            string          `json:"host"`
+	RunID           string          `json:"runId"`
+	CollectedAt     time.Time       `json:"collectedAt"`
+	IntervalSeconds float64         `json:"intervalSeconds"`
+	Batch           int             `json:"batch"`
+	Batches         int             `json:"batches"`
+	Tables          []webhookTable  `json:"tables"`
+	Metrics         []webhookMetric `json:"metrics"`
+}
+
+// webhookTable is a single table's results in a webhookPayload
+// Value is its current count, Rate its difference per second, and Bytes its size, each nil if it isn't known
+type webhookTable struct {
+	Database string   `json:"database"`
+	Kind     string   `json:"kind"`
+	Table    string   `json:"table"`
+	Delta    float64  `json:"delta"`
+	Value    *float64 `json:"value,omitempty"`
+	Rate     *float64 `json:"rate,omitempty"`
+	Bytes    *float64 `json:"bytes,omitempty"`
+}
+
+// webhookMetric is a single run metric in a webhookPayload, such as CollectionDuration
+type webhookMetric struct {
+	Name       string            `json:"name"`
+	Dimensions map[string]string `json:"dimensions,omitempty"`
+	Value      float64           `json:"value"`
+	Unit       string            `json:"unit,omitempty"`
+}
+
+// webhookSink posts each run's results to an HTTP endpoint, with a body rendered from a template
+// Unlike the other sinks, it posts the tables' results themselves rather than metrics, for services without a metrics backend
+type webhookSink struct {
+	config   webhookSinkConfig
+	template *template.Template
+	host     string
+}
+
+// newWebhookSink takes the webhook sink configuration and creates a webhookSink, filling in the defaults
+// The URL, header values and secret are resolved when posting, so that the configuration can be checked without them
+// It returns the sink, as well as an error if the URL, template, batch size or retry configuration is invalid
+func newWebhookSink(config webhookSinkConfig) (*webhookSink, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("webhook url must be configured")
+	}
+	if !strings.HasPrefix(config.URL, "http://") && !strings.HasPrefix(config.URL, "https://") && !strings.HasPrefix(config.URL, "env:") && !strings.HasPrefix(config.URL, "file:") {
+		return nil, fmt.Errorf("invalid webhook url %q, must be an http:// or https:// URL, or reference a secret", config.URL)
+	}
+	if config.Template == "" {
+		config.Template = defaultWebhookSinkTemplate
+	}
+	if config.SignatureHeader == "" {
+		config.SignatureHeader = defaultWebhookSignatureHeader
+	}
+	if config.BatchSize < 0 {
+		return nil, fmt.Errorf("invalid webhook batchSize %d, must be positive", config.BatchSize)
+	}
+	if _, _, err := getRetryParameters(config.Retry); err != nil {
+		return nil, fmt.Errorf("webhook %s", err)
+	}
+
+	bodyTemplate, err := template.New("webhook").Funcs(template.FuncMap{"json": toJSON}).Parse(config.Template)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook template: %s", err)
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	return &webhookSink{config: config, template: bodyTemplate, host: host}, nil
+}
+
+func (s *webhookSink) name() string {
+	return "webhook"
+}
+
+// maxBackfillAge is unlimitedBackfill, as each payload says when it was collected
+func (s *webhookSink) maxBackfillAge() time.Duration {
+	return unlimitedBackfill
+}
+
+// metrics converts each table into "delta", "value", "rate" and "bytes" datums, with the database, kind and table as dimensions
+// These are only what --dry-run prints, as publishReport posts the tables from the report itself
+func (s *webhookSink) metrics(report runReport) []metricDatum {
+	var datums []metricDatum
+	for _, delta := range getTableDeltas(report) {
+		dimensions := delta.dimensions()
+		field := func(name string, value float64, unit string, metricType string) {
+			datums = append(datums, metricDatum{Name: name, Dimensions: dimensions, Value: value, Unit: unit, Timestamp: report.CollectedAt, Type: metricType, Interval: report.Interval})
+		}
+
+		field("delta", float64(delta.Delta), "Count", metricDelta)
+		if delta.HasCount {
+			field("value", float64(delta.Count), "Count", metricGauge)
+		}
+		if report.Interval > 0 {
+			field("rate", float64(delta.Delta)/report.Interval.Seconds(), "Count/Second", metricGauge)
+		}
+		if delta.HasSize {
+			field("bytes", float64(delta.Size), "Bytes", metricGauge)
+		}
+	}
+
+	return datums
+}
+
+// publishReport posts each table in the report, split into batches of up to BatchSize, retrying each post as configured
+// A report with no tables to post, such as that of the first run, doesn't post at all
+func (s *webhookSink) publishReport(report runReport) error {
+	payloads := s.getTablePayloads(report)
+	if len(payloads) == 0 {
+		slog.Debug("No tables to post to webhook")
+		return nil
+	}
+
+	err := s.postPayloads(payloads)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Posted tables to webhook", "posts", len(payloads), "tables", len(getTableDeltas(report)))
+	return nil
+}
+
+// publishRunMetrics posts the run metrics in a payload of their own, if configured, with the run ID of the report
+func (s *webhookSink) publishRunMetrics(report runReport, datums []metricDatum) error {
+	if !s.config.RunMetrics || len(datums) == 0 {
+		return nil
+	}
+
+	err := s.postPayloads([]webhookPayload{s.getMetricsPayload(report.RunID, datums, time.Now())})
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Posted run metrics to webhook", "count", len(datums))
+	return nil
+}
+
+// publish posts the datums as run metrics, as publishRunMetrics does, but without a run ID
+// Runs and replays post their tables and run metrics with publishReport and publishRunMetrics instead
+func (s *webhookSink) publish(datums []metricDatum) error {
+	return s.publishRunMetrics(runReport{}, datums)
+}
+
+// postPayloads renders each payload with the template and posts it, retrying each post as configured
+// It returns an error as soon as a post fails, without posting the rest
+func (s *webhookSink) postPayloads(payloads []webhookPayload) error {
+	for _, payload := range payloads {
+		var body bytes.Buffer
+		err := s.template.Execute(&body, payload)
+		if err != nil {
+			return fmt.Errorf("failed to render webhook template: %s", err)
+		}
+
+		err = publishWithRetry(s.config.Retry, s.name(), func() error {
+			return s.post(body.Bytes())
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// post sends a single body to the URL, signing it if a secret is configured
+// The signature is the hex HMAC-SHA256 of the timestamp header's value, a ".", and the body, so that a captured request can't be replayed later
+// Rejected requests, other than being rate limited, are returned as a permanentError since retrying them won't help
+func (s *webhookSink) post(body []byte) error {
+	url, err := resolveSecret(s.config.URL)
+	if err != nil {
+		return permanentError{fmt.Errorf("failed to resolve webhook.url: %s", err)}
+	}
+
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return permanentError{err}
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for name, value := range s.config.Headers {
+		value, err = resolveSecret(value)
+		if err != nil {
+			return permanentError{fmt.Errorf("failed to resolve webhook header %s: %s", name, err)}
+		}
+		request.Header.Set(name, value)
+	}
+
+	if s.config.Secret != "" {
+		secret, err := resolveSecret(s.config.Secret)
+		if err != nil {
+			return permanentError{fmt.Errorf("failed to resolve webhook.secret: %s", err)}
+		}
+
+		// Sign each attempt afresh, so that a retry isn't rejected for being too old
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(timestamp + "."))
+		mac.Write(body)
+
+		request.Header.Set(webhookTimestampHeader, timestamp)
+		request.Header.Set(s.config.SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	client := http.Client{Timeout: webhookSinkTimeout}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		// Include the start of the response, which usually says what was wrong with the request
+		responseBody, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+		err = fmt.Errorf("%s responded with %s: %s", request.URL.Host, response.Status, strings.TrimSpace(string(responseBody)))
+		if response.StatusCode < 500 && response.StatusCode != http.StatusTooManyRequests {
+			return permanentError{err}
+		}
+		return err
+	}
+
+	return nil
+}
+
+// getTablePayloads converts each table in the report into a webhookTable, split into payloads of up to BatchSize tables
+// Rate is only set if the report has an interval to divide the difference by, as the first replayed snapshot doesn't
+func (s *webhookSink) getTablePayloads(report runReport) []webhookPayload {
+	var tables []webhookTable
+	for _, delta := range getTableDeltas(report) {
+		table := webhookTable{Database: delta.Database, Kind: delta.Kind, Table: delta.Table, Delta: float64(delta.Delta)}
+		if delta.HasCount {
+			value := float64(delta.Count)
+			table.Value = &value
+		}
+		if report.Interval > 0 {
+			rate := float64(delta.Delta) / report.Interval.Seconds()
+			table.Rate = &rate
+		}
+		if delta.HasSize {
+			bytes := float64(delta.Size)
+			table.Bytes = &bytes
+		}
+		tables = append(tables, table)
+	}
+
+	var payloads []webhookPayload
+
+	batchSize := s.config.BatchSize
+	if batchSize == 0 || batchSize > len(tables) {
+		batchSize = len(tables)
+	}
+	for start := 0; start < len(tables); start += batchSize {
+		end := start + batchSize
+		if end > len(tables) {
+			end = len(tables)
+		}
+
+		payloads = append(payloads, webhookPayload{
+			Host:            s.host,
+			RunID:           report.RunID,
+			CollectedAt:     report.CollectedAt,
+			IntervalSeconds: report.Interval.Seconds(),
+			Tables:          tables[start:end],
+			Metrics:         []webhookMetric{},
+		})
+	}
+
+	for i := range payloads {
+		payloads[i].Batch = i + 1
+		payloads[i].Batches = len(payloads)
+	}
+
+	return payloads
+}
+
+// getMetricsPayload converts run metrics into a payload of their own, with no tables, stamped with now
+func (s *webhookSink) getMetricsPayload(runID string, datums []metricDatum, now time.Time) webhookPayload {
+	var metrics []webhookMetric
+	for _, datum := range datums {
+		dimensions := make(map[string]string)
+		for _, dimension := range datum.Dimensions {
+			dimensions[dimension.Name] = dimension.Value
+		}
+		metrics = append(metrics, webhookMetric{Name: datum.Name, Dimensions: dimensions, Value: datum.Value, Unit: datum.Unit})
+	}
+
+	return webhookPayload{Host: s.host, RunID: runID, CollectedAt: now, Batch: 1, Batches: 1, Tables: []webhookTable{}, Metrics: metrics}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestWebhookSinkPublishReport(t *testing.T) {
+	server := newNotificationServer(t)
+	s, err := newWebhookSink(webhookSinkConfig{URL: server.URL, BatchSize: 2, RunMetrics: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := runReport{
+		RunID:       "3f9c2a7e41d05b68",
+		CollectedAt: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		Interval:    time.Minute,
+		Current: map[string]countCollection{
+			"shop": {Increment: map[string]int{"Sale": 120, "Msg": 7}, Row: map[string]int{"Product": 30}, Sizes: map[string]int64{"Sale": 4096}},
+		},
+		Differences: map[string]countCollection{
+			"shop": {Increment: map[string]int{"Sale": 60, "Msg": 0}, Row: map[string]int{"Product": -1}},
+		},
+	}
+
+	if err := publishReport(s, report, s.metrics(report)); err != nil {
+		t.Fatalf("publishReport returned an error: %s", err)
+	}
+	if err := publishRunMetrics(s, report, []metricDatum{{Name: "Heartbeat", Value: 1, Unit: "Count"}}); err != nil {
+		t.Fatalf("publishRunMetrics returned an error: %s", err)
+	}
+
+	requests := server.received()
+	if len(requests) != 3 {
+		t.Fatalf("received %d requests, expected two batches of tables and one of run metrics", len(requests))
+	}
+
+	var payloads []webhookPayload
+	for _, request := range requests {
+		var payload webhookPayload
+		if err := json.Unmarshal([]byte(request.body), &payload); err != nil {
+			t.Fatalf("body %q isn't JSON: %s", request.body, err)
+		}
+		if payload.RunID != report.RunID {
+			t.Errorf("runId is %q, expected that of the report", payload.RunID)
+		}
+		payloads = append(payloads, payload)
+	}
+
+	first := payloads[0]
+	if first.Batch != 1 || first.Batches != 2 || len(first.Tables) != 2 || !first.CollectedAt.Equal(report.CollectedAt) || first.IntervalSeconds != 60 {
+		t.Errorf("first post is %+v, expected the first batch of 2 tables collected over a minute", first)
+	}
+	sale := first.Tables[1]
+	if sale.Table != "Sale" || sale.Delta != 60 || sale.Value == nil || *sale.Value != 120 || sale.Rate == nil || *sale.Rate != 1 || sale.Bytes == nil || *sale.Bytes != 4096 {
+		t.Errorf("Sale is %+v, expected its delta, value, rate and bytes", sale)
+	}
+	if second := payloads[1]; second.Batch != 2 || len(second.Tables) != 1 || second.Tables[0].Table != "Product" || second.Tables[0].Bytes != nil {
+		t.Errorf("second post is %+v, expected the row count of Product without a size", second)
+	}
+	if metrics := payloads[2]; len(metrics.Tables) != 0 || len(metrics.Metrics) != 1 || metrics.Metrics[0].Name != "Heartbeat" {
+		t.Errorf("last post is %+v, expected only the run metrics", metrics)
+	}
+}
+
+func TestWebhookSinkPublishReportFirstRun(t *testing.T) {
+	server := newNotificationServer(t)
+	s, err := newWebhookSink(webhookSinkConfig{URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first run has nothing to compare with, and run metrics aren't posted unless configured
+	report := runReport{RunID: "3f9c2a7e41d05b68", CollectedAt: time.Now(), Current: map[string]countCollection{"shop": {Increment: map[string]int{"Sale": 120}}}}
+	if err := publishReport(s, report, s.metrics(report)); err != nil {
+		t.Fatalf("publishReport returned an error: %s", err)
+	}
+	if err := publishRunMetrics(s, report, []metricDatum{{Name: "Heartbeat", Value: 1, Unit: "Count"}}); err != nil {
+		t.Fatalf("publishRunMetrics returned an error: %s", err)
+	}
+
+	if received := len(server.received()); received != 0 {
+		t.Errorf("received %d requests, expected none", received)
+	}
+}
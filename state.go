@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// stateVersion is the version of the counts YAML format written by this version of rowmetrics
+// Version 1 is the legacy format, a bare map of database names to their countCollections, see migrateLegacyState
+const stateVersion = 2
+
+// version is the version of rowmetrics itself, recorded in the counts YAML
+// It is set at build time, with go build -ldflags "-X main.version=1.2.3"
+var version = "dev"
+
+// countState is the struct which the counts YAML will be mapped to and written as
+// It records when, where and by what the counts were collected, alongside the counts themselves
+// Alerts is the state of any alert rules that are firing, or part way to firing, keyed by getAlertKey
+type countState struct {
+	Version     int                      `yaml:"version"`
+	CollectedAt time.Time                `yaml:"collectedAt"`
+	ToolVersion string                   `yaml:"toolVersion"`
+	Host        string                   `yaml:"host"`
+	Databases   map[string]databaseState `yaml:"databases"`
+	Alerts      map[string]alertState    `yaml:"alerts,omitempty"`
+}
+
+// databaseState is the counts of a single database, as recorded in the counts YAML
+// Dialect is the database type the counts were collected with, or empty if they were migrated from the legacy format
+type databaseState struct {
+	Dialect string       `yaml:"dialect,omitempty"`
+	Counts  []countValue `yaml:"counts"`
+}
+
+// countValue is a single table's count, as recorded in the counts YAML
+// Kind is the table list it was configured in, either "increment" or "row"
+// Source is the dialect query that produced the value, such as "mysql.increment" or "sqlite.fallback"
+type countValue struct {
+	Table  string `yaml:"table"`
+	Kind   string `yaml:"kind"`
+	Value  int    `yaml:"value"`
+	Source string `yaml:"source,omitempty"`
+}
+
+// newCountState takes the countCollections of a run and the time they were collected at, and creates the state to write
+func newCountState(countCollections map[string]countCollection, collectedAt time.Time) countState {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	state := countState{
+		Version:     stateVersion,
+		CollectedAt: collectedAt.UTC(),
+		ToolVersion: version,
+		Host:        host,
+		Databases:   make(map[string]databaseState),
+	}
+
+	for countCollectionName, countCollection := range countCollections {
+		// Go through each countCollection and record each of its counts, in a stable order
+		databaseState := databaseState{Dialect: countCollection.Dialect}
+
+		for _, kind := range []string{"increment", "row"} {
+			counts := countCollection.Increment
+			if kind == "row" {
+				counts = countCollection.Row
+			}
+
+			for _, table := range getSortedKeys(counts) {
+				databaseState.Counts = append(databaseState.Counts, countValue{
+					Table:  table,
+					Kind:   kind,
+					Value:  counts[table],
+					Source: countCollection.Sources[countKey{Kind: kind, Table: table}],
+				})
+			}
+		}
+
+		state.Databases[countCollectionName] = databaseState
+	}
+
+	return state
+}
+
+// getCountCollections converts the state back into a countCollection for each database, to be compared with a new run
+func (state countState) getCountCollections() map[string]countCollection {
+	countCollections := make(map[string]countCollection)
+
+	for databaseName, databaseState := range state.Databases {
+		// Go through each database and sort its counts back into the Increment and Row maps
+		countCollection := countCollection{
+			Increment: make(map[string]int),
+			Row:       make(map[string]int),
+			Dialect:   databaseState.Dialect,
+			Sources:   make(map[countKey]string),
+		}
+
+		for _, count := range databaseState.Counts {
+			if count.Kind == "row" {
+				countCollection.Row[count.Table] = count.Value
+			} else {
+				countCollection.Increment[count.Table] = count.Value
+			}
+			countCollection.Sources[countKey{Kind: count.Kind, Table: count.Table}] = count.Source
+		}
+
+		countCollections[databaseName] = countCollection
+	}
+
+	return countCollections
+}
+
+// corruptStateError is returned by readCountState when a counts YAML file is empty or can't be parsed
+// Only a corrupt counts YAML is recovered from its backup, as any other problem, such as being written by a newer version, would recur
+type corruptStateError struct {
+	err error
+}
+
+func (e corruptStateError) Error() string {
+	return e.err.Error()
+}
+
+// loadCountState loads the state from the counts YAML file, migrating it if it is in the legacy format
+// If the file is empty or can't be parsed, such as after a crash mid-write, the backup written by writeCountState is loaded instead
+// It returns the state, as well as an error if the file couldn't be read, is from a newer version of rowmetrics, or neither file could be parsed
+func loadCountState(fileName string) (countState, error) {
+	state, err := readCountState(fileName)
+	if err == nil {
+		return state, nil
+	}
+	if _, ok := err.(corruptStateError); !ok {
+		// Falling back to the backup wouldn't help, and for a newer version would silently roll the counts back
+		return state, err
+	}
+
+	// If the counts YAML is corrupt, fall back to the backup of the previous one
+	backupState, backupErr := readCountState(getBackupPath(fileName))
+	if backupErr != nil {
+		// If the backup is unusable too, report the original problem
+		return state, err
+	}
+
+	slog.Warn("Counts YAML is unusable, loaded its backup instead", "path", fileName, "backup", getBackupPath(fileName), "error", err)
+	return backupState, nil
+}
+
+// readCountState reads and parses a single counts YAML file, migrating it if it is in the legacy format
+// It returns the state, as well as an error if the file can't be read, is from a newer version of rowmetrics, or a corruptStateError if it is empty or can't be parsed
+func readCountState(fileName string) (countState, error) {
+	var state countState
+
+	// Load the counts YAML file
+	stateSource, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return state, err
+	}
+
+	// An empty file is what a crash mid-write used to leave behind, rather than a valid empty set of counts
+	if len(stateSource) == 0 {
+		return state, corruptStateError{fmt.Errorf("%s is empty", fileName)}
+	}
+
+	// Check the version first, as the legacy format has none
+	// A legacy file with a database named "version" fails to map to an int, and is legacy all the same
+	var header struct {
+		Version int `yaml:"version"`
+	}
+	if yaml.Unmarshal(stateSource, &header) != nil || header.Version == 0 {
+		return migrateLegacyState(fileName, stateSource)
+	}
+
+	if header.Version > stateVersion {
+		return state, fmt.Errorf("%s is version %d, which is newer than this version of rowmetrics supports (%d)", fileName, header.Version, stateVersion)
+	}
+
+	// Map the YAML file to the state
+	err = yaml.Unmarshal(stateSource, &state)
+	if err != nil {
+		return state, corruptStateError{err}
+	}
+
+	// Assuming no errors, return the state and nil
+	return state, nil
+}
+
+// migrateLegacyState converts a counts YAML file in the legacy format into the current state
+// The legacy format is a bare map of database names to their countCollections, with no metadata
+// The collection time is taken from when the file was last modified, as the legacy format was written at the end of each run
+// It returns the state, as well as an error if the file can't be parsed
+func migrateLegacyState(fileName string, stateSource []byte) (countState, error) {
+	var countCollections map[string]countCollection
+
+	// Map the YAML file to the map of countCollections
+	err := yaml.Unmarshal(stateSource, &countCollections)
+	if err != nil {
+		return countState{}, corruptStateError{err}
+	}
+
+	collectedAt := time.Now()
+	if info, err := os.Stat(fileName); err == nil {
+		collectedAt = info.ModTime()
+	}
+
+	slog.Info("Migrating counts YAML from the legacy format", "path", fileName, "databases", len(countCollections))
+
+	// Convert the countCollections, which have no dialect or sources recorded
+	state := newCountState(countCollections, collectedAt)
+	state.Host = ""
+	state.ToolVersion = ""
+	return state, nil
+}
+
+// writeCountState writes the state to the counts YAML file
+// The file is replaced atomically, and the previous file is kept as a backup, see writeFileAtomic
+// It returns an error if any issues were encountered
+func writeCountState(fileName string, state countState) error {
+	// Take the state and export it into a YAML file
+	stateYaml, err := marshalYAML(&state)
+	if err != nil {
+		return err
+	}
+
+	// Write the generated YAML into the file
+	return writeFileAtomic(fileName, stateYaml, true)
+}
+
+// marshalYAML encodes a value as YAML, indented by two spaces as the counts YAML has always been written
+// It returns the YAML, as well as an error if the value can't be encoded
+func marshalYAML(value interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+
+	encoder := yaml.NewEncoder(&buffer)
+	encoder.SetIndent(2)
+	err := encoder.Encode(value)
+	if err != nil {
+		return nil, err
+	}
+
+	err = encoder.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
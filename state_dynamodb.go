@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// dynamoStateStore keeps the state as the counts YAML in a DynamoDB item
+// The table's partition key must be a string named "id", and the item's id is the configured key
+// Rather than locking, saving only succeeds if the item is still the state that was loaded, so overlapping runs can't both save
+type dynamoStateStore struct {
+	awsConfig map[string]string
+	region    string
+	table     string
+	key       string
+
+	// loaded is whether there was an item when the state was loaded
+	// loadedAt is its collectedAt, or empty if there was none or it had no collectedAt, such as an item written by hand
+	loaded   bool
+	loadedAt string
+}
+
+func (s *dynamoStateStore) describe() string {
+	return "dynamodb://" + s.table + "/" + s.key
+}
+
+func (s *dynamoStateStore) lock() (func() error, error) {
+	return func() error { return nil }, nil
+}
+
+func (s *dynamoStateStore) load() (countState, bool, error) {
+	service, err := s.getService()
+	if err != nil {
+		return countState{}, false, err
+	}
+
+	output, err := service.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		Key:            map[string]*dynamodb.AttributeValue{"id": {S: aws.String(s.key)}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return countState{}, false, err
+	}
+	if output.Item == nil {
+		s.loaded, s.loadedAt = false, ""
+		return countState{}, false, nil
+	}
+
+	stateAttribute, ok := output.Item["state"]
+	if !ok || stateAttribute.S == nil {
+		return countState{}, false, fmt.Errorf("%s has no state attribute", s.describe())
+	}
+
+	state, err := parseCountState(s.describe(), []byte(*stateAttribute.S))
+	if err != nil {
+		return state, false, err
+	}
+
+	s.loaded, s.loadedAt = true, ""
+	if collectedAt, ok := output.Item["collectedAt"]; ok && collectedAt.S != nil {
+		s.loadedAt = *collectedAt.S
+	}
+	return state, true, nil
+}
+
+func (s *dynamoStateStore) save(state countState) error {
+	service, err := s.getService()
+	if err != nil {
+		return err
+	}
+
+	stateYaml, err := marshalYAML(&state)
+	if err != nil {
+		return err
+	}
+
+	collectedAt := state.CollectedAt.UTC().Format(time.RFC3339Nano)
+	input := &dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item: map[string]*dynamodb.AttributeValue{
+			"id":          {S: aws.String(s.key)},
+			"state":       {S: aws.String(string(stateYaml))},
+			"collectedAt": {S: aws.String(collectedAt)},
+		},
+	}
+
+	// Only replace the item that was loaded, or create one if there was none
+	switch {
+	case !s.loaded:
+		input.ConditionExpression = aws.String("attribute_not_exists(id)")
+	case s.loadedAt == "":
+		input.ConditionExpression = aws.String("attribute_exists(id) AND attribute_not_exists(collectedAt)")
+	default:
+		input.ConditionExpression = aws.String("collectedAt = :loadedAt")
+		input.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{":loadedAt": {S: aws.String(s.loadedAt)}}
+	}
+
+	_, err = service.PutItem(input)
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return fmt.Errorf("%s was saved by another run since it was loaded", s.describe())
+		}
+		return fmt.Errorf("failed to put %s: %s", s.describe(), err)
+	}
+
+	s.loaded, s.loadedAt = true, collectedAt
+	return nil
+}
+
+// getService opens an AWS session and creates a DynamoDB service instance with it
+func (s *dynamoStateStore) getService() (*dynamodb.DynamoDB, error) {
+	awsSession, err := newAWSSession(s.awsConfig, s.region)
+	if err != nil {
+		return nil, err
+	}
+
+	return dynamodb.New(awsSession), nil
+}
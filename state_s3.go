@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// s3StateStore keeps the state as a counts YAML object in S3
+// Rather than locking, saving is a conditional write that only succeeds if the object is still the one that was loaded,
+// so overlapping runs can't both save
+// Enabling versioning on the bucket keeps previous states, as the backup of the counts YAML file does
+type s3StateStore struct {
+	awsConfig map[string]string
+	region    string
+	bucket    string
+	key       string
+
+	// etag is the ETag of the object that was loaded, or empty if there was none
+	etag string
+}
+
+func (s *s3StateStore) describe() string {
+	return "s3://" + s.bucket + "/" + s.key
+}
+
+func (s *s3StateStore) lock() (func() error, error) {
+	return func() error { return nil }, nil
+}
+
+func (s *s3StateStore) load() (countState, bool, error) {
+	service, err := s.getService()
+	if err != nil {
+		return countState{}, false, err
+	}
+
+	object, err := service.GetObject(&s3.GetObjectInput{Bucket: aws.String(s.bucket), Key: aws.String(s.key)})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchKey {
+			s.etag = ""
+			return countState{}, false, nil
+		}
+		return countState{}, false, err
+	}
+	defer object.Body.Close()
+	s.etag = aws.StringValue(object.ETag)
+
+	stateSource, err := ioutil.ReadAll(object.Body)
+	if err != nil {
+		return countState{}, false, err
+	}
+
+	state, err := parseCountState(s.describe(), stateSource)
+	return state, err == nil, err
+}
+
+func (s *s3StateStore) save(state countState) error {
+	service, err := s.getService()
+	if err != nil {
+		return err
+	}
+
+	stateYaml, err := marshalYAML(&state)
+	if err != nil {
+		return err
+	}
+
+	request, output := service.PutObjectRequest(&s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(s.key),
+		Body:        bytes.NewReader(stateYaml),
+		ContentType: aws.String("application/yaml"),
+	})
+
+	// Only replace the object that was loaded, or create one if there was none
+	// The SDK has no fields for conditional writes, so the headers are set directly, before the request is signed
+	if s.etag == "" {
+		request.HTTPRequest.Header.Set("If-None-Match", "*")
+	} else {
+		request.HTTPRequest.Header.Set("If-Match", s.etag)
+	}
+
+	err = request.Send()
+	if err != nil {
+		if awsErr, ok := err.(awserr.RequestFailure); ok && (awsErr.StatusCode() == http.StatusPreconditionFailed || awsErr.StatusCode() == http.StatusConflict) {
+			// A conflict is another conditional write to the object racing this one
+			return fmt.Errorf("%s was saved by another run since it was loaded", s.describe())
+		}
+		return fmt.Errorf("failed to put %s: %s", s.describe(), err)
+	}
+
+	s.etag = aws.StringValue(output.ETag)
+	return nil
+}
+
+// getService opens an AWS session and creates an S3 service instance with it
+func (s *s3StateStore) getService() (*s3.S3, error) {
+	awsSession, err := newAWSSession(s.awsConfig, s.region)
+	if err != nil {
+		return nil, err
+	}
+
+	return s3.New(awsSession), nil
+}
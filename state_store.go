@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// stateConfig is the configuration of where the state carried between runs is kept
+// Type is one of "file", "s3" or "dynamodb", defaulting to "file", which keeps it in the counts YAML at countPath
+// Bucket and Key are the S3 object, and Table and Key the DynamoDB item, the state is kept in
+// Region is the AWS region of the bucket or table, defaulting to aws.region and then the default credential chain's region
+type stateConfig struct {
+	Type   string
+	Bucket string
+	Key    string
+	Table  string
+	Region string
+}
+
+// defaults for the state configuration
+const (
+	defaultStateKey = "rowmetrics/counts.yml"
+)
+
+// stateStore is where the state carried between runs is kept, such as the counts YAML file
+type stateStore interface {
+	// describe returns where the state is kept, as used in logs, such as a path or URL
+	describe() string
+
+	// lock stops any other run from using the state until the returned function is called
+	// Stores that can't be locked instead refuse to save state that was changed since it was loaded, see save
+	// It returns an error if the lock could not be taken
+	lock() (func() error, error)
+
+	// load loads the last run's state
+	// It returns the state and true, false if no run has saved any state yet, as well as an error if the state could not be loaded
+	load() (countState, bool, error)
+
+	// save replaces the last run's state
+	// It returns an error if the state could not be saved
+	save(state countState) error
+}
+
+// getStateStore takes an applicationConfig and creates the stateStore it configures
+// It returns the store, as well as an error if the state configuration is invalid
+func getStateStore(config applicationConfig) (stateStore, error) {
+	key := config.State.Key
+	if key == "" {
+		key = defaultStateKey
+	}
+
+	switch config.State.Type {
+	case "", "file":
+		if config.CountPath == "" {
+			return nil, fmt.Errorf("countPath must be configured to keep state in a file")
+		}
+		return fileStateStore{path: config.CountPath}, nil
+	case "s3":
+		if config.State.Bucket == "" {
+			return nil, fmt.Errorf("state.bucket must be configured to keep state in S3")
+		}
+		return &s3StateStore{awsConfig: config.AwsConfig, region: config.State.Region, bucket: config.State.Bucket, key: key}, nil
+	case "dynamodb":
+		if config.State.Table == "" {
+			return nil, fmt.Errorf("state.table must be configured to keep state in DynamoDB")
+		}
+		return &dynamoStateStore{awsConfig: config.AwsConfig, region: config.State.Region, table: config.State.Table, key: key}, nil
+	default:
+		return nil, fmt.Errorf("unknown state type %q, must be one of file, s3 or dynamodb", config.State.Type)
+	}
+}
+
+// fileStateStore keeps the state in the counts YAML file, locked with a lock file next to it
+type fileStateStore struct {
+	path string
+}
+
+func (s fileStateStore) describe() string {
+	return s.path
+}
+
+func (s fileStateStore) lock() (func() error, error) {
+	lock, err := lockFile(getLockPath(s.path))
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock %s: %s", getLockPath(s.path), err)
+	}
+
+	return lock.unlock, nil
+}
+
+func (s fileStateStore) load() (countState, bool, error) {
+	if _, err := os.Stat(s.path); os.IsNotExist(err) {
+		return countState{}, false, nil
+	}
+
+	state, err := loadCountState(s.path)
+	return state, err == nil, err
+}
+
+func (s fileStateStore) save(state countState) error {
+	return writeCountState(s.path, state)
+}
+
+// parseCountState parses the counts YAML read from a remote store, rejecting a version newer than this version of rowmetrics
+// Remote stores were only added after the legacy format was replaced, so it isn't migrated
+// It returns the state, as well as an error if the YAML can't be parsed
+func parseCountState(location string, stateSource []byte) (countState, error) {
+	var state countState
+
+	err := yaml.Unmarshal(stateSource, &state)
+	if err != nil {
+		return state, fmt.Errorf("failed to parse %s: %s", location, err)
+	}
+	if state.Version == 0 || state.Version > stateVersion {
+		return state, fmt.Errorf("%s is version %d, which this version of rowmetrics doesn't support (%d)", location, state.Version, stateVersion)
+	}
+
+	return state, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadCountStateBackup(t *testing.T) {
+	backup, err := marshalYAML(newCountState(map[string]countCollection{
+		"edge": {Increment: map[string]int{"Sale": 3}, Row: map[string]int{}},
+	}, time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		counts      string
+		expectError bool
+	}{
+		{name: "empty", counts: "", expectError: false},
+		{name: "corrupt", counts: "version: 2\ndatabases: [", expectError: false},
+		{name: "newer version", counts: "version: 99\n", expectError: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "counts.yml")
+			if err := os.WriteFile(path, []byte(test.counts), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(getBackupPath(path), backup, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			state, err := loadCountState(path)
+			if test.expectError {
+				if err == nil {
+					t.Errorf("loaded %+v, expected an error rather than the backup", state)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("loadCountState returned an error: %s", err)
+			}
+			if state.getCountCollections()["edge"].Increment["Sale"] != 3 {
+				t.Errorf("loaded %+v, expected the backup", state)
+			}
+		})
+	}
+}
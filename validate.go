@@ -0,0 +1,602 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// validationProblem is a single problem found in the config YAML
+// Line is the line of the config YAML the problem was found on, or 0 if it isn't associated with a line
+type validationProblem struct {
+	Line    int
+	Message string
+}
+
+// runValidateCommand runs the validate subcommand with the given arguments
+// It prints every problem found in the config YAML, and returns the exit code for the process
+func runValidateCommand(args []string) int {
+	var (
+		configPath string
+		connect    bool
+	)
+
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	flags.StringVar(&configPath, "config", "config.yml", "path to the application config YAML file")
+	flags.BoolVar(&connect, "connect", false, "also check that each database is reachable and every listed table exists")
+	flags.Parse(args)
+
+	problems, err := validateApplicationConfig(configPath, connect)
+	if err != nil {
+		fmt.Printf("%s: %s\n", configPath, err)
+		return 1
+	}
+
+	for _, problem := range problems {
+		// Go through each problem and print it, prefixed with the file and line it was found on
+		if problem.Line > 0 {
+			fmt.Printf("%s:%d: %s\n", configPath, problem.Line, problem.Message)
+		} else {
+			fmt.Printf("%s: %s\n", configPath, problem.Message)
+		}
+	}
+
+	if len(problems) > 0 {
+		fmt.Printf("%d problem(s) found\n", len(problems))
+		return 1
+	}
+
+	fmt.Printf("%s: OK\n", configPath)
+	return 0
+}
+
+// validateApplicationConfig loads the config YAML file from a filename and checks it for problems
+// If connect is true, each database is also connected to, and checked for the tables listed
+// It returns the problems found, as well as an error if the config YAML could not be parsed at all
+func validateApplicationConfig(fileName string, connect bool) ([]validationProblem, error) {
+	var problems []validationProblem
+
+	// Load the application config YAML file
+	configSource, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse the YAML into nodes, which keep track of the lines they were found on
+	var document yaml.Node
+	err = yaml.Unmarshal(configSource, &document)
+	if err != nil {
+		return nil, err
+	}
+	if len(document.Content) == 0 {
+		return []validationProblem{{Message: "config YAML is empty"}}, nil
+	}
+	root := document.Content[0]
+
+	// Check for keys that don't map to anything, and values of the wrong shape
+	problems = append(problems, validateNode(root, reflect.TypeOf(applicationConfig{}), "")...)
+
+	// Map the YAML file to the applicationConfig object, to check the values themselves
+	// Type errors have already been reported as shape problems above, and the rest of the values are still mapped
+	config, err := loadApplicationConfig(fileName)
+	typeErr, ok := err.(*yaml.TypeError)
+	if err != nil && !ok {
+		return problems, nil
+	}
+	if ok {
+		for _, message := range typeErr.Errors {
+			// A mapping with a duplicate key isn't mapped at all, so its values would be reported as missing
+			if strings.Contains(message, "already defined") {
+				return problems, nil
+			}
+		}
+	}
+
+	for _, key := range []string{"accessKeyId", "secretAccessKey"} {
+		// Go through each AWS credential and make sure it can be resolved
+		if _, err := resolveSecret(config.AwsConfig[key]); err != nil {
+			problems = append(problems, validationProblem{
+				Line:    getNodeLine(getMappingValue(getMappingValue(root, "aws"), key), root),
+				Message: fmt.Sprintf("aws.%s cannot be resolved: %s", key, err),
+			})
+		}
+	}
+
+	if _, err := isCloudWatchEnabled(config.AwsConfig); err != nil {
+		problems = append(problems, validationProblem{
+			Line:    getNodeLine(getMappingValue(getMappingValue(root, "aws"), "enabled"), root),
+			Message: err.Error(),
+		})
+	}
+
+	if _, err := getHistoryRetention(config.History); err != nil {
+		// A bad retention would only be noticed when the history file is first appended to
+		problems = append(problems, validationProblem{
+			Line:    getNodeLine(getMappingValue(getMappingValue(root, "history"), "retention"), root),
+			Message: err.Error(),
+		})
+	}
+
+	if _, err := getStateStore(config); err != nil {
+		// A store that can't be created would only be noticed when a run loads its state
+		stateNode := getMappingValue(root, "state")
+		if stateNode == nil {
+			stateNode = getMappingValue(root, "countPath")
+		}
+		problems = append(problems, validationProblem{Line: getNodeLine(stateNode, root), Message: err.Error()})
+	}
+
+	if anomalyNode := getMappingValue(root, "anomaly"); anomalyNode != nil {
+		// Anomaly detection is only enabled by its seasonality, so a section without one is probably a mistake
+		if _, err := getAnomalyParameters(config.Anomaly); err != nil {
+			problems = append(problems, validationProblem{Line: getNodeLine(anomalyNode, root), Message: err.Error()})
+		}
+		if config.History.Path == "" {
+			problems = append(problems, validationProblem{Line: getNodeLine(anomalyNode, root), Message: "anomaly detection needs history.path to be configured"})
+		}
+	}
+
+	if config.Forecast != nil {
+		forecastNode := getMappingValue(root, "forecast")
+		if _, _, err := getForecastParameters(*config.Forecast); err != nil {
+			problems = append(problems, validationProblem{Line: getNodeLine(forecastNode, root), Message: err.Error()})
+		}
+		if config.History.Path == "" {
+			problems = append(problems, validationProblem{Line: getNodeLine(forecastNode, root), Message: "forecasting needs history.path to be configured"})
+		}
+
+		for i, limit := range config.Forecast.Limits {
+			// Go through each limit and make sure its size can be parsed
+			if _, err := parseByteSize(limit.Bytes); limit.Bytes != "" && err != nil {
+				problems = append(problems, validationProblem{
+					Line:    getNodeLine(getMappingValue(getSequenceItem(getMappingValue(forecastNode, "limits"), i), "bytes"), forecastNode, root),
+					Message: fmt.Sprintf("forecast.limits[%d].bytes: %s", i, err),
+				})
+			}
+		}
+	}
+
+	for _, sinkCheck := range []struct {
+		key        string
+		configured bool
+		create     func() error
+	}{
+		{"statsd", config.Statsd != nil, func() error { _, err := newStatsdSink(*config.Statsd); return err }},
+		{"influx", config.Influx != nil, func() error { _, err := newInfluxSink(*config.Influx); return err }},
+		{"graphite", config.Graphite != nil, func() error { _, err := newGraphiteSink(*config.Graphite); return err }},
+		{"otlp", config.OTLP != nil, func() error { _, err := newOTLPSink(*config.OTLP); return err }},
+		{"textfile", config.Textfile != nil, func() error { _, err := newTextfileSink(*config.Textfile); return err }},
+		{"emf", config.EMF != nil, func() error { _, err := newEMFSink(*config.EMF, config.AwsConfig); return err }},
+		{"gcp", config.GCP != nil, func() error { _, err := newGCPSink(*config.GCP); return err }},
+		{"azure", config.Azure != nil, func() error { _, err := newAzureSink(*config.Azure); return err }},
+		{"webhook", config.Webhook != nil, func() error { _, err := newWebhookSink(*config.Webhook); return err }},
+	} {
+		// Sinks are otherwise only created, and their configuration checked, when a run publishes
+		if !sinkCheck.configured {
+			continue
+		}
+		if err := sinkCheck.create(); err != nil {
+			problems = append(problems, validationProblem{Line: getNodeLine(getMappingValue(root, sinkCheck.key), root), Message: err.Error()})
+		}
+	}
+
+	alertsNode := getMappingValue(root, "alerts")
+	alertLines := make(map[string]int)
+
+	for i, rule := range config.Alerts {
+		// Go through each alert rule and check its values
+		var ruleNode *yaml.Node
+		if alertsNode != nil && alertsNode.Kind == yaml.SequenceNode && i < len(alertsNode.Content) {
+			ruleNode = alertsNode.Content[i]
+		}
+		line := getNodeLine(ruleNode, root)
+
+		if rule.Name == "" {
+			// Rules without a name can't be told apart in the counts YAML or the alerts
+			problems = append(problems, validationProblem{Line: line, Message: fmt.Sprintf("alerts[%d] has no name", i)})
+		} else if firstLine, ok := alertLines[rule.Name]; ok {
+			problems = append(problems, validationProblem{
+				Line:    getNodeLine(getMappingValue(ruleNode, "name"), root),
+				Message: fmt.Sprintf("duplicate alert name %q, first defined on line %d", rule.Name, firstLine),
+			})
+		} else {
+			alertLines[rule.Name] = line
+		}
+
+		if rule.Kind != "" && rule.Kind != "increment" && rule.Kind != "row" {
+			problems = append(problems, validationProblem{
+				Line:    getNodeLine(getMappingValue(ruleNode, "kind"), root),
+				Message: fmt.Sprintf("alert %q has an unknown kind %q, must be increment or row", rule.Name, rule.Kind),
+			})
+		}
+
+		conditions := 0
+		for _, condition := range []*float64{rule.Below, rule.Above, rule.Drop, rule.Anomaly} {
+			if condition != nil {
+				conditions++
+			}
+		}
+		if conditions != 1 {
+			problems = append(problems, validationProblem{Line: line, Message: fmt.Sprintf("alert %q must have exactly one of below, above, drop or anomaly", rule.Name)})
+		}
+
+		if rule.Anomaly != nil && config.Anomaly.Seasonality == "" {
+			// Anomaly scores are only computed when anomaly detection is configured
+			problems = append(problems, validationProblem{Line: line, Message: fmt.Sprintf("alert %q has an anomaly condition, which needs anomaly.seasonality to be configured", rule.Name)})
+		}
+
+		if rule.Drop != nil {
+			if _, err := getAlertWindow(rule); err != nil {
+				problems = append(problems, validationProblem{Line: getNodeLine(getMappingValue(ruleNode, "window"), ruleNode, root), Message: err.Error()})
+			}
+			if config.History.Path == "" {
+				// The trailing average is taken from the history file
+				problems = append(problems, validationProblem{Line: line, Message: fmt.Sprintf("alert %q has a drop condition, which needs history.path to be configured", rule.Name)})
+			}
+		}
+	}
+
+	notificationsNode := getMappingValue(root, "notifications")
+	channelLines := map[string]int{"log": 0}
+
+	for i, channelConfig := range config.Notifications {
+		// Go through each notification channel and make sure it can be created
+		var channelNode *yaml.Node
+		if notificationsNode != nil && notificationsNode.Kind == yaml.SequenceNode && i < len(notificationsNode.Content) {
+			channelNode = notificationsNode.Content[i]
+		}
+		line := getNodeLine(channelNode, root)
+
+		if channelConfig.Name == "" {
+			// Channels without a name can't be told apart in the logs or their rate limits
+			problems = append(problems, validationProblem{Line: line, Message: fmt.Sprintf("notifications[%d] has no name", i)})
+		} else if firstLine, ok := channelLines[channelConfig.Name]; ok {
+			message := fmt.Sprintf("duplicate notification channel name %q, first defined on line %d", channelConfig.Name, firstLine)
+			if firstLine == 0 {
+				message = fmt.Sprintf("notification channel name %q is reserved for the log channel", channelConfig.Name)
+			}
+			problems = append(problems, validationProblem{Line: getNodeLine(getMappingValue(channelNode, "name"), root), Message: message})
+		} else {
+			channelLines[channelConfig.Name] = line
+		}
+
+		if _, err := newNotificationChannel(channelConfig); err != nil {
+			problems = append(problems, validationProblem{Line: line, Message: fmt.Sprintf("notification channel %q: %s", channelConfig.Name, err)})
+		}
+	}
+
+	databasesNode := getMappingValue(root, "databases")
+	databaseLines := make(map[string]int)
+
+	for i, database := range config.Databases {
+		// Go through each configured database and check its values
+		var databaseNode *yaml.Node
+		if databasesNode != nil && databasesNode.Kind == yaml.SequenceNode && i < len(databasesNode.Content) {
+			databaseNode = databasesNode.Content[i]
+		}
+		line := getNodeLine(databaseNode, root)
+
+		if database.Name == "" {
+			// Databases without a name can't be told apart in the counts YAML or the metrics
+			problems = append(problems, validationProblem{Line: line, Message: fmt.Sprintf("databases[%d] has no name", i)})
+		} else if firstLine, ok := databaseLines[database.Name]; ok {
+			// Databases with the same name would overwrite each other's counts
+			problems = append(problems, validationProblem{
+				Line:    getNodeLine(getMappingValue(databaseNode, "name"), root),
+				Message: fmt.Sprintf("duplicate database name %q, first defined on line %d", database.Name, firstLine),
+			})
+		} else {
+			databaseLines[database.Name] = line
+		}
+
+		dialect, err := getDialect(database)
+		if err != nil {
+			// Unsupported types can't be connected to
+			problems = append(problems, validationProblem{
+				Line:    getNodeLine(getMappingValue(databaseNode, "type"), root),
+				Message: fmt.Sprintf("database %q: %s", database.Name, err),
+			})
+		}
+
+		if _, err := resolveSecret(database.Password); err != nil {
+			problems = append(problems, validationProblem{
+				Line:    getNodeLine(getMappingValue(databaseNode, "password"), root),
+				Message: fmt.Sprintf("password for database %q cannot be resolved: %s", database.Name, err),
+			})
+		}
+
+		tablesNode := getMappingValue(databaseNode, "tables")
+		if len(database.Tables.Increment) == 0 && len(database.Tables.Row) == 0 {
+			// A database without tables would be connected to for nothing
+			problems = append(problems, validationProblem{
+				Line:    getNodeLine(tablesNode, databaseNode, root),
+				Message: fmt.Sprintf("database %q has no increment or row tables", database.Name),
+			})
+		} else {
+			for _, kind := range []string{"increment", "row"} {
+				// Go through each table list, and report it if it is present but empty
+				listNode := getMappingValue(tablesNode, kind)
+				if listNode != nil && len(listNode.Content) == 0 {
+					problems = append(problems, validationProblem{
+						Line:    listNode.Line,
+						Message: fmt.Sprintf("database %q has an empty %s table list", database.Name, kind),
+					})
+				}
+			}
+		}
+
+		if connect && dialect != nil {
+			// If requested, check the database is reachable and has every table listed
+			for _, message := range checkDatabaseConnection(database, dialect) {
+				problems = append(problems, validationProblem{Line: line, Message: message})
+			}
+		}
+	}
+
+	// Order the problems by line, so they read top to bottom
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].Line < problems[j].Line
+	})
+
+	return problems, nil
+}
+
+// validateNode checks a YAML node against the type it will be mapped to
+// Keys that don't map to a field are reported, since yaml.Unmarshal silently ignores them, as are keys defined twice in the same mapping
+// Path is the location of the node in the config YAML, used to describe where the problem is
+// It returns the problems found in the node and all of its children
+func validateNode(node *yaml.Node, t reflect.Type, path string) []validationProblem {
+	var problems []validationProblem
+
+	if node.Kind == yaml.AliasNode {
+		// Aliases are checked where their anchor is defined
+		return nil
+	}
+
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			return []validationProblem{{Line: node.Line, Message: fmt.Sprintf("%s must be a mapping", describePath(path))}}
+		}
+		problems = append(problems, getDuplicateKeys(node, path)...)
+
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			// Go through each key and value, and make sure the key maps to a field
+			keyNode, valueNode := node.Content[i], node.Content[i+1]
+			field, ok := getYAMLField(t, keyNode.Value)
+			if !ok {
+				problems = append(problems, validationProblem{
+					Line:    keyNode.Line,
+					Message: fmt.Sprintf("unknown key %q in %s", keyNode.Value, describePath(path)),
+				})
+				continue
+			}
+
+			problems = append(problems, validateNode(valueNode, field.Type, joinPath(path, keyNode.Value))...)
+		}
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			return []validationProblem{{Line: node.Line, Message: fmt.Sprintf("%s must be a mapping", describePath(path))}}
+		}
+		problems = append(problems, getDuplicateKeys(node, path)...)
+
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			// Any key is valid in a map, so just check the values
+			problems = append(problems, validateNode(node.Content[i+1], t.Elem(), joinPath(path, node.Content[i].Value))...)
+		}
+	case reflect.Slice:
+		if node.Kind == yaml.ScalarNode && node.Tag == "!!null" {
+			// An empty value is an empty list
+			return nil
+		}
+		if node.Kind != yaml.SequenceNode {
+			return []validationProblem{{Line: node.Line, Message: fmt.Sprintf("%s must be a list", describePath(path))}}
+		}
+
+		for i, item := range node.Content {
+			// Go through each item and check it
+			problems = append(problems, validateNode(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	default:
+		if node.Kind != yaml.ScalarNode {
+			return []validationProblem{{Line: node.Line, Message: fmt.Sprintf("%s must be a single value", describePath(path))}}
+		}
+	}
+
+	// Duplicate keys are found before the values of a mapping are checked, so order the problems by line
+	sort.SliceStable(problems, func(i, j int) bool {
+		return problems[i].Line < problems[j].Line
+	})
+
+	return problems
+}
+
+// getDuplicateKeys finds the keys of a mapping node that are defined more than once
+// Loading the config YAML skips any mapping with one, so they are reported here rather than as the values that went missing
+// It returns a problem for each repeated key, on the line it was repeated
+func getDuplicateKeys(node *yaml.Node, path string) []validationProblem {
+	var problems []validationProblem
+
+	keyLines := make(map[string]int)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		keyNode := node.Content[i]
+		if firstLine, ok := keyLines[keyNode.Value]; ok {
+			problems = append(problems, validationProblem{
+				Line:    keyNode.Line,
+				Message: fmt.Sprintf("duplicate key %q in %s, first defined on line %d", keyNode.Value, describePath(path), firstLine),
+			})
+			continue
+		}
+		keyLines[keyNode.Value] = keyNode.Line
+	}
+
+	return problems
+}
+
+// getYAMLField finds the exported field of a struct type that a YAML key maps to
+// Fields map to their yaml tag name, or to their lowercased name if they have no tag, as yaml.Unmarshal does
+// It returns the field, as well as whether one was found
+func getYAMLField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			// Unexported fields are never mapped
+			continue
+		}
+
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+
+		if name == key {
+			return field, true
+		}
+	}
+
+	return reflect.StructField{}, false
+}
+
+// getMappingValue finds the value node for a key in a YAML mapping node
+// It returns the value node, or nil if the node isn't a mapping or doesn't have the key
+func getMappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+
+	return nil
+}
+
+// getSequenceItem finds the item at an index of a sequence node
+// It returns the item, or nil if the node is not a sequence or is too short
+func getSequenceItem(node *yaml.Node, index int) *yaml.Node {
+	if node == nil || node.Kind != yaml.SequenceNode || index >= len(node.Content) {
+		return nil
+	}
+
+	return node.Content[index]
+}
+
+// getNodeLine returns the line of the first non-nil node given
+// This allows a problem to be reported against the closest enclosing node when a key is missing
+func getNodeLine(nodes ...*yaml.Node) int {
+	for _, node := range nodes {
+		if node != nil {
+			return node.Line
+		}
+	}
+
+	return 0
+}
+
+// joinPath appends a key to a path in the config YAML
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+
+	return path + "." + key
+}
+
+// describePath returns a human readable description of a path in the config YAML
+func describePath(path string) string {
+	if path == "" {
+		return "the top level"
+	}
+
+	return path
+}
+
+// checkDatabaseConnection connects to a database and checks that every table listed for it exists
+// It returns a message for each problem found
+func checkDatabaseConnection(dbConfig databaseConfig, dialect dialect) []string {
+	dsn, err := getDatabaseDSN(dbConfig, dialect)
+	if err != nil {
+		// The unresolvable password has already been reported
+		return nil
+	}
+
+	// Create the database connection using the dialect's driver and DSN
+	db, err := sql.Open(dialect.driverName(), dsn)
+	if err != nil {
+		return []string{fmt.Sprintf("database %q cannot be opened: %s", dbConfig.Name, err)}
+	}
+	defer db.Close()
+
+	// Make sure the database is actually reachable
+	err = db.Ping()
+	if err != nil {
+		return []string{fmt.Sprintf("database %q is not reachable: %s", dbConfig.Name, err)}
+	}
+
+	// Retrieve which of the listed tables exist
+	dbSchema := getDatabaseSchema(dbConfig, dialect)
+	tables := append(append([]string{}, dbConfig.Tables.Increment...), dbConfig.Tables.Row...)
+	existingTables, err := getExistingTables(db, dialect, dbSchema, tables)
+	if err != nil {
+		return []string{fmt.Sprintf("database %q tables cannot be listed: %s", dbConfig.Name, err)}
+	}
+
+	var messages []string
+	for _, table := range tables {
+		// Go through each listed table and make sure it exists
+		if !existingTables[table] {
+			messages = append(messages, fmt.Sprintf("table %q does not exist in schema %q of database %q", table, dbSchema, dbConfig.Name))
+		}
+	}
+
+	return messages
+}
+
+// getExistingTables takes an open database and a list of table names, and checks which of them exist in a schema
+// It returns the set of table names that exist, as well as an error if they could not be retrieved
+func getExistingTables(db *sql.DB, dialect dialect, dbSchema string, tables []string) (map[string]bool, error) {
+	existingTables := make(map[string]bool)
+	if len(tables) == 0 {
+		return existingTables, nil
+	}
+
+	// Generate the query and slice of arguments to look up the tables
+	query, args, err := buildDialectQuery(dialect, dialect.tablesQuery(dbSchema), tables)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		// Go through each table found and add it to the set
+		var tableName string
+		err := rows.Scan(&tableName)
+		if err != nil {
+			return nil, err
+		}
+
+		existingTables[tableName] = true
+	}
+
+	return existingTables, rows.Err()
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// validateYAML writes a config YAML file and validates it without connecting
+// It returns each problem as "line: message", as well as the error from validateApplicationConfig
+func validateYAML(t *testing.T, config string) ([]string, error) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yml")
+	if err := ioutil.WriteFile(path, []byte(strings.TrimLeft(config, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err := validateApplicationConfig(path, false)
+	var messages []string
+	for _, problem := range problems {
+		messages = append(messages, fmt.Sprintf("%d: %s", problem.Line, problem.Message))
+	}
+
+	return messages, err
+}
+
+func TestValidateApplicationConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		expected []string
+	}{
+		{
+			name: "valid",
+			config: `
+countPath: counts.yml
+databases:
+  - name: shop
+    type: sqlite
+    database: shop.db
+    tables:
+      increment: [Sale]
+`,
+		},
+		{
+			name: "unknown keys",
+			config: `
+countPath: counts.yml
+databse: shop
+databases:
+  - name: shop
+    type: sqlite
+    database: shop.db
+    tabels:
+      increment: [Sale]
+`,
+			expected: []string{
+				`2: unknown key "databse" in the top level`,
+				`4: database "shop" has no increment or row tables`,
+				`7: unknown key "tabels" in databases[0]`,
+			},
+		},
+		{
+			name: "duplicate database names",
+			config: `
+countPath: counts.yml
+databases:
+  - name: shop
+    type: sqlite
+    database: shop.db
+    tables:
+      increment: [Sale]
+  - name: shop
+    type: sqlite
+    database: edge.db
+    tables:
+      increment: [Sale]
+      row: []
+`,
+			expected: []string{
+				`8: duplicate database name "shop", first defined on line 3`,
+				`13: database "shop" has an empty row table list`,
+			},
+		},
+		{
+			name: "unsupported type",
+			config: `
+countPath: counts.yml
+databases:
+  - name: shop
+    type: row
+    tables:
+      increment: [Sale]
+`,
+			expected: []string{
+				`4: database "shop": unsupported database type "row", must be one of ` + strings.Join(getDialectNames(), ", "),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			problems, err := validateYAML(t, test.config)
+			if err != nil {
+				t.Fatalf("validateApplicationConfig returned an error: %s", err)
+			}
+			if !reflect.DeepEqual(problems, test.expected) {
+				t.Errorf("problems are\n%s\nexpected\n%s", strings.Join(problems, "\n"), strings.Join(test.expected, "\n"))
+			}
+		})
+	}
+}
+
+func TestValidateApplicationConfigDuplicateKey(t *testing.T) {
+	problems, err := validateYAML(t, `
+countPath: counts.yml
+databases:
+  - name: shop
+    type: sqlite
+    database: shop.db
+    options:
+      mode: ro
+      mode: rw
+    tables:
+      increment: [Sale]
+countPath: other.yml
+`)
+	if err != nil {
+		t.Fatalf("validateApplicationConfig returned an error: %s", err)
+	}
+
+	expected := []string{
+		`8: duplicate key "mode" in databases[0].options, first defined on line 7`,
+		`11: duplicate key "countPath" in the top level, first defined on line 1`,
+	}
+	if !reflect.DeepEqual(problems, expected) {
+		t.Errorf("problems are\n%s\nexpected\n%s", strings.Join(problems, "\n"), strings.Join(expected, "\n"))
+	}
+}